@@ -0,0 +1,116 @@
+package networkwebsockets
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Policy for temporarily banning remote addresses that make connection
+// attempts too often (e.g. clients stuck in a reconnect loop)
+type BanPolicy struct {
+	// Number of connection attempts allowed from a single address within
+	// Window before the address is banned (0 = never ban)
+	MaxConnects int
+
+	Window time.Duration
+
+	// How long connection attempts from a banned address are rejected for
+	BanDuration time.Duration
+}
+
+// Description of a temporarily banned remote address
+type Ban struct {
+	Addr string
+
+	Expires time.Time
+}
+
+// Record a connection attempt and report whether it should be accepted
+// according to the service's BanPolicy
+func (service *Service) checkBanPolicy(r *http.Request) bool {
+	policy := service.BanPolicy
+	if policy.MaxConnects <= 0 {
+		return true
+	}
+
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	service.bansMu.Lock()
+	defer service.bansMu.Unlock()
+
+	now := time.Now()
+
+	if expires, ok := service.bans[addr]; ok {
+		if now.Before(expires) {
+			return false
+		}
+		delete(service.bans, addr)
+	}
+
+	// Only count attempts made within the policy window
+	attempts := make([]time.Time, 0, policy.MaxConnects+1)
+	for _, attempt := range service.connectAttempts[addr] {
+		if now.Sub(attempt) < policy.Window {
+			attempts = append(attempts, attempt)
+		}
+	}
+	attempts = append(attempts, now)
+
+	if len(attempts) > policy.MaxConnects {
+		delete(service.connectAttempts, addr)
+		service.bans[addr] = now.Add(policy.BanDuration)
+
+		log.Printf("Banned %s for %v after %d connection attempts within %v", addr, policy.BanDuration, len(attempts), policy.Window)
+
+		return false
+	}
+
+	service.connectAttempts[addr] = attempts
+
+	return true
+}
+
+// Return all currently banned remote addresses
+func (service *Service) Bans() []Ban {
+	service.bansMu.Lock()
+	defer service.bansMu.Unlock()
+
+	now := time.Now()
+
+	bans := make([]Ban, 0, len(service.bans))
+	for addr, expires := range service.bans {
+		if !now.Before(expires) {
+			delete(service.bans, addr)
+			continue
+		}
+		bans = append(bans, Ban{addr, expires})
+	}
+
+	sort.Sort(bansByAddr(bans))
+
+	return bans
+}
+
+// Lift the ban on the given remote address, if any, and report whether it was banned
+func (service *Service) ClearBan(addr string) bool {
+	service.bansMu.Lock()
+	defer service.bansMu.Unlock()
+
+	_, ok := service.bans[addr]
+	delete(service.bans, addr)
+	delete(service.connectAttempts, addr)
+
+	return ok
+}
+
+type bansByAddr []Ban
+
+func (b bansByAddr) Len() int           { return len(b) }
+func (b bansByAddr) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bansByAddr) Less(i, j int) bool { return b[i].Addr < b[j].Addr }
@@ -2,13 +2,69 @@ package networkwebsockets
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/richtr/bcrypt"
 )
 
+// Options controlling the behaviour of a channel, configured per channel
+// name via Service.ChannelOptions
+type ChannelOptions struct {
+	// Whether broadcasts carrying a coalesce key replace earlier broadcasts
+	// from the same source with the same key that are still queued for
+	// delivery to a peer, so slow peers only receive the latest value
+	CoalesceBroadcasts bool
+
+	// Whether each peer must acknowledge a broadcast with an 'ack' message
+	// before it is sent the next broadcast, pacing delivery to each peer
+	StopAndWait bool
+
+	// How long peers of a stop-and-wait channel have to acknowledge a
+	// broadcast before they are disconnected (0 = defaultAckTimeout)
+	AckTimeout time.Duration
+
+	// Whether broadcasts are stamped with a vector clock, so peers can
+	// restore their causal order (see SortCausally) when broadcasts from
+	// different services arrive out of order
+	VectorClocks bool
+
+	// Maximum number of broadcasts per second the local peers of the
+	// channel may send combined (0 = no limit), and the number they may
+	// send in a burst (at least 1). Broadcasts beyond the limit are dropped
+	// and their senders sent a "rate_limited" error.
+	MaxBroadcastRate float64
+	BroadcastBurst   int
+
+	// Expression deciding which local peers receive each broadcast, e.g.
+	// `"display" in peer.tags && msg.data.startsWith("ui.")` (see
+	// compileDeliveryFilter for the syntax). Empty delivers broadcasts
+	// to all peers. A channel with an invalid filter delivers no
+	// broadcasts, rather than delivering them to peers the filter was
+	// meant to exclude.
+	DeliveryFilter string
+
+	// Encoding the data of broadcasts and direct messages from local peers
+	// must have: "json" (any JSON value), "base64" (binary data in standard
+	// base64) or "" (the default) for any text. Messages with data in
+	// another encoding are not relayed and their senders are sent an
+	// "invalid_payload" error.
+	EnforceCodec string
+}
+
 type Channel struct {
+	// The service that manages this channel
+	service *Service
+
+	options ChannelOptions
+
 	serviceName string
 
 	serviceHash string
@@ -17,7 +73,8 @@ type Channel struct {
 
 	proxyPath string
 
-	// The current websocket connection instances to this named websocket
+	// The current websocket connection instances to this named websocket,
+	// changed with subscriptionsMu held (see publish and peerList)
 	peers []*Peer
 
 	// The current websocket proxy connection instances to this named websocket
@@ -26,49 +83,157 @@ type Channel struct {
 	// Buffered channel of outbound service messages.
 	broadcastBuffer chan *WireMessage
 
+	// Proxy connections that own each remote peer of this channel, by peer
+	// id, so direct messages are forwarded straight to the owning service
+	routes   map[string]*Proxy
+	routesMu sync.RWMutex
+
+	// Consumers of the channel's presence and broadcasts, see
+	// Service.SubscribeChannel
+	subscriptions   []*channelSubscription
+	subscriptionsMu sync.Mutex
+
+	// Messages that failed to be forwarded over a proxy connection, by
+	// instance id of the service at its other end, waiting for a new
+	// connection to that service
+	pendingForwards   map[string][]*queuedMessage
+	pendingForwardsMu sync.Mutex
+
+	// Times of the last failed dial to services advertising this channel, by
+	// network address, until a dial to the address succeeds
+	dialFailures   map[string]time.Time
+	dialFailuresMu sync.Mutex
+
 	// Attached DNS-SD discovery registration and browser for this Network Web Socket
 	discoveryService *DiscoveryService
 
+	// Whether this channel was pre-registered and so is kept when empty
+	persistent bool
+
+	// Channels collecting responses to ScatterGather requests, by correlation id
+	gathers   map[string]*gather
+	gathersMu sync.Mutex
+
+	// Limits and measures the rate of broadcasts from local peers
+	limiter broadcastLimiter
+
+	// Histograms of broadcasts and peer counts, see Service.ChannelMetrics
+	metrics *channelMetrics
+
+	// Number of direct messages from each local peer waiting to be written
+	// to their targets' connections, by peer id
+	inflightDirect map[string]int
+	inflightMu     sync.Mutex
+
+	// Compiled DeliveryFilter option, nil if the channel has none
+	filter deliveryFilter
+
+	// Vector clock of broadcasts on this channel and the id of this
+	// service's instance of the channel in it
+	clock   VectorClock
+	clockId string
+	clockMu sync.Mutex
+
+	// Number of running goroutines attributed to this channel, accessed
+	// atomically (see goroutineCount)
+	goroutines int64
+
+	// Long-lived workers writing shares of broadcasts to the channel's peer
+	// connections, started as broadcasts need them and fed over
+	// broadcastShares until the channel is stopped
+	broadcastShares  chan *broadcastShare
+	broadcastWorkers int
+	workersStopped   bool
+	workersMu        sync.Mutex
+
+	// Expiry time (in unix nanoseconds) of frame tracing for this channel, 0 if not traced
+	traceExpiry int64
+
+	// Writer shared by the channel's peer connections with the "channel"
+	// WriterModel, created when the first peer connects
+	writer   *channelWriter
+	writerMu sync.Mutex
+
 	done chan int // blocks until .Stop() is called
 }
 
 // Create a new Channel instance with a given service type
 func NewChannel(service *Service, serviceName string) *Channel {
-	serviceHash_BCrypt, _ := bcrypt.HashBytes([]byte(serviceName))
-	serviceHash_Base64 := base64.StdEncoding.EncodeToString(serviceHash_BCrypt)
+	return newChannelWithOptions(service, serviceName, service.ChannelOptions[serviceName])
+}
 
-	channel := &Channel{
-		serviceName: serviceName,
-		serviceHash: serviceHash_Base64,
+// Create a channel with all of its state initialised, without starting,
+// advertising or registering it
+func newChannelState(service *Service, serviceName string) *Channel {
+	return &Channel{
+		service: service,
 
+		serviceName: serviceName,
 		servicePath: fmt.Sprintf("/%s", serviceName),
 
 		peers:           make([]*Peer, 0),
 		proxies:         make([]*Proxy, 0),
 		broadcastBuffer: make(chan *WireMessage, 512),
 
+		routes:          make(map[string]*Proxy),
+		pendingForwards: make(map[string][]*queuedMessage),
+		dialFailures:    make(map[string]time.Time),
+
+		gathers:        make(map[string]*gather),
+		inflightDirect: make(map[string]int),
+
+		metrics: newChannelMetrics(),
+
+		clock:   make(VectorClock),
+		clockId: service.generateId(),
+
 		done: make(chan int, 1),
 	}
+}
 
-	channel.proxyPath = fmt.Sprintf("/%s", GenerateId())
+func newChannelWithOptions(service *Service, serviceName string, options ChannelOptions) *Channel {
+	serviceHash_BCrypt, _ := bcrypt.HashBytes([]byte(serviceName))
 
-	go channel.messageDispatcher()
+	channel := newChannelState(service, serviceName)
+	channel.options = options
+	channel.serviceHash = base64.StdEncoding.EncodeToString(serviceHash_BCrypt)
+	channel.proxyPath = fmt.Sprintf("/%s", service.generateId())
+
+	if options.DeliveryFilter != "" {
+		filter, err := compileDeliveryFilter(options.DeliveryFilter)
+		if err != nil {
+			log.Printf("err: %v", err)
+			filter = func(peer *Peer, message *WireMessage) bool { return false }
+		}
+		channel.filter = filter
+	}
+
+	if expiry, ok := service.channelTraceExpiry(serviceName); ok {
+		channel.setTraceExpiry(expiry)
+	}
+
+	channel.spawn(channel.messageDispatcher)
 
 	log.Printf("New '%s' channel peer created.", channel.serviceName)
 
+	service.channelsMu.Lock()
 	service.Channels[channel.servicePath] = channel
+	service.channelsMu.Unlock()
 
 	// Terminate channel when it is closed
-	go func() {
+	channel.spawn(func() {
 		<-channel.stopNotify()
+		service.channelsMu.Lock()
 		delete(service.Channels, channel.servicePath)
-	}()
+		service.undrain(channel.serviceName)
+		service.channelsMu.Unlock()
+	})
 
 	// Add TLS-SRP credentials for access to this service to credentials store
 	// TODO isolate this per socket
 	serviceTab[channel.serviceHash] = channel.serviceName
 
-	go channel.advertise(service.ProxyPort)
+	go channel.advertise(service.ProxyPort, service.generateId())
 
 	if service.discoveryBrowser != nil {
 
@@ -76,6 +241,9 @@ func NewChannel(service *Service, serviceName string) *Channel {
 		recordsCache := make(map[string]*DNSRecord)
 		for _, cachedRecord := range service.discoveryBrowser.cachedDNSRecords {
 			if bcrypt.Match(channel.serviceName, cachedRecord.Hash_BCrypt) {
+				if !channel.shouldProxy(cachedRecord) {
+					continue
+				}
 				if dErr := dialProxyFromDNSRecord(cachedRecord, channel); dErr != nil {
 					log.Printf("err: %v", dErr)
 				}
@@ -93,10 +261,14 @@ func NewChannel(service *Service, serviceName string) *Channel {
 	return channel
 }
 
-func (channel *Channel) advertise(port int) {
+// Advertise the channel on the network as the DNS-SD service instance with
+// the given id, unless it is already advertised
+func (channel *Channel) advertise(port int, serviceId string) {
 	if channel.discoveryService == nil {
 		// Advertise new socket type on the network
-		channel.discoveryService = NewDiscoveryService(channel.serviceName, channel.serviceHash, channel.proxyPath, port)
+		channel.discoveryService = NewDiscoveryService(channel.serviceName, channel.serviceHash, channel.proxyPath, port, channel.service.Host, channel.service.instanceId)
+		channel.discoveryService.serviceId = serviceId
+		channel.discoveryService.ipv4Addr, channel.discoveryService.ipv6Addr = channel.service.multicastAddrs()
 		channel.discoveryService.Register("local")
 	}
 }
@@ -109,34 +281,231 @@ func (channel *Channel) messageDispatcher() {
 			if !ok {
 				return
 			}
+			if channel.options.VectorClocks {
+				if wsBroadcast.fromProxy {
+					channel.witnessClock(wsBroadcast.Clock)
+				} else {
+					wsBroadcast.Clock = channel.tickClock()
+				}
+			}
+			// Send sampled broadcasts to their chosen peers only
+			if wsBroadcast.Action == "sample" {
+				targets := channel.sampleBroadcast(wsBroadcast)
+				channel.service.observe(channel.serviceName, "broadcast", wsBroadcast.Source, targets, wsBroadcast.Payload)
+				continue
+			}
 			// Send message to local peers
-			channel.localBroadcast(wsBroadcast)
+			var targets []string
+			if !wsBroadcast.remoteOnly {
+				targets = channel.localBroadcast(wsBroadcast)
+			}
 			// Send message to remote proxies
 			channel.remoteBroadcast(wsBroadcast)
+
+			channel.service.observe(channel.serviceName, "broadcast", wsBroadcast.Source, targets, wsBroadcast.Payload)
 		}
 	}
 }
 
 // Broadcast a message to all peer connections for this Channel
-// instance (except to the src websocket connection)
-func (channel *Channel) localBroadcast(broadcast *WireMessage) {
+// instance (except to the src websocket connection) and return the ids of
+// the peer connections written to
+func (channel *Channel) localBroadcast(broadcast *WireMessage) []string {
 	// Write to peer connections
-	for _, peer := range channel.peers {
+	routed := time.Now()
+	targets := channel.deliverBroadcast(broadcast, channel.localRecipients(broadcast), routed)
+
+	// Write to peer connections of subtree channels matching this channel
+	if channel.service == nil || isSubtreeChannelName(channel.serviceName) {
+		return targets
+	}
+	coalesceKey, deadline := channel.writeOptions(broadcast)
+	for _, subtree := range channel.service.channelList() {
+		if !subtree.matchesSubtree(channel.serviceName) {
+			continue
+		}
+		wireData, err := encodeSubtreeBroadcastWireMessage(broadcast.Source, channel.serviceName, broadcast.Payload)
+		if err != nil {
+			continue
+		}
+		// Subtree channels route and filter broadcasts with their own options
+		recipients := subtree.localRecipients(broadcast)
+		for _, peer := range recipients {
+			targets = append(targets, peer.id)
+		}
+		subtree.writeBroadcasts(recipients, wireData, coalesceKey, deadline)
+	}
+
+	return targets
+}
+
+// Return the key to coalesce a broadcast's queued writes with, if any, and
+// the deadline to write it by, zero if it has none
+func (channel *Channel) writeOptions(broadcast *WireMessage) (string, time.Time) {
+	coalesceKey := ""
+	if channel.options.CoalesceBroadcasts && broadcast.CoalesceKey != "" {
+		coalesceKey = broadcast.Source + "/" + broadcast.CoalesceKey
+	}
+
+	var deadline time.Time
+	if broadcast.Deadline > 0 {
+		deadline = time.Unix(0, broadcast.Deadline*int64(time.Millisecond))
+		if broadcast.fromProxy {
+			deadline = deadline.Add(channel.service.clockSkewTolerance())
+		}
+	} else if broadcast.MaxAge > 0 {
+		deadline = time.Now().Add(time.Duration(broadcast.MaxAge) * time.Millisecond)
+	}
+
+	return coalesceKey, deadline
+}
+
+// Publish a broadcast to the channel's subscriptions and write it to the
+// given local peer connections, routed to them at the given time, and
+// return the ids of the peer connections written to
+func (channel *Channel) deliverBroadcast(broadcast *WireMessage, recipients []*Peer, routed time.Time) []string {
+	targets := make([]string, 0, len(recipients))
+
+	channel.publish(nil, WireMessage{Action: "broadcast", Source: broadcast.Source, Payload: broadcast.Payload})
+
+	coalesceKey, deadline := channel.writeOptions(broadcast)
+	m := WireMessage{
+		Action:  "broadcast",
+		Source:  broadcast.Source,
+		Payload: broadcast.Payload,
+		Clock:   broadcast.Clock,
+	}
+	if wireData, err := json.Marshal(m); err == nil {
+		routedSpan := ""
+		if broadcast.TraceParent != "" {
+			routedSpan = channel.service.exportSpan("routed", channel.serviceName, broadcast.Source, broadcast.TraceParent, routed)
+		}
+		delivered := time.Now()
+		channel.writeBroadcasts(recipients, wireData, coalesceKey, deadline)
+		channel.metrics.recordBroadcast(broadcast.Payload, time.Since(delivered))
+		if routedSpan != "" {
+			channel.service.exportSpan("delivered", channel.serviceName, broadcast.Source, routedSpan, delivered)
+		}
+		for _, peer := range recipients {
+			targets = append(targets, peer.id)
+		}
+	}
+
+	return targets
+}
+
+// Return the local peer connections of this channel a broadcast is
+// delivered to, as chosen by the service's Router and the channel's
+// DeliveryFilter, except the broadcast's source and peers outside its shard
+func (channel *Channel) localRecipients(broadcast *WireMessage) []*Peer {
+	recipients := make([]*Peer, 0, len(channel.peers))
+	for _, peer := range channel.filterRecipients(broadcast, channel.route(broadcast, channel.peers)) {
 		// don't send back to self
-		if peer.id == broadcast.Source {
+		// only write to peers in the target shard, if any
+		if peer.id == broadcast.Source || !peer.inShard(broadcast.Shard) {
 			continue
 		}
-		if wireData, err := encodeWireMessage("broadcast", broadcast.Source, "", broadcast.Payload); err == nil {
-			peer.transport.Write(wireData)
+		recipients = append(recipients, peer)
+	}
+	return recipients
+}
+
+// Write a broadcast to the given peer connections, spread over up to the
+// service's BroadcastConcurrency broadcast workers. Returns once the
+// broadcast has been written to every peer, so that each peer receives
+// successive broadcasts in order.
+func (channel *Channel) writeBroadcasts(peers []*Peer, wireData []byte, coalesceKey string, deadline time.Time) {
+	workers := 1
+	if channel.service != nil && channel.service.BroadcastConcurrency > 1 {
+		workers = channel.service.BroadcastConcurrency
+	}
+	if workers > len(peers) {
+		workers = len(peers)
+	}
+
+	channel.workersMu.Lock()
+
+	// Write on the dispatcher when the channel has no goroutines to spare
+	// for more workers, holding up further broadcasts
+	if budget := channel.goroutineBudget(); budget >= 0 && workers > channel.broadcastWorkers+budget {
+		workers = channel.broadcastWorkers + budget
+	}
+
+	if workers <= 1 || channel.workersStopped {
+		channel.workersMu.Unlock()
+		for _, peer := range peers {
+			peer.writeBroadcast(wireData, coalesceKey, deadline)
 		}
+		return
+	}
+
+	channel.startBroadcastWorkers(workers)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for worker := 0; worker < workers; worker++ {
+		channel.broadcastShares <- &broadcastShare{peers, worker, workers, wireData, coalesceKey, deadline, &wg}
+	}
+	channel.workersMu.Unlock()
+
+	wg.Wait()
+}
+
+// Every stride'th peer connection of a broadcast from the offset on, for a
+// broadcast worker to write the broadcast to
+type broadcastShare struct {
+	peers  []*Peer
+	offset int
+	stride int
+
+	wireData    []byte
+	coalesceKey string
+	deadline    time.Time
+
+	done *sync.WaitGroup
+}
+
+// Start broadcast workers until the channel has at least the given number.
+// Must be called with workersMu held.
+func (channel *Channel) startBroadcastWorkers(workers int) {
+	if channel.broadcastShares == nil {
+		channel.broadcastShares = make(chan *broadcastShare)
+	}
+
+	shares := channel.broadcastShares
+	for ; channel.broadcastWorkers < workers; channel.broadcastWorkers++ {
+		channel.spawn(func() {
+			for share := range shares {
+				for i := share.offset; i < len(share.peers); i += share.stride {
+					share.peers[i].writeBroadcast(share.wireData, share.coalesceKey, share.deadline)
+				}
+				share.done.Done()
+			}
+		})
+	}
+}
+
+// Stop the channel's broadcast workers, after which broadcasts are written
+// on the dispatcher
+func (channel *Channel) stopBroadcastWorkers() {
+	channel.workersMu.Lock()
+	defer channel.workersMu.Unlock()
+
+	if channel.workersStopped {
+		return
+	}
+	channel.workersStopped = true
+	if channel.broadcastShares != nil {
+		close(channel.broadcastShares)
 	}
 }
 
 // Broadcast a message to all proxy connections for this Channel
 // instance (except to the src websocket connection)
 func (channel *Channel) remoteBroadcast(broadcast *WireMessage) {
-	// Only send to remote proxies if this message was not received from a proxy itself
-	if broadcast.fromProxy {
+	// Only send to remote proxies if this message was not received from a
+	// proxy itself, unless this service relays messages for the channel
+	if broadcast.fromProxy && !channel.isRelay() {
 		return
 	}
 
@@ -147,12 +516,293 @@ func (channel *Channel) remoteBroadcast(broadcast *WireMessage) {
 		if !proxy.writeable || proxy.base.id == broadcast.Source {
 			continue
 		}
-		if wireData, err := encodeWireMessage("broadcast", broadcast.Source, "", broadcast.Payload); err == nil {
+		traceParent := ""
+		if broadcast.TraceParent != "" {
+			traceParent = channel.service.exportSpan("forwarded", channel.serviceName, broadcast.Source, broadcast.TraceParent, time.Now())
+		}
+		m := WireMessage{
+			Action:      "broadcast",
+			Source:      broadcast.Source,
+			Payload:     broadcast.Payload,
+			CoalesceKey: broadcast.CoalesceKey,
+			Shard:       broadcast.Shard,
+			Clock:       broadcast.Clock,
+			MaxAge:      broadcast.MaxAge,
+			Deadline:    broadcast.Deadline,
+			TraceParent: traceParent,
+		}
+		if wireData, err := json.Marshal(m); err == nil {
+			proxy.base.transport.Write(wireData)
+		}
+	}
+}
+
+// Whether the given channel name subscribes to a subtree of dot-separated
+// channel names (e.g. "house.livingroom.*")
+func isSubtreeChannelName(name string) bool {
+	return strings.HasSuffix(name, ".*")
+}
+
+// Whether this is a subtree channel matching the given channel name
+func (channel *Channel) matchesSubtree(name string) bool {
+	if !isSubtreeChannelName(channel.serviceName) || isSubtreeChannelName(name) {
+		return false
+	}
+	return strings.HasPrefix(name, strings.TrimSuffix(channel.serviceName, "*"))
+}
+
+// Return the host of the service that owns this channel according to the
+// service's ChannelHostPolicy, or "" if the channel is not pinned to a host
+func (channel *Channel) ownerHost() string {
+	if channel.service == nil {
+		return ""
+	}
+	return channel.service.ChannelHostPolicy[channel.serviceName]
+}
+
+// Whether this service owns a pinned channel and so must relay messages
+// and presence between the proxy connections of the channel
+func (channel *Channel) isRelay() bool {
+	owner := channel.ownerHost()
+	return owner != "" && owner == channel.service.Host
+}
+
+// Whether this channel should federate with the given discovered service.
+// Services that do not own a pinned channel only federate with its owner.
+func (channel *Channel) shouldProxy(record *DNSRecord) bool {
+	owner := channel.ownerHost()
+	return owner == "" || owner == channel.service.Host || owner == record.ServiceHost
+}
+
+// Record the outcome of dialing a service advertising this channel at the
+// given network address
+func (channel *Channel) recordDial(addr string, err error) {
+	channel.dialFailuresMu.Lock()
+	if err != nil {
+		channel.dialFailures[addr] = time.Now()
+	} else {
+		delete(channel.dialFailures, addr)
+	}
+	channel.dialFailuresMu.Unlock()
+}
+
+// Return the local peer connection that connected with the given client
+// instance id, or nil if there is none
+func (channel *Channel) peerWithInstance(instance string) *Peer {
+	if channel == nil || instance == "" {
+		return nil
+	}
+	for _, peer := range channel.peers {
+		if peer.instance == instance {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Whether the given peer id belongs to a local peer connection of this channel
+// Return a copy of the channel's local peer connections, which can be
+// iterated over while peers connect and disconnect
+func (channel *Channel) peerList() []*Peer {
+	channel.subscriptionsMu.Lock()
+	defer channel.subscriptionsMu.Unlock()
+
+	return append([]*Peer(nil), channel.peers...)
+}
+
+func (channel *Channel) isLocalPeer(id string) bool {
+	for _, peer := range channel.peers {
+		if peer.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Send a message to all writeable proxy connections except the given proxy
+func (channel *Channel) relayToProxies(from *Proxy, wireData []byte) {
+	for _, proxy := range channel.proxies {
+		if proxy.writeable && proxy != from {
 			proxy.base.transport.Write(wireData)
 		}
 	}
 }
 
+// Broadcast a message to a random sample of the local and remote peer
+// connections of this channel (except to the src websocket connection) and
+// return the ids of the local peer connections written to
+func (channel *Channel) sampleBroadcast(broadcast *WireMessage) []string {
+	routed := time.Now()
+
+	// Deliver samples chosen by a remote service to their target peer only,
+	// unless the service's Router or the channel's DeliveryFilter leave it out
+	if broadcast.fromProxy {
+		for _, peer := range channel.localRecipients(broadcast) {
+			if peer.id == broadcast.Target {
+				return channel.deliverBroadcast(broadcast, []*Peer{peer}, routed)
+			}
+		}
+		return nil
+	}
+
+	// Collect all candidate peer ids in a deterministic order
+	population := make([]string, 0, len(channel.peers))
+	owners := make(map[string]*Proxy)
+	locals := make(map[string]*Peer)
+	for _, peer := range channel.localRecipients(broadcast) {
+		population = append(population, peer.id)
+		locals[peer.id] = peer
+	}
+	for _, proxy := range channel.proxies {
+		for peerId, _ := range proxy.peerIds {
+			if _, ok := owners[peerId]; !ok {
+				population = append(population, peerId)
+				owners[peerId] = proxy
+			}
+		}
+	}
+	sort.Strings(population)
+
+	size := broadcast.Count
+	if size <= 0 {
+		size = int(broadcast.Fraction*float64(len(population)) + 0.5)
+	}
+	if size > len(population) {
+		size = len(population)
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	seed := broadcast.Seed
+	if seed == 0 {
+		seed = channel.service.randomSeed()
+	}
+	random := rand.New(rand.NewSource(seed))
+
+	recipients := make([]*Peer, 0, size)
+	for _, i := range random.Perm(len(population))[:size] {
+		target := population[i]
+
+		if proxy, ok := owners[target]; ok {
+			channel.forwardSample(proxy, broadcast, target)
+			continue
+		}
+
+		recipients = append(recipients, locals[target])
+	}
+
+	if len(recipients) == 0 {
+		return nil
+	}
+	return channel.deliverBroadcast(broadcast, recipients, routed)
+}
+
+// Forward a sampled broadcast over a proxy connection to the remote peer
+// it was chosen for
+func (channel *Channel) forwardSample(proxy *Proxy, broadcast *WireMessage, target string) {
+	traceParent := ""
+	if broadcast.TraceParent != "" {
+		traceParent = channel.service.exportSpan("forwarded", channel.serviceName, broadcast.Source, broadcast.TraceParent, time.Now())
+	}
+	m := WireMessage{
+		Action:      "broadcast",
+		Source:      broadcast.Source,
+		Target:      target,
+		Payload:     broadcast.Payload,
+		Shard:       broadcast.Shard,
+		Clock:       broadcast.Clock,
+		MaxAge:      broadcast.MaxAge,
+		Deadline:    broadcast.Deadline,
+		TraceParent: traceParent,
+	}
+	if wireData, err := json.Marshal(m); err == nil {
+		proxy.base.transport.Write(wireData)
+	}
+}
+
+// Send a request to all peer connections of this channel and return their
+// responses, once all peers have responded or the timeout elapses
+func (channel *Channel) scatterGather(payload string, timeout time.Duration) []WireMessage {
+	correlation := channel.service.generateId()
+	responses := make(chan WireMessage, len(channel.peers))
+
+	channel.gathersMu.Lock()
+	channel.gathers[correlation] = &gather{responses: responses, responded: make(map[string]bool)}
+	channel.gathersMu.Unlock()
+
+	// Drop all responses received after the timeout
+	defer func() {
+		channel.gathersMu.Lock()
+		delete(channel.gathers, correlation)
+		channel.gathersMu.Unlock()
+	}()
+
+	if wireData, err := encodeCorrelatedWireMessage("request", "", "", payload, correlation); err == nil {
+		for _, peer := range channel.peers {
+			peer.transport.Write(wireData)
+		}
+	}
+
+	collected := make([]WireMessage, 0, cap(responses))
+	deadline := time.After(timeout)
+	for len(collected) < cap(responses) {
+		select {
+		case response := <-responses:
+			collected = append(collected, response)
+		case <-deadline:
+			return collected
+		}
+	}
+	return collected
+}
+
+// Responses collected for a ScatterGather request
+type gather struct {
+	responses chan WireMessage
+
+	// Ids of the peers that have responded, each peer's first response is
+	// kept and later ones are dropped
+	responded map[string]bool
+}
+
+// Pass a peer's response to the ScatterGather request it responds to, if
+// that request is still collecting responses and the peer has not
+// responded to it yet
+func (channel *Channel) deliverResponse(response WireMessage) {
+	channel.gathersMu.Lock()
+	defer channel.gathersMu.Unlock()
+
+	gather, ok := channel.gathers[response.Correlation]
+	if !ok || gather.responded[response.Source] {
+		return
+	}
+	gather.responded[response.Source] = true
+
+	select {
+	case gather.responses <- response:
+	default:
+	}
+}
+
+func (channel *Channel) setTraceExpiry(expiry time.Time) {
+	if expiry.IsZero() {
+		atomic.StoreInt64(&channel.traceExpiry, 0)
+		return
+	}
+	atomic.StoreInt64(&channel.traceExpiry, expiry.UnixNano())
+}
+
+// Log a frame sent or received on this channel if frame tracing is enabled
+func (channel *Channel) trace(direction string, id string, buf []byte) {
+	expiry := atomic.LoadInt64(&channel.traceExpiry)
+	if expiry == 0 || time.Now().UnixNano() > expiry {
+		return
+	}
+
+	log.Printf("Channel '%s' trace: %s %s (%d bytes) %s", channel.serviceName, direction, id, len(buf), buf)
+}
+
 // Destroy this Network Web Socket service instance, close all
 // peer and proxy connections.
 func (channel *Channel) Stop() {
@@ -169,6 +819,16 @@ func (channel *Channel) Stop() {
 		proxy.Stop()
 	}
 
+	channel.unsubscribeAll()
+
+	channel.writerMu.Lock()
+	if channel.writer != nil {
+		channel.writer.Stop()
+	}
+	channel.writerMu.Unlock()
+
+	channel.stopBroadcastWorkers()
+
 	// Indicate object is closed
 	channel.done <- 1
 }
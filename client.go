@@ -1,8 +1,13 @@
 package networkwebsockets
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/richtr/websocket"
@@ -34,6 +39,22 @@ func (handler *ClientMessageHandler) Read(buf []byte) error {
 		client.Broadcast <- message
 	case "message":
 		client.Message <- message
+	case "error":
+		client.Error <- message
+	case "request":
+		client.Request <- message
+	case "migrate":
+		// Clients dialed with Dial move to the new channel before passing
+		// the message on
+		if client.url != nil {
+			go client.migrate(message)
+		} else {
+			client.Migrate <- message
+		}
+	case "drain":
+		client.Drain <- message
+	case "echo":
+		client.Echo <- message
 	}
 
 	return nil
@@ -45,24 +66,25 @@ func (handler *ClientMessageHandler) Write(buf []byte) error {
 		return errors.New("ClientMessageHandler requires an attached Client object")
 	}
 
-	if !client.transport.open {
+	transport := client.currentTransport()
+	if !transport.open {
 		return errors.New("Client is not active")
 	}
 
-	client.transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	client.transport.conn.WriteMessage(websocket.TextMessage, buf)
+	transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	transport.conn.WriteMessage(websocket.TextMessage, buf)
 
 	return nil
 }
 
-func Dial(urlStr string, handler MessageHandler) (*Client, *http.Response, error) {
-	d := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
-		ReadBufferSize:   8192,
-		WriteBufferSize:  8192,
-	}
+var clientDialer = websocket.Dialer{
+	HandshakeTimeout: 10 * time.Second,
+	ReadBufferSize:   8192,
+	WriteBufferSize:  8192,
+}
 
-	wsConn, httpResp, err := d.Dial(urlStr, nil)
+func Dial(urlStr string, handler MessageHandler) (*Client, *http.Response, error) {
+	wsConn, httpResp, err := clientDialer.Dial(urlStr, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -71,9 +93,11 @@ func Dial(urlStr string, handler MessageHandler) (*Client, *http.Response, error
 
 	client := NewClient(transport)
 
-	// Setup default client message handler if one has not been provided
+	// Setup default client message handler if one has not been provided,
+	// which reconnects the client when it is migrated to another channel
 	if client.transport.handler == nil {
 		client.transport.handler = &ClientMessageHandler{client}
+		client.url, _ = url.Parse(urlStr)
 	}
 
 	// Start read/write pumps
@@ -85,8 +109,17 @@ func Dial(urlStr string, handler MessageHandler) (*Client, *http.Response, error
 // Client interface
 
 type Client struct {
-	// Underlying transport object
-	transport *Transport
+	// Underlying transport object, replaced when the client is migrated to
+	// another channel
+	transport   *Transport
+	transportMu sync.RWMutex
+
+	// URL the client is connected to, nil if it does not reconnect when
+	// migrated
+	url *url.URL
+
+	// Whether Stop has been called
+	stopped bool
 
 	// incoming message channels
 	Status     chan WireMessage
@@ -94,6 +127,15 @@ type Client struct {
 	Disconnect chan WireMessage
 	Message    chan WireMessage
 	Broadcast  chan WireMessage
+	Error      chan WireMessage
+	Request    chan WireMessage
+	Migrate    chan WireMessage
+	Drain      chan WireMessage
+	Echo       chan WireMessage
+
+	// Messages read but not matched by WaitFor
+	pending   []WireMessage
+	pendingMu sync.Mutex
 }
 
 func NewClient(transport *Transport) *Client {
@@ -105,6 +147,11 @@ func NewClient(transport *Transport) *Client {
 		Disconnect: make(chan WireMessage, 255),
 		Message:    make(chan WireMessage, 255),
 		Broadcast:  make(chan WireMessage, 255),
+		Error:      make(chan WireMessage, 255),
+		Request:    make(chan WireMessage, 255),
+		Migrate:    make(chan WireMessage, 255),
+		Drain:      make(chan WireMessage, 255),
+		Echo:       make(chan WireMessage, 255),
 	}
 
 	return client
@@ -112,19 +159,170 @@ func NewClient(transport *Transport) *Client {
 
 func (client *Client) Start() {
 	// Start read/write pumps
-	client.transport.Start()
+	client.currentTransport().Start()
 }
 
 func (client *Client) Stop() {
+	client.transportMu.Lock()
+	client.stopped = true
+	client.transportMu.Unlock()
+
 	// Stop read/write pumps
-	client.transport.Stop()
+	client.currentTransport().Stop()
+}
+
+// Return the transport of the client's current connection
+func (client *Client) currentTransport() *Transport {
+	client.transportMu.RLock()
+	defer client.transportMu.RUnlock()
+
+	return client.transport
+}
+
+// Reconnect to the channel a migrate message names, presenting its token to
+// keep this client's peer id, then close the current connection and pass
+// the message on to the Migrate channel. The client stays connected to the
+// current channel if it cannot reconnect.
+func (client *Client) migrate(message WireMessage) {
+	defer func() { client.Migrate <- message }()
+
+	client.transportMu.RLock()
+	migrated := *client.url
+	client.transportMu.RUnlock()
+
+	migrated.Path = "/" + message.Payload
+	query := migrated.Query()
+	query.Set("migrate", message.Correlation)
+	migrated.RawQuery = query.Encode()
+
+	wsConn, _, err := clientDialer.Dial(migrated.String(), nil)
+	if err != nil {
+		log.Printf("err: %v", err)
+		return
+	}
+
+	previous := client.currentTransport()
+	transport := NewTransport(wsConn, previous.handler)
+
+	previous.Stop()
+
+	client.transportMu.Lock()
+	if client.stopped {
+		client.transportMu.Unlock()
+		wsConn.Close()
+		return
+	}
+	client.transport = transport
+	client.url = &migrated
+	client.transportMu.Unlock()
+
+	transport.Start()
+}
+
+// WaitFor returns the first incoming message, of any action, for which match
+// returns true. Messages that do not match are buffered and checked by
+// subsequent calls to WaitFor, so callers can wait for specific messages
+// regardless of the order they arrive in. Buffered messages are no longer
+// delivered on the client's incoming message channels.
+func (client *Client) WaitFor(ctx context.Context, match func(WireMessage) bool) (WireMessage, error) {
+	client.pendingMu.Lock()
+	defer client.pendingMu.Unlock()
+
+	for i, message := range client.pending {
+		if match(message) {
+			client.pending = append(client.pending[:i], client.pending[i+1:]...)
+			return message, nil
+		}
+	}
+
+	for {
+		var message WireMessage
+
+		select {
+		case message = <-client.Status:
+		case message = <-client.Connect:
+		case message = <-client.Disconnect:
+		case message = <-client.Message:
+		case message = <-client.Broadcast:
+		case message = <-client.Error:
+		case message = <-client.Request:
+		case message = <-client.Migrate:
+		case message = <-client.Drain:
+		case message = <-client.Echo:
+		case <-ctx.Done():
+			return WireMessage{}, ctx.Err()
+		}
+
+		if match(message) {
+			return message, nil
+		}
+
+		client.pending = append(client.pending, message)
+	}
 }
 
 // Default Client Message Handler Helper functions
 
 func (client *Client) SendBroadcastData(data string) {
 	if wireData, err := encodeWireMessage("broadcast", "", "", data); err == nil {
-		client.transport.Write(wireData)
+		client.currentTransport().Write(wireData)
+	}
+}
+
+func (client *Client) SendCoalescedBroadcastData(data string, coalesceKey string) {
+	m := WireMessage{
+		Action:      "broadcast",
+		Payload:     data,
+		CoalesceKey: coalesceKey,
+	}
+
+	if wireData, err := json.Marshal(m); err == nil {
+		client.currentTransport().Write(wireData)
+	}
+}
+
+func (client *Client) SendShardBroadcastData(data string, shard string) {
+	m := WireMessage{
+		Action:  "broadcast",
+		Payload: data,
+		Shard:   shard,
+	}
+
+	if wireData, err := json.Marshal(m); err == nil {
+		client.currentTransport().Write(wireData)
+	}
+}
+
+// Send a broadcast that is dropped for peers it cannot be written to
+// within maxAge
+func (client *Client) SendBroadcastDataWithMaxAge(data string, maxAge time.Duration) {
+	m := WireMessage{
+		Action:  "broadcast",
+		Payload: data,
+		MaxAge:  int(maxAge / time.Millisecond),
+	}
+
+	if wireData, err := json.Marshal(m); err == nil {
+		client.currentTransport().Write(wireData)
+	}
+}
+
+func (client *Client) SendRemoteBroadcastData(data string) {
+	if wireData, err := encodeWireMessage("remotebroadcast", "", "", data); err == nil {
+		client.currentTransport().Write(wireData)
+	}
+}
+
+func (client *Client) SendSampleBroadcastData(data string, fraction float64, seed int64) {
+	m := WireMessage{
+		Action:   "sample",
+		Payload:  data,
+		Fraction: fraction,
+		Seed:     seed,
+	}
+
+	if wireData, err := json.Marshal(m); err == nil {
+		client.currentTransport().Write(wireData)
 	}
 }
 
@@ -134,12 +332,50 @@ func (client *Client) SendMessageData(data string, targetId string) {
 	}
 
 	if wireData, err := encodeWireMessage("message", "", targetId, data); err == nil {
-		client.transport.Write(wireData)
+		client.currentTransport().Write(wireData)
+	}
+}
+
+func (client *Client) SendAck() {
+	if wireData, err := encodeWireMessage("ack", "", "", ""); err == nil {
+		client.currentTransport().Write(wireData)
+	}
+}
+
+func (client *Client) SendResponseData(data string, correlation string) {
+	if wireData, err := encodeCorrelatedWireMessage("response", "", "", data, correlation); err == nil {
+		client.currentTransport().Write(wireData)
+	}
+}
+
+func (client *Client) SendCreditWindow(window int) {
+	m := WireMessage{
+		Action: "credit",
+		Count:  window,
+	}
+
+	if wireData, err := json.Marshal(m); err == nil {
+		client.currentTransport().Write(wireData)
+	}
+}
+
+// Send an echo request, stamped with the current time, that is returned by
+// the service (or passed on to targetId, if not empty) with the time the
+// service received it
+func (client *Client) SendEcho(targetId string) {
+	m := WireMessage{
+		Action:     "echo",
+		Target:     targetId,
+		ClientTime: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	if wireData, err := json.Marshal(m); err == nil {
+		client.currentTransport().Write(wireData)
 	}
 }
 
 func (client *Client) SendStatusRequest() {
 	if wireData, err := encodeWireMessage("status", "", "", ""); err == nil {
-		client.transport.Write(wireData)
+		client.currentTransport().Write(wireData)
 	}
 }
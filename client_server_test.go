@@ -1,8 +1,30 @@
 package networkwebsockets
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/richtr/bcrypt"
+	"github.com/richtr/mdns"
+	"github.com/richtr/websocket"
 )
 
 func createClient(t testing.TB, urlStr string) *Client {
@@ -62,6 +84,109 @@ func checkMessage(t testing.TB, payload string, targetId string, sender *Client,
 	}
 }
 
+// Concurrency-safe log output capture
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func captureLog() *logBuffer {
+	lb := &logBuffer{}
+	log.SetOutput(lb)
+	return lb
+}
+
+func releaseLog() {
+	log.SetOutput(os.Stderr)
+}
+
+// Message handler that records written messages, blocking each write until released
+type slowMessageHandler struct {
+	release chan bool
+	written chan string
+}
+
+func newSlowMessageHandler() *slowMessageHandler {
+	return &slowMessageHandler{
+		release: make(chan bool),
+		written: make(chan string, 255),
+	}
+}
+
+func (handler *slowMessageHandler) Read(buf []byte) error { return nil }
+
+func (handler *slowMessageHandler) Write(buf []byte) error {
+	<-handler.release
+	handler.written <- string(buf)
+	return nil
+}
+
+// Message handler that records the actions of all received messages
+type recordingMessageHandler struct {
+	actions chan string
+}
+
+func newRecordingMessageHandler() *recordingMessageHandler {
+	return &recordingMessageHandler{
+		actions: make(chan string, 4096),
+	}
+}
+
+func (handler *recordingMessageHandler) Read(buf []byte) error {
+	message, err := decodeWireMessage(buf)
+	if err != nil {
+		return err
+	}
+	handler.actions <- message.Action
+	return nil
+}
+
+func (handler *recordingMessageHandler) Write(buf []byte) error { return nil }
+
+// Observer that records all observed messages, optionally blocking until released
+type recordingObserver struct {
+	release  chan bool
+	observed chan string
+}
+
+func (observer *recordingObserver) OnMessage(channel string, action string, source string, targets []string, payload string) {
+	if observer.release != nil {
+		<-observer.release
+	}
+	observer.observed <- fmt.Sprintf("%s %s %s->%s", channel, action, payload, strings.Join(targets, ","))
+}
+
+// Create a transport that only runs its write pump (and so needs no connection)
+func newWriteOnlyTransport(handler MessageHandler) *Transport {
+	transport := NewTransport(nil, handler)
+	transport.open = true
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go transport.writePump(&wg)
+	wg.Wait()
+
+	return transport
+}
+
+// Create a channel with all of its state initialised, like
+// newChannelWithOptions, without starting, advertising or registering it
+func newTestChannel(service *Service, serviceName string) *Channel {
+	return newChannelState(service, serviceName)
+}
+
 // TEST CASES
 
 func TestSameProxyClients(t *testing.T) {
@@ -92,6 +217,14 @@ func TestSameProxyClients(t *testing.T) {
 	checkBroadcast(t, "hello world 2", client2, []*Client{client1, client3})
 	checkBroadcast(t, "hello world 3", client3, []*Client{client1, client2})
 
+	// Samples reach remote peers behind the owner too
+	client2.SendSampleBroadcastData("sampled", 1, 0)
+	for _, client := range []*Client{client1, client3} {
+		if message := <-client.Broadcast; message.Payload != "sampled" || message.Source != client2Id {
+			t.Fatalf("broadcast=%s from %s, want %s from %s", message.Payload, message.Source, "sampled", client2Id)
+		}
+	}
+
 	// Test direct messaging
 	checkMessage(t, "direct message 1", client2Id, client1, client2)
 	checkMessage(t, "direct message 2", client3Id, client1, client3)
@@ -176,111 +309,4848 @@ func TestMultipleProxyClients(t *testing.T) {
 	<-service2.StopNotify()
 }
 
-// BENCHMARKS
+func TestPinnedChannel(t *testing.T) {
 
-func BenchmarkSameProxyClientSetup(b *testing.B) {
-	service := NewService("localhost", 21000)
-	service.Start()
+	services := make([]*Service, 3)
+	for i, host := range []string{"host1", "host2", "host3"} {
+		services[i] = NewService(host, 21000+i)
+		services[i].ChannelHostPolicy["testservice11"] = "host1"
+		services[i].Start()
+	}
 
-	b.ResetTimer() // start benchmark timer
+	client1 := createClient(t, "ws://localhost:21000/testservice11")
+	client2 := createClient(t, "ws://localhost:21001/testservice11")
+	client3 := createClient(t, "ws://localhost:21002/testservice11")
 
-	// run the benchmark function b.N times
-	for n := 0; n < b.N; n++ {
-		// Create new Network Web Socket channel peers
-		client := createClient(b, "ws://localhost:21000/benchmarkservice1")
-		_ = getClientId(client) // wait for client connection to be established
-		client.Stop()
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+	client3Id := getClientId(client3)
+
+	log.Println("Waiting for Network Web Socket proxies to discover and connect to the channel owner...")
+
+	// Presence of every peer reaches every other peer via the owner
+	for _, client := range []*Client{client1, client2, client3} {
+		for i := 0; i < 2; i++ {
+			<-client.Connect
+		}
 	}
 
-	b.StopTimer() // end benchmark timer
+	// Only the owner federates with the other services
+	if links := len(services[0].FederationLinks()); links != 4 {
+		t.Fatalf("owner links=%d, want %d", links, 4)
+	}
+	for _, service := range services[1:] {
+		if links := len(service.FederationLinks()); links != 2 {
+			t.Fatalf("%s links=%d, want %d", service.Host, links, 2)
+		}
+	}
 
-	go service.Stop()
+	checkBroadcast(t, "hello world 1", client1, []*Client{client2, client3})
+	checkBroadcast(t, "hello world 2", client2, []*Client{client1, client3})
+	checkBroadcast(t, "hello world 3", client3, []*Client{client1, client2})
 
-	<-service.StopNotify()
+	checkMessage(t, "direct message 1", client3Id, client2, client3)
+	checkMessage(t, "direct message 2", client2Id, client3, client2)
+	checkMessage(t, "direct message 3", client1Id, client3, client1)
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go func() {
+		for _, service := range services {
+			service.Stop()
+		}
+	}()
+
+	for _, service := range services {
+		<-service.StopNotify()
+	}
 }
 
-func BenchmarkSameProxyClientMessaging(b *testing.B) {
-	service := NewService("localhost", 21000)
-	_ = service.Start()
+func TestFederationLinkHooks(t *testing.T) {
 
-	client1 := createClient(b, "ws://localhost:21000/benchmarkservice2")
-	client2 := createClient(b, "ws://localhost:21000/benchmarkservice2")
+	service1 := NewService("localhost", 21000)
+
+	linksUp := make(chan string, 255)
+	linksDown := make(chan string, 255)
+
+	service1.OnFederationLinkUp = func(host string, channel string) {
+		linksUp <- channel
+	}
+	service1.OnFederationLinkDown = func(host string, channel string) {
+		linksDown <- channel
+	}
+
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice3")
+	client2 := createClient(t, "ws://localhost:21001/testservice3")
 
 	client2Id := getClientId(client2)
 
-	b.ResetTimer() // start benchmark timer
+	log.Println("Waiting for Network Web Socket proxies to discover and connect to each other...")
 
-	// run the benchmark function b.N times
-	for n := 0; n < b.N; n++ {
-		checkMessage(b, "direct benchmark message", client2Id, client1, client2)
+	checkConnect(t, <-client1.Connect, client2Id)
+
+	// Each service both dials and accepts one proxy connection for the channel
+	for i := 0; i < 2; i++ {
+		if channel := <-linksUp; channel != "testservice3" {
+			t.Fatalf("link up=%s, want %s", channel, "testservice3")
+		}
 	}
 
-	b.StopTimer() // end benchmark timer
+	links := service1.FederationLinks()
+	if len(links) != 2 {
+		t.Fatalf("links=%d, want %d", len(links), 2)
+	}
+	directions := map[string]bool{}
+	for _, link := range links {
+		if link.Channel != "testservice3" {
+			t.Fatalf("link channel=%s, want %s", link.Channel, "testservice3")
+		}
+		directions[link.Direction] = true
+	}
+	if !directions["inbound"] || !directions["outbound"] {
+		t.Fatalf("link directions=%v, want inbound and outbound", directions)
+	}
+
+	// Removing the last remote peer tears down the remote channel and its proxy links
+	client2.Stop()
+	checkDisconnect(t, <-client1.Disconnect, client2Id)
+
+	for i := 0; i < 2; i++ {
+		if channel := <-linksDown; channel != "testservice3" {
+			t.Fatalf("link down=%s, want %s", channel, "testservice3")
+		}
+	}
+
+	client1.Stop()
 
 	go func() {
-		client1.Stop()
-		client2.Stop()
+		service1.Stop()
+		service2.Stop()
+	}()
 
-		service.Stop()
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestLateJoiningProxyClients(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice4")
+	client2 := createClient(t, "ws://localhost:21001/testservice4")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	log.Println("Waiting for Network Web Socket proxies to discover and connect to each other...")
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	// Start traffic before the third service joins
+	checkBroadcast(t, "hello world 1", client1, []*Client{client2})
+
+	service3 := NewService("localhost", 21002)
+	service3.Start()
+
+	client3 := createClient(t, "ws://localhost:21002/testservice4")
+	client3Id := getClientId(client3)
+
+	log.Println("Waiting for late Network Web Socket proxy to discover and connect to existing proxies...")
+
+	// The late joiner learns about all existing remote peers
+	remotePeers := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		remotePeers[(<-client3.Connect).Target] = true
+	}
+	if !remotePeers[client1Id] || !remotePeers[client2Id] {
+		t.Fatalf("connect=%v, want %s and %s", remotePeers, client1Id, client2Id)
+	}
+
+	// Existing peers learn about the late joiner
+	checkConnect(t, <-client1.Connect, client3Id)
+	checkConnect(t, <-client2.Connect, client3Id)
+
+	checkBroadcast(t, "hello world 2", client3, []*Client{client1, client2})
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+		service3.Stop()
 	}()
 
-	<-service.StopNotify()
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+	<-service3.StopNotify()
 }
 
-func BenchmarkSameProxyClientBroadcast(b *testing.B) {
+func TestPresenceBeforeBroadcasts(t *testing.T) {
+
 	service := NewService("localhost", 21000)
 	service.Start()
 
-	client1 := createClient(b, "ws://localhost:21000/benchmarkservice3")
-	client2 := createClient(b, "ws://localhost:21000/benchmarkservice3")
+	client1 := createClient(t, "ws://localhost:21000/testservice13")
+	client2 := createClient(t, "ws://localhost:21000/testservice13")
 
-	b.ResetTimer() // start benchmark timer
+	<-client1.Connect
 
-	// run the benchmark function b.N times
-	for n := 0; n < b.N; n++ {
-		checkBroadcast(b, "benchmark test msg", client1, []*Client{client2})
+	// Broadcast continuously while new peers join
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				client1.SendBroadcastData("live broadcast")
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		recorder := newRecordingMessageHandler()
+		client, _, err := Dial("ws://localhost:21000/testservice13", recorder)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+
+		// Both existing peers must be announced before the first broadcast
+		for j := 0; j < 2; j++ {
+			if action := <-recorder.actions; action != "connect" {
+				t.Fatalf("action=%s, want %s", action, "connect")
+			}
+		}
+
+		client.Stop()
 	}
 
-	b.StopTimer() // end benchmark timer
+	close(stop)
 
-	go func() {
-		client1.Stop()
-		client2.Stop()
+	client1.Stop()
+	client2.Stop()
 
-		service.Stop()
-	}()
+	go service.Stop()
 
 	<-service.StopNotify()
 }
 
-func BenchmarkDifferentProxyClientBroadcast(b *testing.B) {
+func TestFederationMiddleware(t *testing.T) {
+
 	service1 := NewService("localhost", 21000)
 	service1.Start()
 
 	service2 := NewService("localhost", 21001)
+
+	// Strip internal fields from broadcasts received from other services
+	service2.FederationMiddleware = func(channel string, message *WireMessage) error {
+		if message.Action != "broadcast" {
+			return nil
+		}
+		var data map[string]string
+		if err := json.Unmarshal([]byte(message.Payload), &data); err != nil {
+			return err
+		}
+		delete(data, "internal")
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		message.Payload = string(payload)
+		return nil
+	}
 	service2.Start()
 
-	client1 := createClient(b, "ws://localhost:21000/benchmarkservice4")
-	client2 := createClient(b, "ws://localhost:21001/benchmarkservice4")
+	client1 := createClient(t, "ws://localhost:21000/testservice16")
+	client2 := createClient(t, "ws://localhost:21001/testservice16")
+	client3 := createClient(t, "ws://localhost:21001/testservice16")
 
-	<-client1.Connect
-	<-client2.Connect
+	// Wait for client1 to be announced on service2
+	for i := 0; i < 2; i++ {
+		<-client2.Connect
+	}
 
-	b.ResetTimer() // start benchmark timer
+	payload := `{"internal":"secret","text":"hello"}`
 
-	// run the benchmark function b.N times
-	for n := 0; n < b.N; n++ {
-		checkBroadcast(b, "benchmark test msg", client1, []*Client{client2})
+	// Cross-host broadcasts are rewritten
+	client1.SendBroadcastData(payload)
+	if message := <-client2.Broadcast; message.Payload != `{"text":"hello"}` {
+		t.Fatalf("broadcast=%s, want %s", message.Payload, `{"text":"hello"}`)
 	}
 
-	b.StopTimer() // end benchmark timer
+	// Local broadcasts are untouched
+	client3.SendBroadcastData(payload)
+	if message := <-client2.Broadcast; message.Payload != payload {
+		t.Fatalf("broadcast=%s, want %s", message.Payload, payload)
+	}
 
 	client1.Stop()
 	client2.Stop()
+	client3.Stop()
 
-	go service1.Stop()
-	<-service1.StopNotify()
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
 
-	go service2.Stop()
+	<-service1.StopNotify()
 	<-service2.StopNotify()
 }
+
+func TestSubtreeChannels(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	subtree := createClient(t, "ws://localhost:21000/testservice19.room.*")
+	leaf1 := createClient(t, "ws://localhost:21000/testservice19.room.lights")
+	leaf2 := createClient(t, "ws://localhost:21000/testservice19.room.lights")
+	other := createClient(t, "ws://localhost:21000/testservice19.kitchen.lights")
+
+	_ = getClientId(subtree) // wait for client connection to be established
+	_ = getClientId(other)
+	<-leaf1.Connect
+
+	// Broadcasts on other channels are not delivered to the subtree channel
+	other.SendBroadcastData("kitchen lights on")
+
+	// Broadcasts on matching channels are delivered to both the leaf and subtree channels
+	checkBroadcast(t, "room lights on", leaf1, []*Client{leaf2})
+
+	message := <-subtree.Broadcast
+	if message.Payload != "room lights on" || message.Channel != "testservice19.room.lights" {
+		t.Fatalf("broadcast=%s on %s, want %s on %s", message.Payload, message.Channel, "room lights on", "testservice19.room.lights")
+	}
+
+	// Broadcasts on the subtree channel are not delivered to matching channels
+	subtree.SendBroadcastData("subtree broadcast")
+	checkBroadcast(t, "room lights off", leaf1, []*Client{leaf2, subtree})
+
+	for _, client := range []*Client{subtree, leaf1, leaf2, other} {
+		client.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSubtreeChannelDeliveryFilter(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ChannelOptions["testservice82.room.*"] = ChannelOptions{
+		DeliveryFilter: `"display" in peer.tags`,
+	}
+	service.Start()
+
+	display := createClient(t, "ws://localhost:21000/testservice82.room.*?tag=display")
+	console := createClient(t, "ws://localhost:21000/testservice82.room.*?tag=console")
+	leaf := createClient(t, "ws://localhost:21000/testservice82.room.lights")
+
+	getClientId(display)
+	getClientId(console)
+	getClientId(leaf)
+
+	// The subtree channel's filter applies to broadcasts from matching channels
+	leaf.SendBroadcastData("room lights on")
+
+	if message := <-display.Broadcast; message.Payload != "room lights on" {
+		t.Fatalf("broadcast=%s, want %s", message.Payload, "room lights on")
+	}
+
+	select {
+	case message := <-console.Broadcast:
+		t.Fatalf("console received filtered broadcast %s", message.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for _, client := range []*Client{display, console, leaf} {
+		client.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestShardBroadcasts(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	clientA1 := createClient(t, "ws://localhost:21000/testservice22?shard=a")
+	clientA2 := createClient(t, "ws://localhost:21000/testservice22?shard=a")
+	clientB := createClient(t, "ws://localhost:21000/testservice22?shard=b")
+
+	for i := 0; i < 2; i++ {
+		<-clientA1.Connect
+	}
+
+	// Shard broadcasts only reach peers in the same shard
+	clientA1.SendShardBroadcastData("shard a only", "a")
+
+	if message := <-clientA2.Broadcast; message.Payload != "shard a only" {
+		t.Fatalf("broadcast=%s, want %s", message.Payload, "shard a only")
+	}
+
+	// All-shard broadcasts reach everyone
+	checkBroadcast(t, "all shards", clientA1, []*Client{clientA2, clientB})
+
+	clientA1.Stop()
+	clientA2.Stop()
+	clientB.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestStopAndWaitBroadcasts(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ChannelOptions["testservice23"] = ChannelOptions{
+		StopAndWait: true,
+		AckTimeout:  200 * time.Millisecond,
+	}
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice23")
+	receiver := createClient(t, "ws://localhost:21000/testservice23")
+
+	receiverId := getClientId(receiver)
+	checkConnect(t, <-sender.Connect, receiverId)
+
+	// Peers cannot advertise a larger window on stop-and-wait channels
+	receiver.SendCreditWindow(1000000)
+	time.Sleep(50 * time.Millisecond)
+
+	for _, payload := range []string{"first", "second", "third"} {
+		sender.SendBroadcastData(payload)
+	}
+
+	// Each broadcast is only sent once the previous one is acknowledged
+	for _, payload := range []string{"first", "second", "third"} {
+		message := <-receiver.Broadcast
+		if message.Payload != payload {
+			t.Fatalf("broadcast=%s, want %s", message.Payload, payload)
+		}
+
+		select {
+		case message := <-receiver.Broadcast:
+			t.Fatalf("broadcast=%s sent before acknowledgement", message.Payload)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		receiver.SendAck()
+	}
+
+	// Peers that do not acknowledge a broadcast in time are disconnected
+	sender.SendBroadcastData("unacknowledged")
+
+	<-receiver.Broadcast
+
+	checkDisconnect(t, <-sender.Disconnect, receiverId)
+
+	sender.Stop()
+	receiver.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestPeerTags(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice24?tag=kiosk&tag=lobby")
+	client2 := createClient(t, "ws://localhost:21000/testservice24?tag=kiosk")
+	client3 := createClient(t, "ws://localhost:21000/testservice24")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+	_ = getClientId(client3) // wait for client connection to be established
+
+	if count := service.CountPeersWithTag("kiosk"); count != 2 {
+		t.Fatalf("count=%d, want %d", count, 2)
+	}
+
+	for _, peer := range service.Snapshot()[0].Peers {
+		if peer.Id == client1Id && strings.Join(peer.Tags, ",") != "kiosk,lobby" {
+			t.Fatalf("tags=%v, want %s", peer.Tags, "kiosk,lobby")
+		}
+	}
+
+	if sent := service.BroadcastToPeersWithTag("lobby", "lobby announcement"); sent != 1 {
+		t.Fatalf("sent=%d, want %d", sent, 1)
+	}
+	if message := <-client1.Broadcast; message.Payload != "lobby announcement" {
+		t.Fatalf("broadcast=%s, want %s", message.Payload, "lobby announcement")
+	}
+
+	closed, err := service.ClosePeersWithTag("kiosk", 4002, "kiosks closed")
+	if err != nil {
+		t.Fatalf("ClosePeersWithTag: %v", err)
+	}
+	if closed != 2 {
+		t.Fatalf("closed=%d, want %d", closed, 2)
+	}
+
+	disconnected := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		disconnected[(<-client3.Disconnect).Target] = true
+	}
+	if !disconnected[client1Id] || !disconnected[client2Id] {
+		t.Fatalf("disconnected=%v, want %s and %s", disconnected, client1Id, client2Id)
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestObserver(t *testing.T) {
+
+	observer := &recordingObserver{
+		observed: make(chan string, 255),
+	}
+
+	service := NewService("localhost", 21000)
+	service.Observer = observer
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice25")
+	client2 := createClient(t, "ws://localhost:21000/testservice25")
+
+	client2Id := getClientId(client2)
+	checkConnect(t, <-client1.Connect, client2Id)
+
+	checkBroadcast(t, "observed broadcast", client1, []*Client{client2})
+	checkMessage(t, "observed message", client2Id, client1, client2)
+
+	for _, want := range []string{
+		"testservice25 broadcast observed broadcast->" + client2Id,
+		"testservice25 message observed message->" + client2Id,
+	} {
+		if observed := <-observer.observed; observed != want {
+			t.Fatalf("observed=%s, want %s", observed, want)
+		}
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSlowObserver(t *testing.T) {
+
+	observer := &recordingObserver{
+		release:  make(chan bool),
+		observed: make(chan string, 255),
+	}
+
+	service := NewService("localhost", 21000)
+	service.Observer = observer
+	service.ObserverBufferSize = 2
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice26")
+	client2 := createClient(t, "ws://localhost:21000/testservice26")
+
+	<-client1.Connect
+
+	// Delivery continues while the observer is blocked
+	for i := 0; i < 10; i++ {
+		checkBroadcast(t, "broadcast", client1, []*Client{client2})
+	}
+
+	// At most one message is being observed and two are buffered, the rest are dropped
+	for service.DroppedObservations() < 7 {
+		time.Sleep(time.Millisecond)
+	}
+
+	dropped := int(service.DroppedObservations())
+	for i := 0; i < 10-dropped; i++ {
+		observer.release <- true
+		<-observer.observed
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestScatterGather(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	clients := make([]*Client, 3)
+	for i := range clients {
+		clients[i] = createClient(t, "ws://localhost:21000/testservice27")
+		_ = getClientId(clients[i]) // wait for client connection to be established
+	}
+
+	// The first two clients respond in time, the last one responds late.
+	// Repeated responses of the first client are only collected once.
+	go func() {
+		for i, client := range clients {
+			request := <-client.Request
+			if i == len(clients)-1 {
+				time.Sleep(300 * time.Millisecond)
+			}
+			client.SendResponseData(fmt.Sprintf("%s response %d", request.Payload, i), request.Correlation)
+			if i == 0 {
+				client.SendResponseData("ping response 0 again", request.Correlation)
+				client.SendResponseData("ping response 0 again", request.Correlation)
+			}
+		}
+	}()
+
+	responses, err := service.ScatterGather("testservice27", "ping", 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("ScatterGather: %v", err)
+	}
+
+	payloads := map[string]bool{}
+	for _, response := range responses {
+		payloads[response.Payload] = true
+	}
+	if len(responses) != 2 || !payloads["ping response 0"] || !payloads["ping response 1"] {
+		t.Fatalf("responses=%v, want %d responses in time", responses, 2)
+	}
+
+	if _, err := service.ScatterGather("testservice28", "ping", time.Second); err == nil {
+		t.Fatalf("ScatterGather accepted an unknown channel")
+	}
+
+	for _, client := range clients {
+		client.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestBrowseChannels(t *testing.T) {
+
+	hash, _ := bcrypt.HashBytes([]byte("testservice29"))
+	info := fmt.Sprintf("hash=%s,path=/proxy,host=localhost", base64.StdEncoding.EncodeToString([]byte(hash)))
+
+	browser := NewDiscoveryBrowser()
+	browser.query = func(params *mdns.QueryParam) error {
+		// An invalid response, then the same channel advertised in more
+		// responses than fit the entries buffer
+		params.Entries <- &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: 9010, Info: "path=/proxy"}
+		params.Entries <- &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: 9010, Info: info}
+		for i := 0; i < 300; i++ {
+			params.Entries <- &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: 9010, Info: info}
+		}
+		time.Sleep(params.Timeout)
+		return nil
+	}
+
+	channels, err := browser.browseChannels(network_ipv4Addr, network_ipv6Addr, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("BrowseChannels: %v", err)
+	}
+	if len(channels) != 1 {
+		t.Fatalf("BrowseChannels returned %d channels, want %d", len(channels), 1)
+	}
+	found := channels[0]
+	if !found.Matches("testservice29") || found.Host != "localhost" || found.Port != 9010 {
+		t.Fatalf("channel=%s:%d, want %s:%d for %s", found.Host, found.Port, "localhost", 9010, "testservice29")
+	}
+	if found.Matches("testservice30") {
+		t.Fatalf("channel matches %s, want %s only", "testservice30", "testservice29")
+	}
+
+	// Query errors are returned
+	outage := errors.New("multicast socket error")
+	browser.query = func(params *mdns.QueryParam) error {
+		return outage
+	}
+	if _, err := browser.browseChannels(network_ipv4Addr, network_ipv6Addr, 10*time.Millisecond); err != outage {
+		t.Fatalf("BrowseChannels: %v, want %v", err, outage)
+	}
+
+	// A service browses its own multicast groups
+	service := NewService("localhost", 21000)
+	service.MulticastAddress = "239.255.0.1"
+	service.MulticastPort = 5407
+	service.discoveryBrowser.query = func(params *mdns.QueryParam) error {
+		if params.IPv4mdns.String() != "239.255.0.1:5407" || params.IPv6mdns.String() != "[ff02::efff:1]:5407" {
+			t.Errorf("groups=%s %s, want %s %s", params.IPv4mdns, params.IPv6mdns, "239.255.0.1:5407", "[ff02::efff:1]:5407")
+		}
+		params.Entries <- &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: 9010, Info: info}
+		return nil
+	}
+	if channels, err := service.BrowseChannels(10 * time.Millisecond); err != nil || len(channels) != 1 {
+		t.Fatalf("BrowseChannels returned %d channels (err=%v), want %d", len(channels), err, 1)
+	}
+}
+
+func TestPreRegisterChannel(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+
+	options := ChannelOptions{CoalesceBroadcasts: true, StopAndWait: true}
+	if err := service.PreRegisterChannel("testservice31", options); err != nil {
+		t.Fatalf("PreRegisterChannel: %v", err)
+	}
+	if err := service.PreRegisterChannel("testservice31", options); err == nil {
+		t.Fatalf("PreRegisterChannel accepted a channel that is already pre-registered")
+	}
+
+	// Later conflicting options are ignored
+	service.ChannelOptions["testservice31"] = ChannelOptions{}
+
+	service.Start()
+
+	channel := service.GetChannelByName("testservice31")
+	if channel == nil {
+		t.Fatalf("Pre-registered channel was not created on start")
+	}
+
+	for i := 0; i < 2; i++ {
+		client := createClient(t, "ws://localhost:21000/testservice31")
+		_ = getClientId(client) // wait for client connection to be established
+		client.Stop()
+
+		// Wait for the client to leave the channel
+		for len(channel.peers) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if service.GetChannelByName("testservice31") != channel {
+		t.Fatalf("Pre-registered channel was not kept after all peers left")
+	}
+	if channel.options != options {
+		t.Fatalf("options=%v, want %v", channel.options, options)
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSampleBroadcasts(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice33")
+	_ = getClientId(sender) // wait for client connection to be established
+
+	receivers := make([]*Client, 8)
+	for i := range receivers {
+		receivers[i] = createClient(t, "ws://localhost:21000/testservice33")
+		_ = getClientId(receivers[i])
+	}
+
+	// Return which receivers were sent a sample broadcast
+	sample := func(seed int64) []bool {
+		sender.SendSampleBroadcastData("sampled", 0.5, seed)
+		sender.SendBroadcastData("marker")
+
+		sampled := make([]bool, len(receivers))
+		for i, receiver := range receivers {
+			if message := <-receiver.Broadcast; message.Payload == "sampled" {
+				sampled[i] = true
+				<-receiver.Broadcast
+			}
+		}
+		return sampled
+	}
+
+	count := func(sampled []bool) int {
+		n := 0
+		for _, s := range sampled {
+			if s {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := count(sample(0)); n != 4 {
+		t.Fatalf("sampled=%d, want %d", n, 4)
+	}
+
+	// A fixed seed samples the same peers every time
+	sampled := sample(42)
+	if n := count(sampled); n != 4 {
+		t.Fatalf("sampled=%d, want %d", n, 4)
+	}
+	for i, s := range sample(42) {
+		if s != sampled[i] {
+			t.Fatalf("Sample with a fixed seed was not reproducible")
+		}
+	}
+
+	// Sample sizes that are not a count or a fraction are rejected
+	sender.SendSampleBroadcastData("invalid", -1, 0)
+	sender.SendSampleBroadcastData("invalid", 1e300, 0)
+	sender.transport.Write([]byte(`{"action":"sample","count":-1,"data":"invalid"}`))
+	for i := 0; i < 3; i++ {
+		if reply := <-sender.Error; reply.Payload != "invalid_sample" {
+			t.Fatalf("error=%s, want %s", reply.Payload, "invalid_sample")
+		}
+	}
+	if n := count(sample(0)); n != 4 {
+		t.Fatalf("sampled=%d after invalid samples, want %d", n, 4)
+	}
+
+	sender.Stop()
+	for _, receiver := range receivers {
+		receiver.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestCreditWindow(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice34")
+	receiver := createClient(t, "ws://localhost:21000/testservice34")
+
+	receiver.SendCreditWindow(2)
+
+	receiverId := getClientId(receiver)
+	checkConnect(t, <-sender.Connect, receiverId)
+
+	for i := 0; i < 5; i++ {
+		sender.SendBroadcastData(fmt.Sprintf("broadcast %d", i))
+	}
+
+	// Only as many broadcasts as the credit window are sent before acknowledgement
+	received := 0
+	readAvailable := func() {
+		for {
+			select {
+			case message := <-receiver.Broadcast:
+				if want := fmt.Sprintf("broadcast %d", received); message.Payload != want {
+					t.Fatalf("broadcast=%s, want %s", message.Payload, want)
+				}
+				received++
+			case <-time.After(50 * time.Millisecond):
+				return
+			}
+		}
+	}
+
+	readAvailable()
+	if received != 2 {
+		t.Fatalf("received=%d, want %d", received, 2)
+	}
+
+	receiver.SendAck()
+	readAvailable()
+	if received != 3 {
+		t.Fatalf("received=%d, want %d", received, 3)
+	}
+
+	// Widening the window releases held broadcasts
+	receiver.SendCreditWindow(4)
+	readAvailable()
+	if received != 5 {
+		t.Fatalf("received=%d, want %d", received, 5)
+	}
+
+	sender.Stop()
+	receiver.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMigrateChannel(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	clients := make([]*Client, 2)
+	ids := make([]string, len(clients))
+	for i := range clients {
+		clients[i] = createClient(t, "ws://localhost:21000/testservice35")
+		ids[i] = getClientId(clients[i])
+	}
+
+	if _, err := service.MigrateChannel("testservice35", "invalid/channel"); err == nil {
+		t.Fatalf("MigrateChannel accepted an invalid channel name")
+	}
+
+	migrated, err := service.MigrateChannel("testservice35", "testservice36")
+	if err != nil {
+		t.Fatalf("MigrateChannel: %v", err)
+	}
+	if migrated != 2 {
+		t.Fatalf("migrated=%d, want %d", migrated, 2)
+	}
+
+	// Clients reconnect to the new channel by themselves, keeping their ids
+	for i, client := range clients {
+		if message := <-client.Migrate; message.Payload != "testservice36" {
+			t.Fatalf("migrate=%s, want %s", message.Payload, "testservice36")
+		}
+		if id := getClientId(client); id != ids[i] {
+			t.Fatalf("id=%s after migration, want %s", id, ids[i])
+		}
+	}
+
+	for service.GetChannelByName("testservice35") != nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	channel := service.GetChannelByName("testservice36")
+	if channel == nil || len(channel.peers) != 2 || !channel.isLocalPeer(ids[0]) || !channel.isLocalPeer(ids[1]) {
+		t.Fatalf("Clients were not migrated to the new channel")
+	}
+
+	checkBroadcast(t, "migrated", clients[0], clients[1:])
+
+	// Migration tokens can only be claimed once
+	if _, err := service.MigrateChannel("testservice36", "testservice35"); err != nil {
+		t.Fatalf("MigrateChannel: %v", err)
+	}
+	message := <-clients[0].Migrate
+	if _, ok := service.claimMigration(message.Correlation, "testservice35"); ok {
+		t.Fatalf("Migration token was claimed twice")
+	}
+	<-clients[1].Migrate
+
+	for _, client := range clients {
+		client.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestNegotiatedSubprotocol(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	d := websocket.Dialer{
+		Subprotocols: []string{"chat.v2", "chat.v1"},
+	}
+	conn, _, err := d.Dial("ws://localhost:21000/testservice37", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	var peers []ConnectionSnapshot
+	for len(peers) == 0 {
+		if snapshots := service.Snapshot(); len(snapshots) == 1 {
+			peers = snapshots[0].Peers
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if peers[0].Subprotocol != "chat.v2" || conn.Subprotocol() != "chat.v2" {
+		t.Fatalf("subprotocol=%s, want %s", peers[0].Subprotocol, "chat.v2")
+	}
+
+	conn.Close()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestClosePeerWithCode(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice10")
+	client2 := createClient(t, "ws://localhost:21000/testservice10")
+
+	client1Id := getClientId(client1)
+
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	if err := service.ClosePeer("testservice10", client1Id, 1000, "normal closure"); err == nil {
+		t.Fatalf("ClosePeer accepted close code outside the application range")
+	}
+
+	if err := service.ClosePeer("testservice10", client1Id, 4001, "tournament ended"); err != nil {
+		t.Fatalf("ClosePeer: %v", err)
+	}
+
+	message := <-client2.Disconnect
+	checkDisconnect(t, message, client1Id)
+	if message.Code != 4001 || message.Payload != "tournament ended" {
+		t.Fatalf("disconnect=%d %s, want %d %s", message.Code, message.Payload, 4001, "tournament ended")
+	}
+
+	// Admins may close a peer over HTTP too, with the same code validation
+	service.AdminUIEnabled = true
+	service.AdminToken = "secret"
+
+	client3 := createClient(t, "ws://localhost:21000/testservice10")
+	client3Id := getClientId(client3)
+	checkConnect(t, <-client2.Connect, client3Id)
+
+	closeRequest := func(token string, code string) int {
+		req, err := http.NewRequest("POST", "http://localhost:21000/admin/close?channel=testservice10&peer="+client3Id+"&code="+code+"&reason=season+over", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		return w.Code
+	}
+
+	if status := closeRequest("guess", "4002"); status != 401 {
+		t.Fatalf("status=%d, want %d", status, 401)
+	}
+	if status := closeRequest("secret", "1000"); status != 400 {
+		t.Fatalf("status=%d, want %d", status, 400)
+	}
+	if status := closeRequest("secret", "4002"); status != 204 {
+		t.Fatalf("status=%d, want %d", status, 204)
+	}
+
+	message = <-client2.Disconnect
+	checkDisconnect(t, message, client3Id)
+	if message.Code != 4002 || message.Payload != "season over" {
+		t.Fatalf("disconnect=%d %s, want %d %s", message.Code, message.Payload, 4002, "season over")
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestCloseGracePeriod(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.CloseGracePeriod = 200 * time.Millisecond
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice18")
+
+	_ = getClientId(client1) // wait for client connection to be established
+
+	// A client that never reads and so never responds to a close frame
+	d := websocket.Dialer{}
+	conn, _, err := d.Dial("ws://localhost:21000/testservice18", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	connId := (<-client1.Connect).Target
+
+	start := time.Now()
+
+	if err := service.ClosePeer("testservice18", connId, 4001, "closed"); err != nil {
+		t.Fatalf("ClosePeer: %v", err)
+	}
+
+	message := <-client1.Disconnect
+	checkDisconnect(t, message, connId)
+	if elapsed := time.Since(start); elapsed < service.CloseGracePeriod {
+		t.Fatalf("disconnect after %v, want at least %v", elapsed, service.CloseGracePeriod)
+	}
+
+	if channel := service.GetChannelByName("testservice18"); channel == nil || len(channel.peers) != 1 {
+		t.Fatalf("Unresponsive peer was not removed from channel")
+	}
+
+	client1.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestClientWaitFor(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice9")
+	client2 := createClient(t, "ws://localhost:21000/testservice9")
+	client3 := createClient(t, "ws://localhost:21000/testservice9")
+
+	client2Id := getClientId(client2)
+	client3Id := getClientId(client3)
+
+	isConnectFor := func(id string) func(WireMessage) bool {
+		return func(message WireMessage) bool {
+			return message.Action == "connect" && message.Target == id
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Wait for connect events in the reverse order they are sent
+	message, err := client1.WaitFor(ctx, isConnectFor(client3Id))
+	if err != nil {
+		t.Fatalf("WaitFor: %v", err)
+	}
+	checkConnect(t, message, client3Id)
+
+	message, err = client1.WaitFor(ctx, isConnectFor(client2Id))
+	if err != nil {
+		t.Fatalf("WaitFor: %v", err)
+	}
+	checkConnect(t, message, client2Id)
+
+	// Waiting for a message that never arrives returns when the context is done
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+
+	if _, err := client1.WaitFor(shortCtx, isConnectFor("unknown")); err != context.DeadlineExceeded {
+		t.Fatalf("WaitFor err=%v, want %v", err, context.DeadlineExceeded)
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestCoalescedWrites(t *testing.T) {
+
+	handler := newSlowMessageHandler()
+	transport := newWriteOnlyTransport(handler)
+	defer close(transport.closed)
+
+	// The slow consumer is still busy with an earlier message...
+	transport.Write([]byte("first"))
+
+	// ...while several updates with the same key are queued for it
+	transport.WriteCoalesced([]byte("cursor 1"), "peer1/cursor")
+	transport.WriteCoalesced([]byte("other 1"), "peer2/cursor")
+	transport.WriteCoalesced([]byte("cursor 2"), "peer1/cursor")
+	transport.WriteCoalesced([]byte("cursor 3"), "peer1/cursor")
+	transport.Write([]byte("last"))
+
+	expected := []string{"first", "cursor 3", "other 1", "last"}
+	for _, want := range expected {
+		handler.release <- true
+		if got := <-handler.written; got != want {
+			t.Fatalf("write=%s, want %s", got, want)
+		}
+	}
+}
+
+func TestRemoteBroadcast(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice8")
+	client2 := createClient(t, "ws://localhost:21000/testservice8")
+	client3 := createClient(t, "ws://localhost:21001/testservice8")
+
+	client1Id := getClientId(client1)
+
+	log.Println("Waiting for Network Web Socket proxies to discover and connect to each other...")
+
+	checkConnect(t, <-client3.Connect, client1Id)
+	<-client3.Connect
+
+	client1.SendRemoteBroadcastData("remote broadcast")
+
+	if message := <-client3.Broadcast; message.Payload != "remote broadcast" || message.Source != client1Id {
+		t.Fatalf("broadcast=%s from %s, want %s from %s", message.Payload, message.Source, "remote broadcast", client1Id)
+	}
+
+	// Same-proxy peers must not receive the remote broadcast, so the first
+	// broadcast they see is the next regular broadcast
+	checkBroadcast(t, "local broadcast", client1, []*Client{client2, client3})
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestChannelTrace(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	service.EnableChannelTrace("testservice5")
+
+	output := captureLog()
+	defer releaseLog()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice5")
+	client2 := createClient(t, "ws://localhost:21000/testservice5")
+	client3 := createClient(t, "ws://localhost:21000/testservice6")
+	client4 := createClient(t, "ws://localhost:21000/testservice6")
+
+	<-client1.Connect
+	<-client3.Connect
+
+	checkBroadcast(t, "traced message", client1, []*Client{client2})
+	checkBroadcast(t, "untraced message", client3, []*Client{client4})
+
+	traced := output.String()
+	if !strings.Contains(traced, "Channel 'testservice5' trace: inbound from peer") {
+		t.Fatalf("no inbound frames traced for testservice5")
+	}
+	if !strings.Contains(traced, "Channel 'testservice5' trace: outbound to peer") {
+		t.Fatalf("no outbound frames traced for testservice5")
+	}
+	if strings.Contains(traced, "Channel 'testservice6' trace") || strings.Contains(traced, "untraced message") {
+		t.Fatalf("frames traced for untraced channel testservice6")
+	}
+
+	service.DisableChannelTrace("testservice5")
+
+	checkBroadcast(t, "message after trace disabled", client1, []*Client{client2})
+
+	if strings.Contains(output.String(), "message after trace disabled") {
+		t.Fatalf("frames traced after trace was disabled")
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+	client4.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMaxMessagePayloadSize(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.MaxMessagePayloadSize = 16
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice7")
+	client2 := createClient(t, "ws://localhost:21000/testservice7")
+
+	client2Id := getClientId(client2)
+
+	<-client1.Connect
+
+	client1.SendMessageData("this payload is over sixteen bytes", client2Id)
+
+	if message := <-client1.Error; message.Payload != "payload_too_large" {
+		t.Fatalf("error=%s, want %s", message.Payload, "payload_too_large")
+	}
+
+	// Messages within the limit are still relayed (and are the first to arrive)
+	checkMessage(t, "short message", client2Id, client1, client2)
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMessageToUnknownTarget(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	// The only peer on the channel
+	client := createClient(t, "ws://localhost:21000/testservice20")
+
+	client.SendMessageData("hello?", "1234567")
+
+	if message := <-client.Error; message.Payload != "unknown_target" {
+		t.Fatalf("error=%s, want %s", message.Payload, "unknown_target")
+	}
+
+	client.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestCanSendDirect(t *testing.T) {
+
+	var hostId string
+
+	service := NewService("localhost", 21000)
+	// Only allow direct messages to the first peer
+	service.CanSendDirect = func(channel string, from string, to string) bool {
+		return channel == "testservice32" && to == hostId
+	}
+	service.Start()
+
+	host := createClient(t, "ws://localhost:21000/testservice32")
+	client1 := createClient(t, "ws://localhost:21000/testservice32")
+	client2 := createClient(t, "ws://localhost:21000/testservice32")
+
+	hostId = getClientId(host)
+	client2Id := getClientId(client2)
+	_ = getClientId(client1) // wait for client connection to be established
+
+	checkMessage(t, "allowed message", hostId, client1, host)
+
+	client1.SendMessageData("forbidden message", client2Id)
+
+	if message := <-client1.Error; message.Payload != "forbidden" {
+		t.Fatalf("error=%s, want %s", message.Payload, "forbidden")
+	}
+
+	// Echoes passed on to another peer are direct messages too
+	client1.SendEcho(client2Id)
+
+	if message := <-client1.Error; message.Payload != "forbidden" {
+		t.Fatalf("error=%s, want %s", message.Payload, "forbidden")
+	}
+
+	host.Stop()
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestListenWith(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	service := NewService("localhost", 21000)
+	if err := service.ListenWith(listener); err != nil {
+		t.Fatalf("ListenWith: %v", err)
+	}
+	service.Start()
+
+	if service.Addr() == nil || service.Addr().String() != listener.Addr().String() {
+		t.Fatalf("addr=%v, want %v", service.Addr(), listener.Addr())
+	}
+
+	client1 := createClient(t, "ws://"+service.Addr().String()+"/testservice12")
+	client2 := createClient(t, "ws://"+service.Addr().String()+"/testservice12")
+
+	checkConnect(t, <-client1.Connect, getClientId(client2))
+	checkBroadcast(t, "hello world", client1, []*Client{client2})
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestDisallowedRequestMethods(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+
+	endpoints := map[string]func(http.ResponseWriter, *http.Request){
+		"http://localhost:21000/":             service.Handler.ServeLocalRequest,
+		"http://localhost:21000/testservice4": service.Handler.ServeLocalRequest,
+		"wss://localhost:21002/1234567":       service.Handler.ServeProxyRequest,
+	}
+
+	for urlStr, handler := range endpoints {
+		for _, method := range []string{"POST", "PUT", "DELETE", "PATCH", "OPTIONS"} {
+			req, err := http.NewRequest(method, urlStr, nil)
+			if err != nil {
+				t.Fatalf("NewRequest: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			if w.Code != 405 {
+				t.Fatalf("%s %s status=%d, want %d", method, urlStr, w.Code, 405)
+			}
+			if allow := w.Header().Get("Allow"); allow != "GET" {
+				t.Fatalf("%s %s allow=%s, want %s", method, urlStr, allow, "GET")
+			}
+		}
+	}
+
+	// Admin routes accept GET for reads and POST for actions only
+	service.AdminUIEnabled = true
+	for path, allowed := range adminRouteMethods {
+		for _, method := range []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"} {
+			if method == allowed {
+				continue
+			}
+
+			req, err := http.NewRequest(method, "http://localhost:21000"+path, nil)
+			if err != nil {
+				t.Fatalf("NewRequest: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			service.Handler.ServeLocalRequest(w, req)
+
+			if w.Code != 405 {
+				t.Fatalf("%s %s status=%d, want %d", method, path, w.Code, 405)
+			}
+			if allow := w.Header().Get("Allow"); allow != allowed {
+				t.Fatalf("%s %s allow=%s, want %s", method, path, allow, allowed)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ChannelHostPolicy["testservice14"] = "host1"
+	service.ChannelOptions["testservice14"] = ChannelOptions{CoalesceBroadcasts: true}
+	service.MaxMessagePayloadSize = 1024
+
+	if err := service.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	service.ChannelHostPolicy["invalid/channel"] = "host1"
+	service.ChannelHostPolicy["testservice15"] = ""
+	service.ChannelOptions["invalid channel"] = ChannelOptions{}
+	service.MaxMessagePayloadSize = maxMessageSize + 1
+	service.DuplicateInstancePolicy = "close"
+	service.WriterModel = "shared"
+	service.ReadBufferSize = -1
+	service.ChannelOptions["testservice16"] = ChannelOptions{DeliveryFilter: `peer.role == "display"`}
+	service.ChannelOptions["testservice17"] = ChannelOptions{EnforceCodec: "msgpack"}
+	service.MulticastAddress = "10.0.0.1"
+
+	err := service.Validate()
+	if err == nil {
+		t.Fatalf("Validate: expected an error for an invalid configuration")
+	}
+
+	for _, want := range []string{"'invalid/channel'", "'testservice15'", "'invalid channel'", "MaxMessagePayloadSize", "DuplicateInstancePolicy", "WriterModel", "peer.role", "ReadBufferSize", "msgpack", "MulticastAddress"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("err=%s, want it to contain %s", err.Error(), want)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.LoadSheddingHighWaterMark = 5
+
+	// A channel with a single peer that writes slowly
+	handler := newSlowMessageHandler()
+	peer := &Peer{
+		id:        "slowpeer",
+		transport: newWriteOnlyTransport(handler),
+		active:    true,
+	}
+	channel := newTestChannel(service, "testservice17")
+	channel.peers = []*Peer{peer}
+	peer.channel = channel
+	service.Channels[channel.servicePath] = channel
+
+	request := func() int {
+		req, err := http.NewRequest("GET", "http://localhost:21000/testservice17", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		return w.Code
+	}
+
+	// Build up the peer's send queue (the first message is held by the handler)
+	for i := 0; i < 7; i++ {
+		peer.transport.Write([]byte("queued message"))
+	}
+	for service.Snapshot()[0].QueueDepth != 6 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if snapshot := service.Snapshot()[0]; snapshot.Peers[0].Id != "slowpeer" || snapshot.Peers[0].QueueDepth != 6 {
+		t.Fatalf("peer queue depth=%d, want %d", snapshot.Peers[0].QueueDepth, 6)
+	}
+
+	if code := request(); code != 503 {
+		t.Fatalf("status=%d, want %d", code, 503)
+	}
+
+	// Drain the send queue
+	for i := 0; i < 7; i++ {
+		handler.release <- true
+		<-handler.written
+	}
+
+	if depth := service.Snapshot()[0].QueueDepth; depth != 0 {
+		t.Fatalf("queue depth=%d, want %d", depth, 0)
+	}
+
+	if code := request(); code == 503 {
+		t.Fatalf("status=%d, want a recovered service", code)
+	}
+
+	peer.transport.closeOnce.Do(func() {
+		close(peer.transport.closed)
+	})
+}
+
+func TestAbandonPendingForwards(t *testing.T) {
+
+	lb := captureLog()
+	defer releaseLog()
+
+	service := NewService("localhost", 21000)
+	service.ForwardTimeout = 50 * time.Millisecond
+
+	// A channel with a local peer and a proxy connection to a hung remote service
+	peerHandler := newSlowMessageHandler()
+	peer := &Peer{
+		id:        "localpeer",
+		transport: newWriteOnlyTransport(peerHandler),
+		active:    true,
+	}
+	proxyHandler := newSlowMessageHandler()
+	proxy := &Proxy{
+		base: Peer{
+			id:        "hungproxy",
+			transport: newWriteOnlyTransport(proxyHandler),
+			active:    true,
+		},
+		peerIds:   make(map[string]bool),
+		writeable: true,
+		host:      "hung",
+	}
+	proxy.base.transport.abandonAfter = service.ForwardTimeout
+	channel := newTestChannel(service, "testservice21")
+	channel.peers = []*Peer{peer}
+	channel.proxies = []*Proxy{proxy}
+	peer.channel = channel
+	proxy.base.channel = channel
+	service.Channels[channel.servicePath] = channel
+
+	go channel.messageDispatcher()
+
+	for i := 0; i < 3; i++ {
+		channel.broadcastBuffer <- &WireMessage{Action: "broadcast", Source: "remotepeer", Payload: "forwarded"}
+	}
+
+	// Local delivery is not blocked by the hung remote service
+	for i := 0; i < 3; i++ {
+		peerHandler.release <- true
+		<-peerHandler.written
+	}
+
+	// The first forward is in-flight and the others are pending
+	for len(service.PendingForwards()) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if forward := service.PendingForwards()[0]; forward.Host != "hung" || forward.Channel != "testservice21" {
+		t.Fatalf("pending forward=%s %s, want %s %s", forward.Host, forward.Channel, "hung", "testservice21")
+	}
+
+	// Pending forwards are abandoned once the in-flight forward completes
+	time.Sleep(2 * service.ForwardTimeout)
+	proxyHandler.release <- true
+	<-proxyHandler.written
+
+	for len(service.PendingForwards()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if logged := lb.String(); strings.Count(logged, "Abandoned message") != 2 {
+		t.Fatalf("Expected 2 abandoned messages to be logged: %s", logged)
+	}
+
+	// Pending forwards can be cancelled
+	for i := 0; i < 2; i++ {
+		channel.broadcastBuffer <- &WireMessage{Action: "broadcast", Source: "remotepeer", Payload: "forwarded"}
+	}
+	for i := 0; i < 2; i++ {
+		peerHandler.release <- true
+		<-peerHandler.written
+	}
+	for len(service.PendingForwards()) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if cancelled := service.CancelPendingForwards("hung"); cancelled != 1 {
+		t.Fatalf("cancelled=%d, want %d", cancelled, 1)
+	}
+
+	proxyHandler.release <- true
+	<-proxyHandler.written
+
+	close(channel.broadcastBuffer)
+	for _, transport := range []*Transport{peer.transport, proxy.base.transport} {
+		transport.closeOnce.Do(func() {
+			close(transport.closed)
+		})
+	}
+}
+
+func TestBanPolicy(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.BanPolicy = BanPolicy{
+		MaxConnects: 3,
+		Window:      time.Second,
+		BanDuration: 100 * time.Millisecond,
+	}
+
+	get := func(path string, remoteAddr string, upgrade bool) int {
+		req, err := http.NewRequest("GET", "http://localhost:21000"+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.RemoteAddr = remoteAddr
+		if upgrade {
+			req.Header.Set("Upgrade", "websocket")
+		}
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		return w.Code
+	}
+	request := func(remoteAddr string) int {
+		return get("/testservice80", remoteAddr, true)
+	}
+
+	// Requests other than websocket upgrades (e.g. console page loads) are
+	// not connection attempts
+	for i := 0; i < 5; i++ {
+		if code := get("/", "10.0.0.1:1234", false); code == 403 {
+			t.Fatalf("status=%d for a console page load", code)
+		}
+	}
+
+	// Rapid connection attempts from one address trigger a ban
+	for i := 0; i < 3; i++ {
+		if code := request("10.0.0.1:1234"); code == 403 {
+			t.Fatalf("status=%d before the connection attempt limit", code)
+		}
+	}
+	if code := request("10.0.0.1:1234"); code != 403 {
+		t.Fatalf("status=%d, want %d", code, 403)
+	}
+
+	if bans := service.Bans(); len(bans) != 1 || bans[0].Addr != "10.0.0.1" {
+		t.Fatalf("bans=%v, want a ban on %s", bans, "10.0.0.1")
+	}
+
+	// Other addresses are not banned
+	if code := request("10.0.0.2:1234"); code == 403 {
+		t.Fatalf("status=%d for an address that is not banned", code)
+	}
+
+	// Bans expire
+	time.Sleep(150 * time.Millisecond)
+
+	if bans := service.Bans(); len(bans) != 0 {
+		t.Fatalf("bans=%v, want none", bans)
+	}
+	if code := request("10.0.0.1:1234"); code == 403 {
+		t.Fatalf("status=%d after the ban expired", code)
+	}
+
+	// Bans can be cleared
+	for i := 0; i < 3; i++ {
+		request("10.0.0.1:1234")
+	}
+	if !service.ClearBan("10.0.0.1") {
+		t.Fatalf("ClearBan: %s was not banned", "10.0.0.1")
+	}
+	if code := request("10.0.0.1:1234"); code == 403 {
+		t.Fatalf("status=%d after the ban was cleared", code)
+	}
+}
+
+func TestAdminUI(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost:21000"+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/admin/", "/admin/status"} {
+		if w := request(path); w.Code != 404 {
+			t.Fatalf("%s status=%d, want %d", path, w.Code, 404)
+		}
+	}
+
+	service.AdminUIEnabled = true
+	service.AdminToken = "secret"
+
+	// Every admin endpoint requires the token
+	for path, method := range adminRouteMethods {
+		req, err := http.NewRequest(method, "http://localhost:21000"+path+"?token=guess", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		if w.Code != 401 {
+			t.Fatalf("%s %s status=%d, want %d", method, path, w.Code, 401)
+		}
+	}
+
+	for _, path := range []string{"/admin", "/admin/"} {
+		if w := request(path + "?token=secret"); w.Code != 200 || !strings.Contains(w.Body.String(), "Network Web Sockets Admin") {
+			t.Fatalf("%s status=%d, want the admin page", path, w.Code)
+		}
+	}
+
+	// The admin page presents its token to the status endpoint as a bearer token
+	req, err := http.NewRequest("GET", "http://localhost:21000/admin/status", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	w := httptest.NewRecorder()
+	service.Handler.ServeLocalRequest(w, req)
+	if w.Code != 200 {
+		t.Fatalf("/admin/status status=%d, want %d", w.Code, 200)
+	}
+
+	var status struct {
+		Channels        []ChannelSnapshot
+		FederationLinks []FederationLink
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+}
+
+func TestRejectConnectionsWithoutDiscovery(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.RejectConnectionsWithoutDiscovery = true
+
+	request := func() int {
+		req, err := http.NewRequest("GET", "http://localhost:21000/testservice38", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		return w.Code
+	}
+
+	// Simulate a discovery outage
+	outage := errors.New("multicast socket error")
+	service.discoveryBrowser.query = func(params *mdns.QueryParam) error {
+		return outage
+	}
+	service.discoveryBrowser.Browse(service, 0)
+
+	if err := service.DiscoveryError(); err != outage {
+		t.Fatalf("DiscoveryError=%v, want %v", err, outage)
+	}
+	if code := request(); code != 503 {
+		t.Fatalf("status=%d, want %d", code, 503)
+	}
+
+	// Recover from the outage
+	service.discoveryBrowser.query = func(params *mdns.QueryParam) error {
+		return nil
+	}
+	service.discoveryBrowser.Browse(service, 0)
+
+	if err := service.DiscoveryError(); err != nil {
+		t.Fatalf("DiscoveryError=%v, want %v", err, nil)
+	}
+	if code := request(); code == 503 {
+		t.Fatalf("status=%d after discovery recovered", code)
+	}
+
+	for _, channel := range service.channelList() {
+		channel.Stop()
+	}
+}
+
+func TestClusterStatus(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.AdminUIEnabled = true
+	service1.AdminToken = "secret"
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice39")
+	client2 := createClient(t, "ws://localhost:21001/testservice39")
+
+	// A channel the remote service shares over no proxy link of service1
+	client3 := createClient(t, "ws://localhost:21001/testservice81")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	req, err := http.NewRequest("GET", "http://localhost:21000/admin/cluster-status", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	w := httptest.NewRecorder()
+	service1.Handler.ServeLocalRequest(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status=%d, want %d", w.Code, 200)
+	}
+
+	var status ClusterStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if len(status.Hosts) != 2 {
+		t.Fatalf("hosts=%v, want 2 hosts", status.Hosts)
+	}
+	for _, host := range status.Hosts {
+		if !host.Reachable {
+			t.Fatalf("host %s is unreachable", host.Host)
+		}
+		for _, channel := range host.Channels {
+			if channel.Name == "testservice81" {
+				t.Fatalf("host %s reported channel %s over an unrelated proxy link", host.Host, channel.Name)
+			}
+		}
+	}
+
+	wantPeers := []string{client1Id, client2Id}
+	sort.Strings(wantPeers)
+	if fmt.Sprint(status.Peers) != fmt.Sprint(wantPeers) {
+		t.Fatalf("peers=%v, want %v", status.Peers, wantPeers)
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestVectorClocks(t *testing.T) {
+
+	options := ChannelOptions{VectorClocks: true}
+
+	service1 := NewService("localhost", 21000)
+	service1.ChannelOptions["testservice40"] = options
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.ChannelOptions["testservice40"] = options
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice40")
+	client2 := createClient(t, "ws://localhost:21001/testservice40")
+	client3 := createClient(t, "ws://localhost:21001/testservice40")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+	client3Id := getClientId(client3)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client1.Connect, client3Id)
+	checkConnect(t, <-client2.Connect, client3Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	// client2 replies to a broadcast from client1 on the other service
+	client1.SendBroadcastData("question")
+	if question := <-client2.Broadcast; question.Payload != "question" {
+		t.Fatalf("broadcast=%s, want %s", question.Payload, "question")
+	}
+	client2.SendBroadcastData("answer")
+
+	received := []WireMessage{<-client3.Broadcast, <-client3.Broadcast}
+	if received[0].Payload != "question" {
+		received[0], received[1] = received[1], received[0]
+	}
+	question, answer := received[0], received[1]
+
+	if !question.Clock.HappenedBefore(answer.Clock) {
+		t.Fatalf("question clock %v does not precede answer clock %v", question.Clock, answer.Clock)
+	}
+	if answer.Clock.HappenedBefore(question.Clock) {
+		t.Fatalf("answer clock %v precedes question clock %v", answer.Clock, question.Clock)
+	}
+
+	// Restore the causal order of broadcasts received out of order
+	outOfOrder := []WireMessage{answer, question}
+	SortCausally(outOfOrder)
+	if outOfOrder[0].Payload != "question" || outOfOrder[1].Payload != "answer" {
+		t.Fatalf("order=[%s %s], want [question answer]", outOfOrder[0].Payload, outOfOrder[1].Payload)
+	}
+
+	// Concurrent broadcasts are not reordered, whatever their clock counts
+	concurrent := []WireMessage{
+		{Payload: "first", Clock: VectorClock{"a": 2}},
+		{Payload: "second", Clock: VectorClock{"b": 1}},
+	}
+	SortCausally(concurrent)
+	if concurrent[0].Payload != "first" || concurrent[1].Payload != "second" {
+		t.Fatalf("order=[%s %s], want [first second]", concurrent[0].Payload, concurrent[1].Payload)
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestSignedChannelURLs(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.URLSigningSecret = []byte("shared secret")
+	service.Start()
+
+	request := func(query string) int {
+		req, err := http.NewRequest("GET", "http://localhost:21000/testservice41?"+query, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		return w.Code
+	}
+
+	valid := service.SignChannel("testservice41", time.Now().Add(time.Minute))
+	expired := service.SignChannel("testservice41", time.Now().Add(-time.Minute))
+	otherChannel := service.SignChannel("testservice42", time.Now().Add(time.Minute))
+	tampered := strings.Replace(valid, "expires=", "expires=1", 1)
+
+	for _, query := range []string{"", expired, otherChannel, tampered} {
+		if code := request(query); code != 403 {
+			t.Fatalf("query %q status=%d, want %d", query, code, 403)
+		}
+	}
+
+	client := createClient(t, "ws://localhost:21000/testservice41?"+valid)
+	if id := getClientId(client); id == "" {
+		t.Fatalf("Could not connect with signed URL")
+	}
+
+	client.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestDuplicateInstancePolicy(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.DuplicateInstancePolicy = "replace"
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice42?instance=abc")
+	client2 := createClient(t, "ws://localhost:21000/testservice42")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	// A new connection of the same instance replaces the open connection
+	client3 := createClient(t, "ws://localhost:21000/testservice42?instance=abc")
+	client3Id := getClientId(client3)
+
+	disconnect := <-client2.Disconnect
+	checkDisconnect(t, disconnect, client1Id)
+	if disconnect.Code != replacedCloseCode {
+		t.Fatalf("code=%d, want %d", disconnect.Code, replacedCloseCode)
+	}
+	checkConnect(t, <-client2.Connect, client3Id)
+
+	// A new connection of the same instance is rejected
+	service.DuplicateInstancePolicy = "reject"
+
+	req, err := http.NewRequest("GET", "http://localhost:21000/testservice42?instance=abc", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+
+	w := httptest.NewRecorder()
+	service.Handler.ServeLocalRequest(w, req)
+	if w.Code != 409 {
+		t.Fatalf("status=%d, want %d", w.Code, 409)
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSendMessage(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice43")
+	client2 := createClient(t, "ws://localhost:21001/testservice43")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	// Send to a local peer and to a peer of the federated service
+	for id, client := range map[string]*Client{client1Id: client1, client2Id: client2} {
+		if err := service1.SendMessage("testservice43", id, "from service"); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+
+		message := <-client.Message
+		if message.Payload != "from service" || message.Source != "" || message.Target != id {
+			t.Fatalf("message=%+v, want a message to %s from the service", message, id)
+		}
+	}
+
+	if err := service1.SendMessage("testservice43", "unknownpeer", "from service"); err == nil {
+		t.Fatalf("SendMessage: expected an error for an unknown peer")
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestPauseAdvertisement(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice44")
+	client2 := createClient(t, "ws://localhost:21001/testservice44")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	isAdvertised := func() bool {
+		channels, err := service1.BrowseChannels(100 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("BrowseChannels: %v", err)
+		}
+		for _, channel := range channels {
+			if channel.Matches("testservice44") && channel.Port == service1.ProxyPort {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := service1.PauseAdvertisement("testservice44"); err != nil {
+		t.Fatalf("PauseAdvertisement: %v", err)
+	}
+
+	if isAdvertised() {
+		t.Fatalf("channel is advertised while paused")
+	}
+
+	// Existing federation links keep delivering messages
+	checkBroadcast(t, "while paused", client1, []*Client{client2})
+	checkBroadcast(t, "while paused", client2, []*Client{client1})
+
+	if err := service1.ResumeAdvertisement("testservice44"); err != nil {
+		t.Fatalf("ResumeAdvertisement: %v", err)
+	}
+
+	if !isAdvertised() {
+		t.Fatalf("channel is not advertised after resuming")
+	}
+
+	if err := service1.PauseAdvertisement("testservice45"); err == nil {
+		t.Fatalf("PauseAdvertisement: expected an error for an unknown channel")
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestDeterministicIds(t *testing.T) {
+
+	// Return the ids of the peers of two federated services and the sorted
+	// ids of their proxy connections
+	connectIds := func() []string {
+		service1 := NewService("localhost", 21000)
+		service1.RandomSource = rand.NewSource(42)
+		service1.Start()
+
+		service2 := NewService("localhost", 21001)
+		service2.RandomSource = rand.NewSource(43)
+		service2.Start()
+
+		client1 := createClient(t, "ws://localhost:21000/testservice45")
+		client2 := createClient(t, "ws://localhost:21000/testservice45")
+		client3 := createClient(t, "ws://localhost:21001/testservice45")
+
+		ids := []string{getClientId(client1), getClientId(client2), getClientId(client3)}
+
+		// Wait for the services to federate
+		for i := 0; i < 2; i++ {
+			<-client3.Connect
+		}
+		<-client1.Connect
+		<-client1.Connect
+
+		for _, service := range []*Service{service1, service2} {
+			proxyIds := make([]string, 0)
+			for _, snapshot := range service.Snapshot() {
+				for _, proxy := range snapshot.Proxies {
+					proxyIds = append(proxyIds, proxy.Id)
+				}
+			}
+			sort.Strings(proxyIds)
+			ids = append(ids, proxyIds...)
+		}
+
+		client1.Stop()
+		client2.Stop()
+		client3.Stop()
+
+		go func() {
+			service1.Stop()
+			service2.Stop()
+		}()
+
+		<-service1.StopNotify()
+		<-service2.StopNotify()
+
+		return ids
+	}
+
+	ids1 := connectIds()
+	ids2 := connectIds()
+
+	if ids1[0] == ids1[1] {
+		t.Fatalf("ids=%v, want distinct ids", ids1)
+	}
+	if len(ids1) <= 3 {
+		t.Fatalf("ids=%v, want proxy ids", ids1)
+	}
+	if fmt.Sprint(ids1) != fmt.Sprint(ids2) {
+		t.Fatalf("ids=%v, want %v for the same random seeds", ids2, ids1)
+	}
+}
+
+func TestDrainChannel(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice46")
+	client2 := createClient(t, "ws://localhost:21001/testservice46")
+	client3 := createClient(t, "ws://localhost:21000/testservice47")
+	client4 := createClient(t, "ws://localhost:21000/testservice47")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+	client3Id := getClientId(client3)
+	client4Id := getClientId(client4)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+	checkConnect(t, <-client3.Connect, client4Id)
+	checkConnect(t, <-client4.Connect, client3Id)
+
+	if err := service1.DrainChannel("testservice46", "event over", 100*time.Millisecond); err != nil {
+		t.Fatalf("DrainChannel: %v", err)
+	}
+
+	// All peers of the drained channel, local and remote, are notified
+	for _, client := range []*Client{client1, client2} {
+		if drain := <-client.Drain; drain.Payload != "event over" {
+			t.Fatalf("drain=%s, want %s", drain.Payload, "event over")
+		}
+	}
+
+	// Both services reject new connections to the drained channel only
+	request := func(service *Service, url string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		return w.Code
+	}
+
+	if code := request(service1, "http://localhost:21000/testservice46"); code != 503 {
+		t.Fatalf("status=%d, want %d", code, 503)
+	}
+	if code := request(service2, "http://localhost:21001/testservice46"); code != 503 {
+		t.Fatalf("status=%d, want %d", code, 503)
+	}
+	if code := request(service1, "http://localhost:21000/testservice47"); code == 503 {
+		t.Fatalf("status=%d for a channel that is not drained", code)
+	}
+
+	// Local peers of the drained channel are closed after the grace period
+	disconnect := <-client2.Disconnect
+	checkDisconnect(t, disconnect, client1Id)
+	if disconnect.Code != drainedCloseCode {
+		t.Fatalf("code=%d, want %d", disconnect.Code, drainedCloseCode)
+	}
+
+	// The other channel stays fully operational
+	client5 := createClient(t, "ws://localhost:21000/testservice47")
+	client5Id := getClientId(client5)
+	checkConnect(t, <-client3.Connect, client5Id)
+	checkBroadcast(t, "still open", client3, []*Client{client4, client5})
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+	client4.Stop()
+	client5.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+// Router that delivers each broadcast to the next peer in a ring of all peers
+// ordered by id
+type ringRouter struct{}
+
+func (router ringRouter) Route(channel string, source string, message *WireMessage, peerIds []string) []string {
+	ring := append([]string{}, peerIds...)
+	sort.Strings(ring)
+	for i, id := range ring {
+		if id == source {
+			return []string{ring[(i+1)%len(ring)]}
+		}
+	}
+	return nil
+}
+
+func TestRouter(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Router = ringRouter{}
+	service.Start()
+
+	clients := make(map[string]*Client)
+	ring := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		client := createClient(t, "ws://localhost:21000/testservice48")
+		id := getClientId(client)
+		clients[id] = client
+		ring = append(ring, id)
+	}
+	sort.Strings(ring)
+
+	for _, id := range ring {
+		clients[id].SendBroadcastData("from " + id)
+	}
+
+	// Each peer only receives the broadcast of the previous peer in the ring
+	for i, id := range ring {
+		previous := ring[(i+len(ring)-1)%len(ring)]
+
+		broadcast := <-clients[id].Broadcast
+		if broadcast.Source != previous || broadcast.Payload != "from "+previous {
+			t.Fatalf("broadcast=%s from %s, want broadcast from %s", broadcast.Payload, broadcast.Source, previous)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	for id, client := range clients {
+		if len(client.Broadcast) != 0 {
+			t.Fatalf("peer %s received %d unexpected broadcasts", id, len(client.Broadcast))
+		}
+		client.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestEcho(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice49")
+	client2 := createClient(t, "ws://localhost:21000/testservice49")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+
+	// Echo back to the sender and on to another peer
+	client1.SendEcho("")
+	client1.SendEcho(client2Id)
+
+	for _, client := range []*Client{client1, client2} {
+		echo := <-client.Echo
+		if echo.Source != client1Id {
+			t.Fatalf("source=%s, want %s", echo.Source, client1Id)
+		}
+		if echo.ClientTime < before || echo.ServerTime < echo.ClientTime {
+			t.Fatalf("clientTime=%d serverTime=%d, want both set after %d", echo.ClientTime, echo.ServerTime, before)
+		}
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMaxConcurrentFederationDials(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.MaxConcurrentFederationDials = 2
+
+	channel := newTestChannel(service, "testservice50")
+
+	// A fake remote service that holds each proxy connection attempt open
+	// for a while before failing it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	var mu sync.Mutex
+	dialing, maxDialing := 0, 0
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				mu.Lock()
+				dialing++
+				if dialing > maxDialing {
+					maxDialing = dialing
+				}
+				mu.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mu.Lock()
+				dialing--
+				mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// Dial many discovered hosts at once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		record := &DNSRecord{
+			ServiceEntry: &mdns.ServiceEntry{
+				AddrV4: net.ParseIP("127.0.0.1"),
+				Port:   port,
+			},
+			Path:        "/testservice50",
+			Hash_Base64: fmt.Sprintf("host%d", i),
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dialProxyFromDNSRecord(record, channel)
+		}()
+	}
+	wg.Wait()
+
+	if maxDialing < 1 || maxDialing > service.MaxConcurrentFederationDials {
+		t.Fatalf("max concurrent dials=%d, want 1-%d", maxDialing, service.MaxConcurrentFederationDials)
+	}
+}
+
+func TestStrictMessageParsing(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice51")
+	client2 := createClient(t, "ws://localhost:21000/testservice51")
+
+	getClientId(client1)
+	getClientId(client2)
+
+	typo := []byte(`{"action":"broadcast","data":"hello","shrad":"a"}`)
+
+	// Unknown fields are ignored by default
+	client1.transport.Write(typo)
+	if broadcast := <-client2.Broadcast; broadcast.Payload != "hello" {
+		t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "hello")
+	}
+
+	service.StrictMessageParsing = true
+
+	client1.transport.Write(typo)
+	if reply := <-client1.Error; reply.Payload != "unknown_field" {
+		t.Fatalf("error=%s, want %s", reply.Payload, "unknown_field")
+	}
+
+	checkBroadcast(t, "no typos", client1, []*Client{client2})
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestBroadcastMaxAge(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+
+	// A slow peer that blocks on each write and a fast peer that does not
+	slowHandler := newSlowMessageHandler()
+	fastHandler := newSlowMessageHandler()
+	fastHandler.release = make(chan bool, 2)
+	fastHandler.release <- true
+	fastHandler.release <- true
+
+	channel := newTestChannel(service, "testservice52")
+	for i, handler := range []*slowMessageHandler{slowHandler, fastHandler} {
+		peer := &Peer{
+			id:        fmt.Sprintf("peer%d", i),
+			transport: newWriteOnlyTransport(handler),
+			active:    true,
+			channel:   channel,
+		}
+		peer.transport.lateDrops = &service.lateBroadcastDrops
+		channel.peers = append(channel.peers, peer)
+	}
+
+	channel.localBroadcast(&WireMessage{Action: "broadcast", Source: "source", Payload: "first"})
+	channel.localBroadcast(&WireMessage{Action: "broadcast", Source: "source", Payload: "realtime", MaxAge: 20})
+
+	for _, payload := range []string{"first", "realtime"} {
+		if written := <-fastHandler.written; !strings.Contains(written, payload) {
+			t.Fatalf("fast peer written=%s, want %s", written, payload)
+		}
+	}
+
+	// The slow peer is still writing the first broadcast when the deadline passes
+	time.Sleep(50 * time.Millisecond)
+	slowHandler.release <- true
+	if written := <-slowHandler.written; !strings.Contains(written, "first") {
+		t.Fatalf("slow peer written=%s, want %s", written, "first")
+	}
+
+	for i := 0; service.DroppedLateBroadcasts() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("DroppedLateBroadcasts=%d, want %d", service.DroppedLateBroadcasts(), 1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case slowHandler.release <- true:
+		t.Fatalf("slow peer was written the late broadcast: %s", <-slowHandler.written)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	for _, peer := range channel.peers {
+		close(peer.transport.closed)
+	}
+}
+
+func TestMaxBroadcastRate(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ChannelOptions["testservice53"] = ChannelOptions{MaxBroadcastRate: 5, BroadcastBurst: 5}
+	service.Start()
+
+	receiver := createClient(t, "ws://localhost:21000/testservice53")
+	getClientId(receiver)
+
+	senders := make([]*Client, 3)
+	for i := range senders {
+		senders[i] = createClient(t, "ws://localhost:21000/testservice53")
+		getClientId(senders[i])
+	}
+
+	// The senders' combined rate is capped, whichever of them sends
+	for i := 0; i < 5; i++ {
+		for _, sender := range senders {
+			sender.SendBroadcastData(fmt.Sprintf("broadcast %d", i))
+		}
+	}
+
+	delivered := 0
+receive:
+	for {
+		select {
+		case <-receiver.Broadcast:
+			delivered++
+		case <-time.After(200 * time.Millisecond):
+			break receive
+		}
+	}
+
+	// The burst plus at most one token refilled while sending
+	if delivered < 5 || delivered > 6 {
+		t.Fatalf("delivered=%d, want 5 or 6", delivered)
+	}
+
+	limited := 0
+	for _, sender := range senders {
+	replies:
+		for {
+			select {
+			case reply := <-sender.Error:
+				if reply.Payload != "rate_limited" {
+					t.Fatalf("error=%s, want %s", reply.Payload, "rate_limited")
+				}
+				limited++
+			default:
+				break replies
+			}
+		}
+	}
+	if limited != 15-delivered {
+		t.Fatalf("rate_limited errors=%d, want %d", limited, 15-delivered)
+	}
+
+	for _, snapshot := range service.Snapshot() {
+		if snapshot.Name == "testservice53" && (snapshot.BroadcastRate < 5 || snapshot.BroadcastRate > 6) {
+			t.Fatalf("BroadcastRate=%v, want between 5 and 6", snapshot.BroadcastRate)
+		}
+	}
+
+	// Sample broadcasts are limited like other broadcasts
+	for i := 0; i < 10; i++ {
+		senders[0].SendSampleBroadcastData("sample", 1, int64(i))
+	}
+	select {
+	case reply := <-senders[0].Error:
+		if reply.Payload != "rate_limited" {
+			t.Fatalf("error=%s, want %s", reply.Payload, "rate_limited")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sample broadcasts were not rate limited")
+	}
+
+	receiver.Stop()
+	for _, sender := range senders {
+		sender.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+// Records exported spans in memory
+type recordingSpanExporter struct {
+	spans chan Span
+}
+
+func (exporter *recordingSpanExporter) ExportSpan(span Span) {
+	exporter.spans <- span
+}
+
+// Wait for a span with the given name from the exporter
+func waitForSpan(t *testing.T, exporter *recordingSpanExporter, name string) Span {
+	for {
+		select {
+		case span := <-exporter.spans:
+			if span.Name == name {
+				return span
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s span exported", name)
+		}
+	}
+}
+
+func TestSpanExporter(t *testing.T) {
+
+	exporter1 := &recordingSpanExporter{make(chan Span, 255)}
+	exporter2 := &recordingSpanExporter{make(chan Span, 255)}
+
+	service1 := NewService("localhost", 21000)
+	service1.SpanExporter = exporter1
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.SpanExporter = exporter2
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice54")
+	client2 := createClient(t, "ws://localhost:21001/testservice54")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	checkBroadcast(t, "traced", client1, []*Client{client2})
+
+	received := waitForSpan(t, exporter1, "received")
+	if received.ParentId != "" || received.Source != client1Id || received.Channel != "testservice54" {
+		t.Fatalf("received span=%+v, want root span of %s on testservice54", received, client1Id)
+	}
+	forwarded := waitForSpan(t, exporter1, "forwarded")
+
+	remoteReceived := waitForSpan(t, exporter2, "received")
+	remoteRouted := waitForSpan(t, exporter2, "routed")
+	remoteDelivered := waitForSpan(t, exporter2, "delivered")
+
+	// Each span is a child of the previous stage, across both services
+	for _, link := range []struct {
+		child, parent Span
+	}{
+		{forwarded, received},
+		{remoteReceived, forwarded},
+		{remoteRouted, remoteReceived},
+		{remoteDelivered, remoteRouted},
+	} {
+		if link.child.TraceId != received.TraceId || link.child.ParentId != link.parent.SpanId {
+			t.Fatalf("%s span=%+v, want child of %s span %s in trace %s", link.child.Name, link.child, link.parent.Name, link.parent.SpanId, received.TraceId)
+		}
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestDiscoveryTTL(t *testing.T) {
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client2 := createClient(t, "ws://localhost:21001/testservice55")
+	getClientId(client2)
+
+	// Browse for service2 by hand instead of starting service1's browser
+	service1 := NewService("localhost", 21000)
+	service1.DiscoveryTTL = 1500 * time.Millisecond
+	channel := NewChannel(service1, "testservice55")
+	channel.persistent = true
+
+	outboundLinks := func() int {
+		count := 0
+		for _, link := range service1.FederationLinks() {
+			if link.Direction == "outbound" {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 0; outboundLinks() == 0; i++ {
+		if i == 5 {
+			t.Fatalf("service1 did not federate with service2")
+		}
+		service1.discoveryBrowser.Browse(service1, 1)
+	}
+
+	// Links stay up while service2 is still advertised
+	service1.discoveryBrowser.Browse(service1, 1)
+	service1.expireProxyServices(time.Now())
+	if count := outboundLinks(); count != 1 {
+		t.Fatalf("outbound links=%d, want %d", count, 1)
+	}
+
+	// service2 vanishes from discovery without a goodbye
+	service2.PauseAdvertisement("testservice55")
+	service1.discoveryBrowser.Browse(service1, 1)
+	service1.expireProxyServices(time.Now())
+	if count := outboundLinks(); count != 0 {
+		t.Fatalf("outbound links=%d, want %d", count, 0)
+	}
+
+	// service2 sees the link drop too
+	for i := 0; len(service2.FederationLinks()) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("service2 links=%v, want none", service2.FederationLinks())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client2.Stop()
+	channel.Stop()
+
+	go service2.Stop()
+
+	<-service2.StopNotify()
+}
+
+func TestSubscribeChannelLinkDown(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+
+	// A channel with a proxy connection owning two remote peers
+	proxy := &Proxy{
+		base:    Peer{id: "proxy"},
+		peerIds: map[string]bool{"remote1": true, "remote2": true},
+	}
+	channel := newTestChannel(service, "testservice84")
+	channel.proxies = []*Proxy{proxy}
+	proxy.base.channel = channel
+	service.Channels[channel.servicePath] = channel
+
+	events, stop, err := service.SubscribeChannel("testservice84")
+	if err != nil {
+		t.Fatalf("SubscribeChannel: %v", err)
+	}
+	defer stop()
+
+	for event := range events {
+		if event.Action == "snapshot" {
+			break
+		}
+	}
+
+	// The remote peers leave the channel when the link goes down
+	proxy.removeConnection()
+
+	disconnected := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		event := <-events
+		if event.Action != "disconnect" {
+			t.Fatalf("event=%+v, want a disconnect", event)
+		}
+		disconnected[event.Target] = true
+	}
+	if !disconnected["remote1"] || !disconnected["remote2"] {
+		t.Fatalf("disconnected=%v, want remote1 and remote2", disconnected)
+	}
+}
+
+func TestRetainForwardWithoutInstance(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ForwardRetries = 3
+
+	channel := newTestChannel(service, "testservice85")
+	proxy := &Proxy{base: Peer{id: "proxy", channel: channel}}
+
+	// Messages for a remote service of unknown instance could never be
+	// replayed, so they are not kept
+	proxy.retainForward(&queuedMessage{buf: []byte("lost")})
+	if pending := len(channel.pendingForwards); pending != 0 {
+		t.Fatalf("pending forwards=%d, want %d", pending, 0)
+	}
+
+	proxy.instance = "remote"
+	proxy.retainForward(&queuedMessage{buf: []byte("kept")})
+	if pending := len(channel.pendingForwards["remote"]); pending != 1 {
+		t.Fatalf("pending forwards=%d, want %d", pending, 1)
+	}
+}
+
+func TestTapPeer(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.AdminUIEnabled = true
+	service.AdminToken = "secret"
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice56")
+	client2 := createClient(t, "ws://localhost:21000/testservice56")
+
+	client1Id := getClientId(client1)
+	getClientId(client2)
+
+	tapURL := "http://localhost:21000/admin/tap?channel=testservice56&peer=" + client1Id + "&duration=5s"
+
+	tap := func(token string) *http.Response {
+		req, err := http.NewRequest("POST", tapURL, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", tapURL, err)
+		}
+		return resp
+	}
+
+	resp := tap("guess")
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Fatalf("status=%d, want %d", resp.StatusCode, 401)
+	}
+
+	resp = tap("secret")
+	if resp.StatusCode != 200 {
+		t.Fatalf("status=%d, want %d", resp.StatusCode, 200)
+	}
+
+	// The tap sees client1's traffic in both directions without altering it
+	checkBroadcast(t, "ping", client1, []*Client{client2})
+	checkBroadcast(t, "pong", client2, []*Client{client1})
+
+	frames := bufio.NewScanner(resp.Body)
+	for _, want := range []TappedFrame{{Direction: "inbound", Data: "ping"}, {Direction: "outbound", Data: "pong"}} {
+		for {
+			if !frames.Scan() {
+				t.Fatalf("tap ended before %s frame %s: %v", want.Direction, want.Data, frames.Err())
+			}
+			var frame TappedFrame
+			if err := json.Unmarshal(frames.Bytes(), &frame); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if frame.Direction == want.Direction && strings.Contains(frame.Data, want.Data) {
+				break
+			}
+		}
+	}
+	resp.Body.Close()
+
+	// A tap that expires immediately is closed, not left open
+	expired, _, err := service.TapPeer("testservice56", client1Id, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("TapPeer: %v", err)
+	}
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("tap was not closed when it expired")
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestChannelWriterModel(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.WriterModel = "channel"
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice57")
+	client2 := createClient(t, "ws://localhost:21000/testservice57")
+	client3 := createClient(t, "ws://localhost:21000/testservice57")
+
+	getClientId(client1)
+	client2Id := getClientId(client2)
+	client3Id := getClientId(client3)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client1.Connect, client3Id)
+
+	channel := service.GetChannelByName("testservice57")
+	for _, peer := range channel.peers {
+		if peer.transport.writer != channel.writer {
+			t.Fatalf("peer %s does not use the channel's writer", peer.id)
+		}
+	}
+
+	checkBroadcast(t, "shared writer", client1, []*Client{client2, client3})
+	checkBroadcast(t, "in order", client3, []*Client{client1, client2})
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestChannelWriterBatches(t *testing.T) {
+
+	writer := newChannelWriter()
+
+	// Both peers record their writes in the same order
+	written := make(chan string, 255)
+	transports := make(map[string]*Transport)
+	for _, name := range []string{"busy", "quiet"} {
+		handler := &slowMessageHandler{release: make(chan bool), written: written}
+		close(handler.release)
+		transports[name] = NewTransport(nil, handler)
+		transports[name].open = true
+		transports[name].writer = writer
+	}
+
+	for i := 0; i < 3*writerBatchSize; i++ {
+		transports["busy"].Write([]byte("busy"))
+	}
+	transports["quiet"].Write([]byte("quiet"))
+
+	go writer.run()
+	defer writer.Stop()
+
+	// The quiet peer is written after the first batch of the busy peer
+	for i := 0; i < writerBatchSize; i++ {
+		if message := <-written; message != "busy" {
+			t.Fatalf("message %d=%s, want %s", i, message, "busy")
+		}
+	}
+	if message := <-written; message != "quiet" {
+		t.Fatalf("message %d=%s, want %s", writerBatchSize, message, "quiet")
+	}
+	for i := 0; i < 2*writerBatchSize; i++ {
+		if message := <-written; message != "busy" {
+			t.Fatalf("message %d=%s, want %s", writerBatchSize+1+i, message, "busy")
+		}
+	}
+}
+
+func TestDeliveryFilter(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ChannelOptions["testservice58"] = ChannelOptions{
+		DeliveryFilter: `"display" in peer.tags && msg.data.startsWith("ui.")`,
+	}
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice58")
+	display := createClient(t, "ws://localhost:21000/testservice58?tag=display")
+	console := createClient(t, "ws://localhost:21000/testservice58?tag=console")
+
+	getClientId(sender)
+	getClientId(display)
+	getClientId(console)
+
+	sender.SendBroadcastData("log.started")
+	sender.SendBroadcastData("ui.refresh")
+
+	if broadcast := <-display.Broadcast; broadcast.Payload != "ui.refresh" {
+		t.Fatalf("display broadcast=%s, want %s", broadcast.Payload, "ui.refresh")
+	}
+	select {
+	case broadcast := <-console.Broadcast:
+		t.Fatalf("console was delivered broadcast %s", broadcast.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sender.Stop()
+	display.Stop()
+	console.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestCompileDeliveryFilter(t *testing.T) {
+
+	peer := &Peer{id: "peer1", shard: "eu", tags: []string{"display"}}
+
+	for _, test := range []struct {
+		expression string
+		message    WireMessage
+		deliver    bool
+	}{
+		{`peer.shard == msg.shard || msg.source == "admin"`, WireMessage{Source: "peer2", Shard: "eu"}, true},
+		{`peer.shard == msg.shard || msg.source == "admin"`, WireMessage{Source: "admin", Shard: "us"}, true},
+		{`peer.shard == msg.shard || msg.source == "admin"`, WireMessage{Source: "peer2", Shard: "us"}, false},
+		{`!("console" in peer.tags) && !msg.data.contains("secret")`, WireMessage{Payload: "hello"}, true},
+		{`!("console" in peer.tags) && !msg.data.contains("secret")`, WireMessage{Payload: "a secret"}, false},
+	} {
+		filter, err := compileDeliveryFilter(test.expression)
+		if err != nil {
+			t.Fatalf("compileDeliveryFilter(%s): %v", test.expression, err)
+		}
+		if deliver := filter(peer, &test.message); deliver != test.deliver {
+			t.Fatalf("%s with %+v=%v, want %v", test.expression, test.message, deliver, test.deliver)
+		}
+	}
+
+	for _, expression := range []string{
+		`peer.role == "display"`,
+		`msg.data`,
+		`peer.tags == "display"`,
+		`msg.data.matches(".*")`,
+		`(peer.id == "a"`,
+		strings.Repeat(`peer.id == "a" || `, 20) + `true`,
+	} {
+		if _, err := compileDeliveryFilter(expression); err == nil {
+			t.Fatalf("compileDeliveryFilter(%s): expected an error", expression)
+		}
+	}
+}
+
+func TestPublishMulti(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice59")
+	client2 := createClient(t, "ws://localhost:21000/testservice60")
+
+	getClientId(client1)
+	getClientId(client2)
+
+	results := service.PublishMulti([]string{"testservice59", "unknownservice", "testservice60"}, "", "announcement")
+
+	for name, want := range map[string]bool{"testservice59": true, "unknownservice": false, "testservice60": true} {
+		if err, ok := results[name]; !ok || (err == nil) != want {
+			t.Fatalf("%s result=%v, want success=%v", name, err, want)
+		}
+	}
+
+	for _, client := range []*Client{client1, client2} {
+		if broadcast := <-client.Broadcast; broadcast.Payload != "announcement" {
+			t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "announcement")
+		}
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestBufferSizes(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ReadBufferSize = 256
+	service.WriteBufferSize = 256
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice61")
+	client2 := createClient(t, "ws://localhost:21000/testservice61")
+
+	getClientId(client1)
+	getClientId(client2)
+
+	// Messages many times larger than the buffers are still delivered whole
+	large := strings.Repeat("0123456789", 700)
+	client1.SendBroadcastData(large)
+	if broadcast := <-client2.Broadcast; broadcast.Payload != large {
+		t.Fatalf("broadcast of %d bytes, want %d bytes", len(broadcast.Payload), len(large))
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestBroadcastOnConnect(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	observer, _, err := websocket.DefaultDialer.Dial("ws://localhost:21000/testservice62", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	// Wait until the observer is registered with the channel
+	for snapshots := service.Snapshot(); len(snapshots) == 0 || len(snapshots[0].Peers) == 0; snapshots = service.Snapshot() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 20; i++ {
+		// Broadcast in the same tick as connecting, before reading anything
+		conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:21000/testservice62", nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"broadcast","data":"early"}`))
+
+		// The observer sees the sender connect before its broadcast
+		connected := ""
+		for connected == "" {
+			_, buf, err := observer.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			message, _ := decodeWireMessage(buf)
+			switch message.Action {
+			case "connect":
+				connected = message.Target
+			case "broadcast":
+				t.Fatalf("broadcast from %s received before its connect", message.Source)
+			}
+		}
+
+		_, buf, err := observer.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if message, _ := decodeWireMessage(buf); message.Action != "broadcast" || message.Source != connected || message.Payload != "early" {
+			t.Fatalf("message=%s, want broadcast early from %s", buf, connected)
+		}
+
+		conn.Close()
+
+		// Skip the sender's disconnect
+		for {
+			_, buf, err := observer.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			if message, _ := decodeWireMessage(buf); message.Action == "disconnect" {
+				break
+			}
+		}
+	}
+
+	observer.Close()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSlowWriteStrikes(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.SlowWriteThreshold = 10 * time.Millisecond
+	service.SlowWriteStrikes = 3
+	service.SlowWriteWindow = 100 * time.Millisecond
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice63")
+	client2 := createClient(t, "ws://localhost:21000/testservice63")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+	checkConnect(t, <-client2.Connect, client1Id)
+
+	var peer *Peer
+	for _, p := range service.GetChannelByName("testservice63").peers {
+		if p.id == client1Id {
+			peer = p
+		}
+	}
+
+	// Intermittent slow writes never reach the strike limit within the window
+	for i := 0; i < 4; i++ {
+		peer.recordWrite(time.Now(), 20*time.Millisecond)
+		time.Sleep(60 * time.Millisecond)
+	}
+	peer.recordWrite(time.Now(), 5*time.Millisecond) // not slow
+
+	if peers := service.Snapshot()[0].Peers; peers[0].WriteStrikes+peers[1].WriteStrikes != 1 {
+		t.Fatalf("peers=%v, want 1 write strike", peers)
+	}
+	select {
+	case disconnect := <-client2.Disconnect:
+		t.Fatalf("peer %s disconnected after intermittent slow writes", disconnect.Target)
+	default:
+	}
+
+	// Sustained slow writes drop the peer
+	for i := 0; i < 3; i++ {
+		peer.recordWrite(time.Now(), 20*time.Millisecond)
+	}
+
+	disconnect := <-client2.Disconnect
+	checkDisconnect(t, disconnect, client1Id)
+	if disconnect.Code != slowConsumerCloseCode {
+		t.Fatalf("code=%d, want %d", disconnect.Code, slowConsumerCloseCode)
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMiddleware(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	service := NewService("localhost", 21000)
+	if err := service.ListenWith(listener); err != nil {
+		t.Fatalf("ListenWith: %v", err)
+	}
+
+	service.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "seen")
+			next.ServeHTTP(w, r)
+		})
+	})
+	unblock := service.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Blocked", 429)
+		})
+	})
+
+	get := func() *http.Response {
+		resp, err := http.Get("http://" + service.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get(); resp.StatusCode != 429 || resp.Header.Get("X-Middleware") != "seen" {
+		t.Fatalf("status=%d header=%q, want %d and %q", resp.StatusCode, resp.Header.Get("X-Middleware"), 429, "seen")
+	}
+
+	// Unregistered middleware no longer runs
+	unblock()
+
+	if resp := get(); resp.StatusCode != 200 || resp.Header.Get("X-Middleware") != "seen" {
+		t.Fatalf("status=%d header=%q, want %d and %q", resp.StatusCode, resp.Header.Get("X-Middleware"), 200, "seen")
+	}
+
+	listener.Close()
+}
+
+type noDelayRecordingConn struct {
+	net.Conn
+	noDelay []bool
+}
+
+func (c *noDelayRecordingConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = append(c.noDelay, noDelay)
+	return nil
+}
+
+type singleConnListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
+
+func TestNoDelay(t *testing.T) {
+
+	if service := NewService("localhost", 21000); !service.NoDelay {
+		t.Fatalf("NoDelay=%v, want %v by default", service.NoDelay, true)
+	}
+
+	for _, noDelay := range []bool{true, false} {
+		conn := &noDelayRecordingConn{}
+		listener := &noDelayListener{&singleConnListener{conn: conn}, noDelay}
+
+		if _, err := listener.Accept(); err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+
+		if len(conn.noDelay) != 1 || conn.noDelay[0] != noDelay {
+			t.Fatalf("SetNoDelay calls=%v, want [%v]", conn.noDelay, noDelay)
+		}
+	}
+}
+
+// BENCHMARKS
+
+func BenchmarkSameProxyClientSetup(b *testing.B) {
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	b.ResetTimer() // start benchmark timer
+
+	// run the benchmark function b.N times
+	for n := 0; n < b.N; n++ {
+		// Create new Network Web Socket channel peers
+		client := createClient(b, "ws://localhost:21000/benchmarkservice1")
+		_ = getClientId(client) // wait for client connection to be established
+		client.Stop()
+	}
+
+	b.StopTimer() // end benchmark timer
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func BenchmarkSameProxyClientMessaging(b *testing.B) {
+	service := NewService("localhost", 21000)
+	_ = service.Start()
+
+	client1 := createClient(b, "ws://localhost:21000/benchmarkservice2")
+	client2 := createClient(b, "ws://localhost:21000/benchmarkservice2")
+
+	client2Id := getClientId(client2)
+
+	b.ResetTimer() // start benchmark timer
+
+	// run the benchmark function b.N times
+	for n := 0; n < b.N; n++ {
+		checkMessage(b, "direct benchmark message", client2Id, client1, client2)
+	}
+
+	b.StopTimer() // end benchmark timer
+
+	go func() {
+		client1.Stop()
+		client2.Stop()
+
+		service.Stop()
+	}()
+
+	<-service.StopNotify()
+}
+
+func BenchmarkSameProxyClientBroadcast(b *testing.B) {
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(b, "ws://localhost:21000/benchmarkservice3")
+	client2 := createClient(b, "ws://localhost:21000/benchmarkservice3")
+
+	b.ResetTimer() // start benchmark timer
+
+	// run the benchmark function b.N times
+	for n := 0; n < b.N; n++ {
+		checkBroadcast(b, "benchmark test msg", client1, []*Client{client2})
+	}
+
+	b.StopTimer() // end benchmark timer
+
+	go func() {
+		client1.Stop()
+		client2.Stop()
+
+		service.Stop()
+	}()
+
+	<-service.StopNotify()
+}
+
+func BenchmarkDifferentProxyClientBroadcast(b *testing.B) {
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(b, "ws://localhost:21000/benchmarkservice4")
+	client2 := createClient(b, "ws://localhost:21001/benchmarkservice4")
+
+	<-client1.Connect
+	<-client2.Connect
+
+	b.ResetTimer() // start benchmark timer
+
+	// run the benchmark function b.N times
+	for n := 0; n < b.N; n++ {
+		checkBroadcast(b, "benchmark test msg", client1, []*Client{client2})
+	}
+
+	b.StopTimer() // end benchmark timer
+
+	client1.Stop()
+	client2.Stop()
+
+	go service1.Stop()
+	<-service1.StopNotify()
+
+	go service2.Stop()
+	<-service2.StopNotify()
+}
+
+// Message handler that discards written messages
+type discardMessageHandler struct{}
+
+func (handler *discardMessageHandler) Read(buf []byte) error  { return nil }
+func (handler *discardMessageHandler) Write(buf []byte) error { return nil }
+
+func benchmarkBroadcastConcurrency(b *testing.B, concurrency int) {
+	service := NewService("localhost", 21000)
+	service.BroadcastConcurrency = concurrency
+
+	channel := newTestChannel(service, "benchmarkservice5")
+	for i := 0; i < 2000; i++ {
+		peer := &Peer{
+			id:        fmt.Sprintf("peer%d", i),
+			transport: newWriteOnlyTransport(&discardMessageHandler{}),
+			active:    true,
+			channel:   channel,
+		}
+		channel.peers = append(channel.peers, peer)
+	}
+
+	broadcast := &WireMessage{Action: "broadcast", Source: "source", Payload: "benchmark test msg"}
+
+	b.ResetTimer() // start benchmark timer
+
+	// run the benchmark function b.N times
+	for n := 0; n < b.N; n++ {
+		channel.localBroadcast(broadcast)
+	}
+
+	b.StopTimer() // end benchmark timer
+
+	for _, peer := range channel.peers {
+		close(peer.transport.closed)
+	}
+}
+
+// Counts down a broadcast's remaining deliveries
+type countingMessageHandler struct {
+	delivered *sync.WaitGroup
+}
+
+func (handler *countingMessageHandler) Read(buf []byte) error { return nil }
+func (handler *countingMessageHandler) Write(buf []byte) error {
+	handler.delivered.Done()
+	return nil
+}
+
+// Measure the time until a broadcast on every channel has been written to
+// all of its peers, and the number of goroutines used, for a writer model
+func benchmarkWriterModel(b *testing.B, writerModel string, channels int, peersPerChannel int) {
+	service := NewService("localhost", 21000)
+	service.WriterModel = writerModel
+
+	baseGoroutines := runtime.NumGoroutine()
+
+	var delivered sync.WaitGroup
+	all := make([]*Channel, 0, channels)
+	for c := 0; c < channels; c++ {
+		channel := newTestChannel(service, fmt.Sprintf("benchmarkservice6-%d", c))
+		for i := 0; i < peersPerChannel; i++ {
+			transport := NewTransport(nil, &countingMessageHandler{&delivered})
+			transport.open = true
+			if writerModel == "channel" {
+				transport.writer = channel.sharedWriter()
+				transport.writer.add(transport)
+			} else {
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go transport.writePump(&wg)
+				wg.Wait()
+			}
+
+			channel.peers = append(channel.peers, &Peer{
+				id:        fmt.Sprintf("peer%d", i),
+				transport: transport,
+				active:    true,
+				channel:   channel,
+			})
+		}
+		all = append(all, channel)
+	}
+
+	goroutines := runtime.NumGoroutine() - baseGoroutines
+
+	broadcast := &WireMessage{Action: "broadcast", Source: "source", Payload: "benchmark test msg"}
+
+	b.ResetTimer() // start benchmark timer
+
+	for n := 0; n < b.N; n++ {
+		delivered.Add(channels * peersPerChannel)
+		for _, channel := range all {
+			channel.localBroadcast(broadcast)
+		}
+		delivered.Wait()
+	}
+
+	b.StopTimer() // end benchmark timer
+
+	b.ReportMetric(float64(goroutines), "goroutines")
+
+	for _, channel := range all {
+		for _, peer := range channel.peers {
+			close(peer.transport.closed)
+		}
+		if channel.writer != nil {
+			channel.writer.Stop()
+		}
+	}
+}
+
+func BenchmarkWriterModelPeerManySmallChannels(b *testing.B) {
+	benchmarkWriterModel(b, "peer", 500, 4)
+}
+func BenchmarkWriterModelChannelManySmallChannels(b *testing.B) {
+	benchmarkWriterModel(b, "channel", 500, 4)
+}
+func BenchmarkWriterModelPeerFewLargeChannels(b *testing.B) {
+	benchmarkWriterModel(b, "peer", 4, 500)
+}
+func BenchmarkWriterModelChannelFewLargeChannels(b *testing.B) {
+	benchmarkWriterModel(b, "channel", 4, 500)
+}
+
+func BenchmarkBroadcastConcurrency1(b *testing.B)  { benchmarkBroadcastConcurrency(b, 1) }
+func BenchmarkBroadcastConcurrency4(b *testing.B)  { benchmarkBroadcastConcurrency(b, 4) }
+func BenchmarkBroadcastConcurrency16(b *testing.B) { benchmarkBroadcastConcurrency(b, 16) }
+
+func TestQuietPeersOnLinkDown(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+
+	// A channel with a quiet and a regular local peer and a proxy connection
+	proxyHandler := &slowMessageHandler{release: make(chan bool), written: make(chan string, 255)}
+	close(proxyHandler.release)
+	proxy := &Proxy{
+		base: Peer{
+			id:        "proxy",
+			transport: newWriteOnlyTransport(proxyHandler),
+			active:    true,
+		},
+		peerIds:   make(map[string]bool),
+		writeable: true,
+	}
+	channel := newTestChannel(service, "testservice83")
+	channel.peers = []*Peer{{id: "quiet", quiet: true}, {id: "regular"}}
+	channel.proxies = []*Proxy{proxy}
+	proxy.base.channel = channel
+
+	proxy.removeConnection()
+
+	// Only the regular peer, which the remote service was told about, is
+	// reported as disconnected
+	message, err := decodeWireMessage([]byte(<-proxyHandler.written))
+	if err != nil {
+		t.Fatalf("decodeWireMessage: %v", err)
+	}
+	if message.Action != "disconnect" || message.Target != "regular" {
+		t.Fatalf("message=%s %s, want disconnect %s", message.Action, message.Target, "regular")
+	}
+
+	select {
+	case written := <-proxyHandler.written:
+		t.Fatalf("unexpected message %s", written)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQuietJoin(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice64")
+	client1Id := getClientId(client1)
+
+	client2 := createClient(t, "ws://localhost:21000/testservice64?quiet=true")
+	getClientId(client2)
+
+	client3 := createClient(t, "ws://localhost:21000/testservice64")
+	client3Id := getClientId(client3)
+
+	// A quiet peer is informed of other peers but they are not informed of it
+	checkConnect(t, <-client2.Connect, client1Id)
+	checkConnect(t, <-client2.Connect, client3Id)
+	checkConnect(t, <-client1.Connect, client3Id)
+	checkConnect(t, <-client3.Connect, client1Id)
+
+	// A quiet peer still receives broadcasts
+	client1.SendBroadcastData("hello")
+	for _, client := range []*Client{client2, client3} {
+		if broadcast := <-client.Broadcast; broadcast.Payload != "hello" {
+			t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "hello")
+		}
+	}
+
+	// A quiet peer leaves without a disconnect event
+	client2.Stop()
+	client3.Stop()
+	checkDisconnect(t, <-client1.Disconnect, client3Id)
+
+	client1.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestDirectMessageRoutes(t *testing.T) {
+
+	services := make([]*Service, 3)
+	forwarded := make([]int32, 3)
+	for i := range services {
+		i := i
+		services[i] = NewService("localhost", 21000+i)
+		services[i].FederationMiddleware = func(channel string, message *WireMessage) error {
+			if message.Action == "message" {
+				atomic.AddInt32(&forwarded[i], 1)
+			}
+			return nil
+		}
+		services[i].Start()
+	}
+
+	clients := make([]*Client, 3)
+	clientIds := make([]string, 3)
+	for i := range clients {
+		clients[i] = createClient(t, fmt.Sprintf("ws://localhost:%d/testservice65", 21000+i))
+		clientIds[i] = getClientId(clients[i])
+	}
+
+	// Wait for every peer to be announced on every service
+	for _, client := range clients {
+		for i := 0; i < 2; i++ {
+			<-client.Connect
+		}
+	}
+
+	channel := services[2].GetChannelByName("testservice65")
+	channel.routesMu.RLock()
+	route := channel.routes[clientIds[0]]
+	channel.routesMu.RUnlock()
+	if route == nil {
+		t.Fatalf("no route to %s", clientIds[0])
+	}
+
+	// A direct message to a remote peer is forwarded to its service only
+	clients[2].SendMessageData("hello", clientIds[0])
+	if message := <-clients[0].Message; message.Payload != "hello" || message.Source != clientIds[2] {
+		t.Fatalf("message=%+v, want hello from %s", message, clientIds[2])
+	}
+	if atomic.LoadInt32(&forwarded[0]) != 1 || atomic.LoadInt32(&forwarded[1]) != 0 {
+		t.Fatalf("forwarded=%v, want [1 0 0]", forwarded)
+	}
+
+	// Routes to disconnected peers are removed
+	clients[0].Stop()
+	checkDisconnect(t, <-clients[2].Disconnect, clientIds[0])
+
+	channel.routesMu.RLock()
+	route = channel.routes[clientIds[0]]
+	channel.routesMu.RUnlock()
+	if route != nil {
+		t.Fatalf("route to %s was not removed on disconnect", clientIds[0])
+	}
+
+	clients[1].Stop()
+	clients[2].Stop()
+
+	go func() {
+		for _, service := range services {
+			service.Stop()
+		}
+	}()
+
+	for _, service := range services {
+		<-service.StopNotify()
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice66")
+	getClientId(client1)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:21000/testservice66", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	connId := (<-client1.Connect).Target
+
+	readError := func() string {
+		for {
+			var message WireMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				t.Fatalf("ReadJSON: %v", err)
+			}
+			if message.Action == "error" {
+				return message.Payload
+			}
+		}
+	}
+
+	// A malformed control frame is reported and the connection kept open
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":`))
+	if reason := readError(); reason != "malformed_message" {
+		t.Fatalf("error=%s, want %s", reason, "malformed_message")
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"broadcast","data":"still open"}`))
+	if broadcast := <-client1.Broadcast; broadcast.Payload != "still open" {
+		t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "still open")
+	}
+
+	// A malformed control frame is reported and the connection closed
+	service.ErrorPolicy = map[string]string{"malformed_message": "close"}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":`))
+	if reason := readError(); reason != "malformed_message" {
+		t.Fatalf("error=%s, want %s", reason, "malformed_message")
+	}
+
+	_, _, err = conn.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != errorCloseCode {
+		t.Fatalf("read err=%v, want close code %d", err, errorCloseCode)
+	}
+	conn.Close()
+
+	disconnect := <-client1.Disconnect
+	checkDisconnect(t, disconnect, connId)
+	if disconnect.Code != errorCloseCode || disconnect.Payload != "malformed_message" {
+		t.Fatalf("disconnect=%+v, want code %d", disconnect, errorCloseCode)
+	}
+
+	client1.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestChannelFederationCoverage(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	// service3 hosts the channel without channel peers
+	service3 := NewService("localhost", 21002)
+	service3.PreRegisterChannel("testservice67", ChannelOptions{})
+	service3.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice67")
+	client2 := createClient(t, "ws://localhost:21001/testservice67")
+
+	getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+
+	// A service advertising the channel at an address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	channel := service1.GetChannelByName("testservice67")
+	record := &DNSRecord{
+		ServiceEntry: &mdns.ServiceEntry{AddrV4: net.ParseIP("127.0.0.1"), Port: closedPort},
+		Path:         "/unreachable",
+		Hash_Base64:  "unreachable",
+	}
+	if err := dialProxyFromDNSRecord(record, channel); err == nil {
+		t.Fatalf("dialProxyFromDNSRecord: expected an error")
+	}
+
+	want := FederationCoverage{
+		WithPeers:    []string{fmt.Sprintf("127.0.0.1:%d", service2.ProxyPort)},
+		WithoutPeers: []string{fmt.Sprintf("127.0.0.1:%d", service3.ProxyPort)},
+		Unreachable:  []string{fmt.Sprintf("127.0.0.1:%d", closedPort)},
+	}
+
+	// Wait for service1 to dial service3 too
+	var coverage FederationCoverage
+	for i := 0; ; i++ {
+		if coverage, err = service1.ChannelFederationCoverage("testservice67"); err != nil {
+			t.Fatalf("ChannelFederationCoverage: %v", err)
+		}
+		if fmt.Sprint(coverage) == fmt.Sprint(want) {
+			break
+		}
+		if i == 200 {
+			t.Fatalf("coverage=%+v, want %+v", coverage, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := service1.ChannelFederationCoverage("unknownservice"); err == nil {
+		t.Fatalf("ChannelFederationCoverage: expected an error for an unknown channel")
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+		service3.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+	<-service3.StopNotify()
+}
+
+func TestForwardedBroadcastDeadline(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.Start()
+
+	// Delay broadcasts as if they were held up on the way to service2
+	service2 := NewService("localhost", 21001)
+	service2.ClockSkewTolerance = time.Millisecond
+	service2.FederationMiddleware = func(channel string, message *WireMessage) error {
+		if message.Action == "broadcast" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	}
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice68")
+	client2 := createClient(t, "ws://localhost:21001/testservice68")
+
+	getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+
+	// The remaining time budget of a broadcast is not reset on service2
+	client1.SendBroadcastDataWithMaxAge("stale", 50*time.Millisecond)
+	client1.SendBroadcastDataWithMaxAge("fresh", 10*time.Second)
+
+	if broadcast := <-client2.Broadcast; broadcast.Payload != "fresh" {
+		t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "fresh")
+	}
+	if dropped := service2.DroppedLateBroadcasts(); dropped != 1 {
+		t.Fatalf("DroppedLateBroadcasts=%d, want %d", dropped, 1)
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+}
+
+func TestMaxUpgradeRate(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.MaxUpgradeRate = 20
+	service.UpgradeBurst = 2
+	service.MaxUpgradeWait = 2 * time.Second
+	service.Start()
+
+	// A burst of connections is paced rather than rejected
+	const burst = 10
+	conns := make(chan *websocket.Conn, burst)
+	errs := make(chan error, burst)
+
+	start := time.Now()
+	for i := 0; i < burst; i++ {
+		go func() {
+			conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:21000/testservice69", nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			conns <- conn
+		}()
+	}
+
+	for i := 0; i < burst; i++ {
+		select {
+		case conn := <-conns:
+			defer conn.Close()
+		case err := <-errs:
+			t.Fatalf("Dial: %v", err)
+		}
+	}
+
+	// The first UpgradeBurst connections are upgraded at once
+	want := time.Duration(burst-service.UpgradeBurst) * time.Second / 20
+	if elapsed := time.Since(start); elapsed < want-50*time.Millisecond {
+		t.Fatalf("burst upgraded in %v, want at least %v", elapsed, want)
+	}
+
+	// Connections that would wait too long are rejected
+	service.MaxUpgradeRate = 1
+	service.UpgradeBurst = 1
+	service.MaxUpgradeWait = 10 * time.Millisecond
+	service.upgrades = upgradeLimiter{}
+
+	statuses := make([]int, 2)
+	for i := range statuses {
+		req, err := http.NewRequest("GET", "http://localhost:21000/testservice69", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+		statuses[i] = w.Code
+	}
+	if statuses[0] == 503 || statuses[1] != 503 {
+		t.Fatalf("statuses=%v, want a 503 for the second request only", statuses)
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestEnforceCodec(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.ChannelOptions["testservice70"] = ChannelOptions{EnforceCodec: "json"}
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice70")
+	client2 := createClient(t, "ws://localhost:21000/testservice70")
+
+	getClientId(client1)
+	getClientId(client2)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:21000/testservice70", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Data that is not JSON is rejected with an error
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"broadcast","data":"not json"}`))
+	for {
+		var message WireMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		if message.Action == "error" {
+			if message.Payload != "invalid_payload" {
+				t.Fatalf("error=%s, want %s", message.Payload, "invalid_payload")
+			}
+			break
+		}
+	}
+
+	// JSON data is relayed
+	client1.SendBroadcastData(`{"text":"hello"}`)
+	if broadcast := <-client2.Broadcast; broadcast.Payload != `{"text":"hello"}` {
+		t.Fatalf("broadcast=%s, want %s", broadcast.Payload, `{"text":"hello"}`)
+	}
+
+	client1.Stop()
+	client2.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSkipOwnAdvertisement(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	channel := NewChannel(service, "testservice71")
+	channel.persistent = true
+
+	// An earlier advertisement of the channel by this service (e.g. before
+	// it was recreated) at an address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	staleHash, _ := bcrypt.HashBytes([]byte("testservice71"))
+
+	browse := func(instance string) {
+		service.discoveryBrowser.query = func(params *mdns.QueryParam) error {
+			params.Entries <- &mdns.ServiceEntry{
+				AddrV4: net.ParseIP("127.0.0.1"),
+				Port:   closedPort,
+				Info:   fmt.Sprintf("hash=%s,path=/stale,host=localhost,instance=%s", base64.StdEncoding.EncodeToString([]byte(staleHash)), instance),
+			}
+			time.Sleep(params.Timeout)
+			return nil
+		}
+		service.discoveryBrowser.Browse(service, 1)
+	}
+
+	dialFailures := func() int {
+		channel.dialFailuresMu.Lock()
+		defer channel.dialFailuresMu.Unlock()
+		return len(channel.dialFailures)
+	}
+
+	// Own advertisements are not dialed
+	browse(service.instanceId)
+	if n := dialFailures(); n != 0 {
+		t.Fatalf("dialed own advertisement %d times, want 0", n)
+	}
+
+	// Advertisements by other service instances are
+	browse("otherinstance")
+	if n := dialFailures(); n != 1 {
+		t.Fatalf("dialed other advertisement %d times, want 1", n)
+	}
+
+	channel.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSubscribeChannel(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice72")
+	client2 := createClient(t, "ws://localhost:21000/testservice72")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	events, stop, err := service.SubscribeChannel("testservice72")
+	if err != nil {
+		t.Fatalf("SubscribeChannel: %v", err)
+	}
+
+	// The snapshot lists the current peers
+	snapshot := map[string]bool{}
+	for event := range events {
+		if event.Action == "snapshot" {
+			break
+		}
+		if event.Action != "connect" {
+			t.Fatalf("snapshot event=%+v, want a connect", event)
+		}
+		snapshot[event.Target] = true
+	}
+	if len(snapshot) != 2 || !snapshot[client1Id] || !snapshot[client2Id] {
+		t.Fatalf("snapshot=%v, want %s and %s", snapshot, client1Id, client2Id)
+	}
+
+	// Live events follow the snapshot
+	client3 := createClient(t, "ws://localhost:21000/testservice72")
+	client3Id := getClientId(client3)
+	if event := <-events; event.Action != "connect" || event.Target != client3Id {
+		t.Fatalf("event=%+v, want a connect of %s", event, client3Id)
+	}
+
+	client1.SendBroadcastData("hello")
+	if event := <-events; event.Action != "broadcast" || event.Source != client1Id || event.Payload != "hello" {
+		t.Fatalf("event=%+v, want a broadcast from %s", event, client1Id)
+	}
+
+	// Sampled broadcasts are published like other broadcasts
+	client1.SendSampleBroadcastData("sampled", 1, 0)
+	if event := <-events; event.Action != "broadcast" || event.Source != client1Id || event.Payload != "sampled" {
+		t.Fatalf("event=%+v, want a sampled broadcast from %s", event, client1Id)
+	}
+
+	client2.Stop()
+	if event := <-events; event.Action != "disconnect" || event.Target != client2Id {
+		t.Fatalf("event=%+v, want a disconnect of %s", event, client2Id)
+	}
+
+	// Stopping the subscription closes the stream
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatalf("events received after the subscription was stopped")
+	}
+
+	if _, _, err := service.SubscribeChannel("unknownservice"); err == nil {
+		t.Fatalf("SubscribeChannel: expected an error for an unknown channel")
+	}
+
+	client1.Stop()
+	client3.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMaxInflightDirectPerSource(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.MaxInflightDirectPerSource = 2
+
+	channel := newTestChannel(service, "testservice73")
+
+	// A target that blocks on each write, a chatty source and a well-behaved source
+	targetHandler := newSlowMessageHandler()
+	chattyHandler := newSlowMessageHandler()
+	chattyHandler.release = make(chan bool, 2)
+	chattyHandler.release <- true
+	chattyHandler.release <- true
+	politeHandler := newRecordingMessageHandler()
+	for id, handler := range map[string]MessageHandler{"target": targetHandler, "chatty": chattyHandler, "polite": politeHandler} {
+		channel.peers = append(channel.peers, &Peer{
+			id:        id,
+			transport: newWriteOnlyTransport(handler),
+			active:    true,
+			channel:   channel,
+		})
+	}
+
+	read := func(source string, message string) error {
+		for _, peer := range channel.peers {
+			if peer.id == source {
+				handler := &PeerMessageHandler{peer}
+				return handler.Read([]byte(message))
+			}
+		}
+		return nil
+	}
+	send := func(source string, payload string) error {
+		return read(source, fmt.Sprintf(`{"action":"message","target":"target","data":"%s"}`, payload))
+	}
+
+	// The chatty source is throttled once it has two messages in flight
+	for i := 0; i < 2; i++ {
+		if err := send("chatty", fmt.Sprintf("chatty%d", i)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if err := send("chatty", "chatty2"); err == nil {
+		t.Fatalf("send: expected the chatty source to be throttled")
+	}
+	if written := <-chattyHandler.written; !strings.Contains(written, "throttled") {
+		t.Fatalf("written=%s, want a throttled error", written)
+	}
+
+	// Echoes passed on to the target count against the same limit
+	if err := read("chatty", `{"action":"echo","target":"target"}`); err == nil {
+		t.Fatalf("echo: expected the chatty source to be throttled")
+	}
+	if written := <-chattyHandler.written; !strings.Contains(written, "throttled") {
+		t.Fatalf("written=%s, want a throttled error", written)
+	}
+
+	// The well-behaved source is unaffected
+	if err := send("polite", "polite0"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// The chatty source may send again once its messages are written
+	for _, payload := range []string{"chatty0", "chatty1", "polite0"} {
+		targetHandler.release <- true
+		if written := <-targetHandler.written; !strings.Contains(written, payload) {
+			t.Fatalf("written=%s, want %s", written, payload)
+		}
+	}
+	if err := send("chatty", "chatty3"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	targetHandler.release <- true
+	if written := <-targetHandler.written; !strings.Contains(written, "chatty3") {
+		t.Fatalf("written=%s, want %s", written, "chatty3")
+	}
+}
+
+func TestForwardRetries(t *testing.T) {
+
+	service1 := NewService("localhost", 21000)
+	service1.ForwardRetries = 2
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice74")
+	client2 := createClient(t, "ws://localhost:21001/testservice74")
+
+	client1Id := getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+
+	var link *Proxy
+	for _, proxy := range service1.GetChannelByName("testservice74").proxies {
+		if proxy.writeable {
+			link = proxy
+		}
+	}
+	if link == nil {
+		t.Fatal("No proxy connection from service2 found")
+	}
+
+	// Flap the link while broadcasts are being forwarded over it
+	expired, _ := json.Marshal(WireMessage{
+		Action:   "broadcast",
+		Source:   client1Id,
+		Payload:  "expired",
+		MaxAge:   1,
+		Deadline: time.Now().Add(time.Millisecond).UnixNano() / int64(time.Millisecond),
+	})
+	retried, _ := json.Marshal(WireMessage{
+		Action:  "broadcast",
+		Source:  client1Id,
+		Payload: "retried",
+	})
+
+	link.base.transport.writeMu.Lock()
+	link.base.transport.Write(expired)
+	link.base.transport.Write(retried)
+	link.base.transport.conn.Close()
+	link.base.transport.writeMu.Unlock()
+
+	// service2 dials service1 again once it rediscovers the channel
+	for i := 0; ; i++ {
+		select {
+		case broadcast := <-client2.Broadcast:
+			if broadcast.Payload != "retried" {
+				t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "retried")
+			}
+			if dropped := service1.DroppedLateBroadcasts(); dropped != 1 {
+				t.Fatalf("DroppedLateBroadcasts=%d, want %d", dropped, 1)
+			}
+
+			client1.Stop()
+			client2.Stop()
+
+			go func() {
+				service1.Stop()
+				service2.Stop()
+			}()
+
+			<-service1.StopNotify()
+			<-service2.StopNotify()
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if i == 10 {
+			t.Fatal("Broadcast was not forwarded again after the link came back")
+		}
+		service2.discoveryBrowser.Browse(service2, 1)
+	}
+}
+
+func TestStatsWindow(t *testing.T) {
+
+	var stats windowedStats
+	start := time.Unix(1000000, 0)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	// Two peers stay connected, a third one is connected for one second
+	stats.recordPeers(at(0), 2)
+	stats.recordPeers(at(30), 1)
+	stats.recordPeers(at(31), -1)
+
+	// 10 messages per second for a minute
+	for second := 0; second < 60; second++ {
+		for i := 0; i < 10; i++ {
+			stats.recordMessage(at(second).Add(time.Duration(i) * 10 * time.Millisecond))
+		}
+	}
+
+	check := func(now time.Time, window time.Duration, messages uint64, rate float64, peakPeers int) {
+		result := stats.aggregate(now, window)
+		if result.Messages != messages || result.MessagesPerSecond != rate || result.PeakPeers != peakPeers {
+			t.Fatalf("Stats(%v)=%+v, want %d messages at %v/s and %d peak peers", window, result, messages, rate, peakPeers)
+		}
+	}
+
+	check(at(59), time.Minute, 600, 10, 3)
+	check(at(59), 10*time.Second, 100, 10, 2)
+	check(at(89), time.Minute, 300, 5, 3)
+
+	// Buckets of seconds that left the window are reused
+	stats.recordMessage(at(statsBuckets + 59))
+	check(at(statsBuckets+59), time.Hour, 1, 1.0/3600, 2)
+	check(at(statsBuckets+59), 2*time.Hour, 1, 1.0/3600, 2)
+}
+
+func TestMulticastAddrs(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+
+	check := func(wantIPv4 string, wantIPv6 string) {
+		ipv4Addr, ipv6Addr := service.multicastAddrs()
+		if ipv4Addr.String() != wantIPv4 || ipv6Addr.String() != wantIPv6 {
+			t.Fatalf("addrs=%s %s, want %s %s", ipv4Addr, ipv6Addr, wantIPv4, wantIPv6)
+		}
+	}
+
+	check("224.0.0.251:5406", "[ff02::fb]:5406")
+
+	// A custom IPv4 group moves the IPv6 group too
+	service.MulticastAddress = "239.255.0.1"
+	check("239.255.0.1:5406", "[ff02::efff:1]:5406")
+
+	service.MulticastPort = 5407
+	check("239.255.0.1:5407", "[ff02::efff:1]:5407")
+
+	service.MulticastAddress = ""
+	check("224.0.0.251:5407", "[ff02::fb]:5407")
+}
+
+func TestMulticastGroups(t *testing.T) {
+
+	// service1 and service3 form a cluster apart from service2
+	service1 := NewService("localhost", 21000)
+	service1.MulticastAddress = "239.255.0.1"
+	service1.Start()
+
+	service2 := NewService("localhost", 21001)
+	service2.Start()
+
+	service3 := NewService("localhost", 21002)
+	service3.MulticastAddress = "239.255.0.1"
+	service3.Start()
+
+	client1 := createClient(t, "ws://localhost:21000/testservice75")
+	client2 := createClient(t, "ws://localhost:21001/testservice75")
+	client3 := createClient(t, "ws://localhost:21002/testservice75")
+
+	getClientId(client1)
+	getClientId(client2)
+	client3Id := getClientId(client3)
+
+	for i := 0; ; i++ {
+		select {
+		case connect := <-client1.Connect:
+			checkConnect(t, connect, client3Id)
+		case <-time.After(100 * time.Millisecond):
+			if i == 10 {
+				t.Fatal("service1 did not federate with service3")
+			}
+			service1.discoveryBrowser.Browse(service1, 1)
+			continue
+		}
+		break
+	}
+
+	service2.discoveryBrowser.Browse(service2, 1)
+	if links := service2.FederationLinks(); len(links) != 0 {
+		t.Fatalf("service2 has %d federation links, want 0", len(links))
+	}
+	select {
+	case connect := <-client2.Connect:
+		t.Fatalf("client2 was told about peer %s of another cluster", connect.Target)
+	default:
+	}
+
+	client1.Stop()
+	client2.Stop()
+	client3.Stop()
+
+	go func() {
+		service1.Stop()
+		service2.Stop()
+		service3.Stop()
+	}()
+
+	<-service1.StopNotify()
+	<-service2.StopNotify()
+	<-service3.StopNotify()
+}
+
+func TestMaxBroadcastFanoutSubtree(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.MaxBroadcastFanout = 20
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice86.room")
+	getClientId(sender)
+
+	subscribers := make([]*Client, 3)
+	for i := range subscribers {
+		subscribers[i] = createClient(t, "ws://localhost:21000/testservice86.*")
+		getClientId(subscribers[i])
+	}
+
+	// 3 subtree recipients of 7 bytes exceed the budget, 3 of 5 bytes do not
+	sender.SendBroadcastData("0123456")
+	sender.SendBroadcastData("01234")
+
+	if reply := <-sender.Error; reply.Payload != "fanout_too_large" {
+		t.Fatalf("error=%s, want %s", reply.Payload, "fanout_too_large")
+	}
+	for _, subscriber := range subscribers {
+		if broadcast := <-subscriber.Broadcast; broadcast.Payload != "01234" {
+			t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "01234")
+		}
+	}
+
+	sender.Stop()
+	for _, subscriber := range subscribers {
+		subscriber.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMaxBroadcastFanout(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.MaxBroadcastFanout = 100
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice76")
+	getClientId(sender)
+
+	receivers := make([]*Client, 9)
+	for i := range receivers {
+		receivers[i] = createClient(t, "ws://localhost:21000/testservice76")
+		getClientId(receivers[i])
+		<-sender.Connect
+	}
+
+	// 9 recipients of 12 bytes exceed the budget, 9 of 5 bytes do not
+	sender.SendBroadcastData("0123456789ab")
+	sender.SendBroadcastData("01234")
+
+	if reply := <-sender.Error; reply.Payload != "fanout_too_large" {
+		t.Fatalf("error=%s, want %s", reply.Payload, "fanout_too_large")
+	}
+	for _, receiver := range receivers {
+		if broadcast := <-receiver.Broadcast; broadcast.Payload != "01234" {
+			t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "01234")
+		}
+	}
+
+	// Sample broadcasts are checked like broadcasts
+	sender.SendSampleBroadcastData("0123456789ab", 1, 1)
+	if reply := <-sender.Error; reply.Payload != "fanout_too_large" {
+		t.Fatalf("error=%s, want %s", reply.Payload, "fanout_too_large")
+	}
+
+	sender.Stop()
+	for _, receiver := range receivers {
+		receiver.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestMaxChannelGoroutines(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.MaxChannelGoroutines = 8
+	service.BroadcastConcurrency = 4
+	service.Start()
+
+	goroutines := func() int {
+		for _, snapshot := range service.Snapshot() {
+			if snapshot.Name == "testservice77" {
+				return snapshot.Goroutines
+			}
+		}
+		return 0
+	}
+
+	client1 := createClient(t, "ws://localhost:21000/testservice77")
+	client2 := createClient(t, "ws://localhost:21000/testservice77")
+
+	getClientId(client1)
+	client2Id := getClientId(client2)
+
+	checkConnect(t, <-client1.Connect, client2Id)
+
+	// The dispatcher and channel stop watcher plus two pumps and a stop
+	// watcher per peer
+	if n := goroutines(); n != 8 {
+		t.Fatalf("Goroutines=%d, want %d", n, 8)
+	}
+
+	// The channel is at its limit
+	if conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:21000/testservice77", nil); err == nil {
+		conn.Close()
+		t.Fatal("Dial: expected the connection to be rejected")
+	}
+
+	client1.SendBroadcastData("inline")
+	if broadcast := <-client2.Broadcast; broadcast.Payload != "inline" {
+		t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "inline")
+	}
+
+	client2.Stop()
+	for i := 0; goroutines() != 5; i++ {
+		if i == 20 {
+			t.Fatalf("Goroutines=%d after a peer left, want %d", goroutines(), 5)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	client1.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestForcedDrainCloses(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.CloseGracePeriod = 200 * time.Millisecond
+	service.Start()
+
+	client := createClient(t, "ws://localhost:21000/testservice78")
+	clientId := getClientId(client)
+
+	// A client that never reads, so never answers the close frame
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:21000/testservice78", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	<-client.Connect
+
+	start := time.Now()
+	if err := service.DrainChannel("testservice78", "shutting down", 10*time.Millisecond); err != nil {
+		t.Fatalf("DrainChannel: %v", err)
+	}
+
+	for service.GetChannelByName("testservice78") != nil {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("channel still has peers %v after draining", service.GetChannelByName("testservice78").peers)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Only the uncooperative client was terminated
+	if elapsed := time.Since(start); elapsed < service.CloseGracePeriod {
+		t.Fatalf("drained in %v, before CloseGracePeriod %v", elapsed, service.CloseGracePeriod)
+	}
+	if forced := service.ForcedDrainCloses(); forced != 1 {
+		t.Fatalf("ForcedDrainCloses=%d, want %d (client %s closed cooperatively)", forced, 1, clientId)
+	}
+
+	// The stopped channel no longer rejects connections
+	client.Stop()
+	client = createClient(t, "ws://localhost:21000/testservice78")
+	client.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestSyntheticPeers(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.Start()
+
+	publisher := createClient(t, "ws://localhost:21000/testservice79")
+	getClientId(publisher)
+
+	consumers, err := service.SpawnSyntheticPeers("testservice79", 20, SyntheticPeerConfig{ConsumeRate: 1000})
+	if err != nil {
+		t.Fatalf("SpawnSyntheticPeers: %v", err)
+	}
+
+	// Synthetic peers are announced like other peers
+	for i := 0; i < 20; i++ {
+		<-publisher.Connect
+	}
+
+	for i := 0; i < 10; i++ {
+		publisher.SendBroadcastData(fmt.Sprintf("load %d", i))
+	}
+
+	for i := 0; consumers.Received() != 200; i++ {
+		if i == 40 {
+			t.Fatalf("Received=%d, want %d", consumers.Received(), 200)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Synthetic publishers reach real peers
+	publishers, err := service.SpawnSyntheticPeers("testservice79", 2, SyntheticPeerConfig{PublishRate: 50, Payload: "synthetic"})
+	if err != nil {
+		t.Fatalf("SpawnSyntheticPeers: %v", err)
+	}
+
+	if broadcast := <-publisher.Broadcast; broadcast.Payload != "synthetic" {
+		t.Fatalf("broadcast=%s, want %s", broadcast.Payload, "synthetic")
+	}
+	publishers.Stop()
+
+	stats := service.Stats(time.Minute)
+	if stats.PeakPeers != 23 {
+		t.Fatalf("PeakPeers=%d, want %d", stats.PeakPeers, 23)
+	}
+	if stats.Messages < 10+publishers.Published() {
+		t.Fatalf("Messages=%d, want at least %d", stats.Messages, 10+publishers.Published())
+	}
+
+	consumers.Stop()
+	if n := len(service.GetChannelByName("testservice79").peers); n != 1 {
+		t.Fatalf("%d peers after stopping synthetic peers, want %d", n, 1)
+	}
+
+	publisher.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestChannelMetrics(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.AdminUIEnabled = true
+	service.AdminToken = "secret"
+	service.MetricsTopChannels = 1
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice87")
+	getClientId(sender)
+	receivers := make([]*Client, 2)
+	for i := range receivers {
+		receivers[i] = createClient(t, "ws://localhost:21000/testservice87")
+		getClientId(receivers[i])
+		<-sender.Connect
+	}
+
+	other := createClient(t, "ws://localhost:21000/testservice88")
+	getClientId(other)
+
+	checkBroadcast(t, "hello", sender, receivers)
+	checkBroadcast(t, strings.Repeat("x", 300), sender, receivers)
+
+	metrics := func() []ChannelMetrics {
+		req, err := http.NewRequest("GET", "http://localhost:21000/admin/metrics", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		service.Handler.ServeLocalRequest(w, req)
+
+		var metrics []ChannelMetrics
+		if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		return metrics
+	}
+
+	// Only the channel with the most peers is reported on. Broadcasts are
+	// observed once written to every receiver, just after they arrive.
+	result := metrics()
+	for timeout := time.After(time.Second); len(result) == 1 && result[0].FanOutDuration.Count < 2; result = metrics() {
+		select {
+		case <-timeout:
+			t.Fatalf("metrics=%+v, want %d broadcasts observed", result, 2)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if len(result) != 1 || result[0].Name != "testservice87" {
+		t.Fatalf("metrics=%+v, want %s only", result, "testservice87")
+	}
+
+	fanOut, size := result[0].FanOutDuration, result[0].MessageSize
+	if fanOut.Count != 2 || fanOut.Sum <= 0 {
+		t.Fatalf("FanOutDuration=%+v, want %d observations", fanOut, 2)
+	}
+	// One payload of at most 64 bytes and one of 257 to 1024 bytes
+	if size.Count != 2 || size.Sum != 305 || size.Counts[0] != 1 || size.Counts[2] != 1 {
+		t.Fatalf("MessageSize=%+v, want 5 and 300 bytes observed", size)
+	}
+	if peers := result[0].Peers; len(peers) != channelMetricsSeconds || peers[len(peers)-1] != 3 {
+		t.Fatalf("Peers=%v, want %d seconds ending with %d", peers, channelMetricsSeconds, 3)
+	}
+
+	// Allowed channels are reported on regardless of their number of peers
+	service.MetricsChannels = []string{"testservice88"}
+	result = metrics()
+	if len(result) != 1 || result[0].Name != "testservice88" || result[0].FanOutDuration.Count != 0 {
+		t.Fatalf("metrics=%+v, want %s only without broadcasts", result, "testservice88")
+	}
+
+	sender.Stop()
+	for _, receiver := range receivers {
+		receiver.Stop()
+	}
+	other.Stop()
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
+
+func TestBroadcastWorkers(t *testing.T) {
+
+	service := NewService("localhost", 21000)
+	service.BroadcastConcurrency = 4
+	service.Start()
+
+	sender := createClient(t, "ws://localhost:21000/testservice89")
+	getClientId(sender)
+	receivers := make([]*Client, 6)
+	for i := range receivers {
+		receivers[i] = createClient(t, "ws://localhost:21000/testservice89")
+		getClientId(receivers[i])
+		<-sender.Connect
+	}
+
+	channel := service.GetChannelByName("testservice89")
+	before := channel.goroutineCount()
+
+	// Workers are started by the first broadcast and reused by later ones
+	for i := 0; i < 10; i++ {
+		checkBroadcast(t, fmt.Sprintf("broadcast %d", i), sender, receivers)
+		if n := channel.goroutineCount(); n != before+4 {
+			t.Fatalf("Goroutines=%d after %d broadcasts, want %d", n, i+1, before+4)
+		}
+	}
+
+	sender.Stop()
+	for _, receiver := range receivers {
+		receiver.Stop()
+	}
+
+	go service.Stop()
+
+	<-service.StopNotify()
+}
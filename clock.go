@@ -0,0 +1,92 @@
+package networkwebsockets
+
+// Vector clock stamped on broadcasts of channels with the VectorClocks
+// option, counting the broadcasts sent from or seen by each service's
+// instance of the channel
+type VectorClock map[string]uint64
+
+// Whether the broadcast stamped with this clock causally precedes the
+// broadcast stamped with the other clock
+func (clock VectorClock) HappenedBefore(other VectorClock) bool {
+	before := false
+	for id, count := range clock {
+		if count > other[id] {
+			return false
+		}
+		if count < other[id] {
+			before = true
+		}
+	}
+	for id, count := range other {
+		if _, ok := clock[id]; !ok && count > 0 {
+			before = true
+		}
+	}
+	return before
+}
+
+// Sort broadcasts stamped with vector clocks so that every broadcast comes
+// after all broadcasts that causally precede it. Otherwise the original
+// order is kept: each position takes the first remaining broadcast that no
+// other remaining broadcast causally precedes, so broadcasts that are
+// already in causal order are left as they are.
+func SortCausally(messages []WireMessage) {
+	// Number of remaining broadcasts causally preceding each broadcast
+	predecessors := make([]int, len(messages))
+	for i := range messages {
+		for j := range messages {
+			if i != j && messages[j].Clock.HappenedBefore(messages[i].Clock) {
+				predecessors[i]++
+			}
+		}
+	}
+
+	sorted := make([]WireMessage, 0, len(messages))
+	placed := make([]bool, len(messages))
+	for len(sorted) < len(messages) {
+		for i := range messages {
+			if placed[i] || predecessors[i] > 0 {
+				continue
+			}
+
+			placed[i] = true
+			sorted = append(sorted, messages[i])
+			for j := range messages {
+				if !placed[j] && messages[i].Clock.HappenedBefore(messages[j].Clock) {
+					predecessors[j]--
+				}
+			}
+			break
+		}
+	}
+
+	copy(messages, sorted)
+}
+
+// Count a broadcast sent from this service's instance of the channel and
+// return a copy of the channel's clock to stamp it with
+func (channel *Channel) tickClock() VectorClock {
+	channel.clockMu.Lock()
+	defer channel.clockMu.Unlock()
+
+	channel.clock[channel.clockId]++
+
+	stamp := make(VectorClock, len(channel.clock))
+	for id, count := range channel.clock {
+		stamp[id] = count
+	}
+	return stamp
+}
+
+// Merge the clock of a broadcast received from a remote service into the
+// channel's clock
+func (channel *Channel) witnessClock(stamp VectorClock) {
+	channel.clockMu.Lock()
+	defer channel.clockMu.Unlock()
+
+	for id, count := range stamp {
+		if count > channel.clock[id] {
+			channel.clock[id] = count
+		}
+	}
+}
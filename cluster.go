@@ -0,0 +1,182 @@
+package networkwebsockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Time allowed for federated services to respond to a cluster status request
+const clusterStatusTimeout = 2 * time.Second
+
+// Status of a single service as reported in a ClusterStatus
+type HostStatus struct {
+	// Network address ("<host>:<proxy port>") of the service, or the remote
+	// address of the proxy connection to it if it did not respond
+	Host string
+
+	// Whether the service responded to the status request before the timeout
+	Reachable bool
+
+	// The service's channels, empty if it is not reachable. Federated
+	// services only report the channel the status request was received on,
+	// since the names of their other channels are secret to their peers.
+	Channels []ChannelSnapshot
+}
+
+// Combined status of this service and all services federated with it
+type ClusterStatus struct {
+	// This service followed by each federated service
+	Hosts []HostStatus
+
+	// Ids of all channel peers connected to reachable services, without
+	// duplicates for peers reported by more than one service
+	Peers []string
+}
+
+// A federated service's response to a cluster status request
+type hostStatusResponse struct {
+	// Remote address of the proxy connection the response was received on
+	proxyHost string
+
+	status HostStatus
+}
+
+// Return the status of this service with the given channel snapshots
+func (service *Service) hostStatus(channels []ChannelSnapshot) HostStatus {
+	return HostStatus{
+		Host:      fmt.Sprintf("%s:%d", service.Host, service.ProxyPort),
+		Reachable: true,
+		Channels:  channels,
+	}
+}
+
+// Request the status of every service federated with this service over its
+// proxy connections and combine the statuses received before the timeout
+// elapses with the status of this service. Federated services that do not
+// respond in time are reported as unreachable.
+func (service *Service) ClusterStatus(timeout time.Duration) ClusterStatus {
+	correlation := service.generateId()
+
+	proxyHosts := make([]string, 0)
+	for _, channel := range service.channelList() {
+		for _, proxy := range channel.proxies {
+			proxyHosts = append(proxyHosts, proxy.host)
+		}
+	}
+
+	responses := make(chan hostStatusResponse, len(proxyHosts))
+
+	service.statusRequestsMu.Lock()
+	if service.statusRequests == nil {
+		service.statusRequests = make(map[string]chan hostStatusResponse)
+	}
+	service.statusRequests[correlation] = responses
+	service.statusRequestsMu.Unlock()
+
+	// Drop all responses received after the timeout
+	defer func() {
+		service.statusRequestsMu.Lock()
+		delete(service.statusRequests, correlation)
+		service.statusRequestsMu.Unlock()
+	}()
+
+	if wireData, err := encodeCorrelatedWireMessage("clusterstatus", "", "", "", correlation); err == nil {
+		for _, channel := range service.channelList() {
+			for _, proxy := range channel.proxies {
+				proxy.base.transport.Write(wireData)
+			}
+		}
+	}
+
+	collected := make([]hostStatusResponse, 0, cap(responses))
+	deadline := time.After(timeout)
+collect:
+	for len(collected) < cap(responses) {
+		select {
+		case response := <-responses:
+			collected = append(collected, response)
+		case <-deadline:
+			break collect
+		}
+	}
+
+	status := ClusterStatus{
+		Hosts: []HostStatus{service.hostStatus(service.Snapshot())},
+		Peers: make([]string, 0),
+	}
+
+	// A federated service may respond over more than one proxy connection
+	seenHosts := map[string]bool{status.Hosts[0].Host: true}
+	respondedProxyHosts := make(map[string]bool)
+	for _, response := range collected {
+		respondedProxyHosts[response.proxyHost] = true
+		if !seenHosts[response.status.Host] {
+			seenHosts[response.status.Host] = true
+			status.Hosts = append(status.Hosts, response.status)
+		}
+	}
+
+	for _, proxyHost := range proxyHosts {
+		if !respondedProxyHosts[proxyHost] && !seenHosts[proxyHost] {
+			seenHosts[proxyHost] = true
+			status.Hosts = append(status.Hosts, HostStatus{
+				Host:     proxyHost,
+				Channels: make([]ChannelSnapshot, 0),
+			})
+		}
+	}
+
+	seenPeers := make(map[string]bool)
+	for _, host := range status.Hosts {
+		for _, channel := range host.Channels {
+			for _, peer := range channel.Peers {
+				if !seenPeers[peer.Id] {
+					seenPeers[peer.Id] = true
+					status.Peers = append(status.Peers, peer.Id)
+				}
+			}
+		}
+	}
+	sort.Strings(status.Peers)
+
+	return status
+}
+
+// Respond to a cluster status request received over the given proxy
+// connection with the status of the proxy's channel only, or pass a response
+// to the ClusterStatus request it responds to if that request is still
+// collecting responses
+func (service *Service) handleStatusMessage(proxy *Proxy, message WireMessage) error {
+	if message.Payload == "" {
+		payload, err := json.Marshal(service.hostStatus([]ChannelSnapshot{proxy.base.channel.snapshot()}))
+		if err != nil {
+			return err
+		}
+
+		wireData, err := encodeCorrelatedWireMessage("clusterstatus", "", "", string(payload), message.Correlation)
+		if err != nil {
+			return err
+		}
+
+		return proxy.base.transport.Write(wireData)
+	}
+
+	var status HostStatus
+	if err := json.Unmarshal([]byte(message.Payload), &status); err != nil {
+		return err
+	}
+
+	service.statusRequestsMu.Lock()
+	defer service.statusRequestsMu.Unlock()
+
+	if responses, ok := service.statusRequests[message.Correlation]; ok {
+		select {
+		case responses <- hostStatusResponse{proxy.host, status}:
+		default:
+		}
+	}
+
+	return nil
+}
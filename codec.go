@@ -0,0 +1,35 @@
+package networkwebsockets
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Check that the application data of a message from a local peer is encoded
+// with the channel's EnforceCodec, if it has one. Messages without data
+// always conform.
+func (channel *Channel) checkCodec(message WireMessage) error {
+	if message.Payload == "" {
+		return nil
+	}
+
+	switch message.Action {
+	case "broadcast", "remotebroadcast", "sample", "message", "response":
+	default:
+		return nil
+	}
+
+	switch channel.options.EnforceCodec {
+	case "json":
+		if !json.Valid([]byte(message.Payload)) {
+			return fmt.Errorf("'%s' message data is not valid JSON", message.Action)
+		}
+	case "base64":
+		if _, err := base64.StdEncoding.DecodeString(message.Payload); err != nil {
+			return fmt.Errorf("'%s' message data is not valid base64: %v", message.Action, err)
+		}
+	}
+
+	return nil
+}
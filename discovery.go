@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/richtr/bcrypt"
@@ -30,6 +31,36 @@ var (
 	}
 )
 
+// Return the multicast addresses a service advertises and browses on
+func (service *Service) multicastAddrs() (*net.UDPAddr, *net.UDPAddr) {
+	if service.MulticastAddress == "" && service.MulticastPort == 0 {
+		return network_ipv4Addr, network_ipv6Addr
+	}
+
+	ipv4Addr := &net.UDPAddr{IP: network_ipv4Addr.IP, Port: mdnsPort}
+	ipv6Addr := &net.UDPAddr{IP: network_ipv6Addr.IP, Port: mdnsPort}
+	if service.MulticastAddress != "" {
+		ipv4Addr.IP = net.ParseIP(service.MulticastAddress)
+		ipv6Addr.IP = multicastGroupV6(ipv4Addr.IP)
+	}
+	if service.MulticastPort != 0 {
+		ipv4Addr.Port = service.MulticastPort
+		ipv6Addr.Port = service.MulticastPort
+	}
+
+	return ipv4Addr, ipv6Addr
+}
+
+// Return the link-local IPv6 multicast group (ff02::/16) ending in the
+// given IPv4 multicast group, so that services on different IPv4 groups are
+// kept apart on IPv6 too (e.g. 239.255.0.1 gives ff02::efff:1)
+func multicastGroupV6(group net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, net.ParseIP("ff02::"))
+	copy(ip[12:], group.To4())
+	return ip
+}
+
 /** Network Web Socket DNS-SD Discovery Client interface **/
 
 type DiscoveryService struct {
@@ -37,30 +68,47 @@ type DiscoveryService struct {
 	Hash string
 	Path string
 	Port int
+	Host string
+
+	// Instance id of the advertising service
+	Instance string
+
+	// Multicast addresses to advertise on, network_ipv4Addr and
+	// network_ipv6Addr if nil
+	ipv4Addr *net.UDPAddr
+	ipv6Addr *net.UDPAddr
+
+	// DNS-SD service instance name to register, a new id if empty
+	serviceId string
 
 	server *mdns.Server
 }
 
-func NewDiscoveryService(name, hash, path string, port int) *DiscoveryService {
+func NewDiscoveryService(name, hash, path string, port int, host string, instance string) *DiscoveryService {
 	discoveryService := &DiscoveryService{
-		Name: name,
-		Hash: hash,
-		Path: path,
-		Port: port,
+		Name:     name,
+		Hash:     hash,
+		Path:     path,
+		Port:     port,
+		Host:     host,
+		Instance: instance,
 	}
 
 	return discoveryService
 }
 
 func (dc *DiscoveryService) Register(domain string) {
-	dnssdServiceId := GenerateId()
+	dnssdServiceId := dc.serviceId
+	if dnssdServiceId == "" {
+		dnssdServiceId = GenerateId()
+	}
 
 	s := &mdns.MDNSService{
 		Instance: dnssdServiceId,
 		Service:  "_nws._tcp",
 		Domain:   domain,
 		Port:     dc.Port,
-		Info:     fmt.Sprintf("hash=%s,path=%s", dc.Hash, dc.Path),
+		Info:     fmt.Sprintf("hash=%s,path=%s,host=%s,instance=%s", dc.Hash, dc.Path, dc.Host, dc.Instance),
 	}
 
 	if err := s.Init(); err != nil {
@@ -75,6 +123,10 @@ func (dc *DiscoveryService) Register(domain string) {
 		IPv4Addr: network_ipv4Addr,
 		IPv6Addr: network_ipv6Addr,
 	}
+	if dc.ipv4Addr != nil && dc.ipv6Addr != nil {
+		mdnsClientConfig.IPv4Addr = dc.ipv4Addr
+		mdnsClientConfig.IPv6Addr = dc.ipv6Addr
+	}
 
 	// Add the DNS zone record to advertise
 	mdnsClientConfig.Zone = s
@@ -103,12 +155,20 @@ type DiscoveryBrowser struct {
 	// Network Web Socket DNS-SD records currently unresolved by this proxy instance
 	cachedDNSRecords map[string]*DNSRecord
 	closed           bool
+
+	// Runs mDNS/DNS-SD queries
+	query func(params *mdns.QueryParam) error
+
+	// Error of the most recent mDNS/DNS-SD query, nil if it succeeded
+	lastErr   error
+	lastErrMu sync.Mutex
 }
 
 func NewDiscoveryBrowser() *DiscoveryBrowser {
 	discoveryBrowser := &DiscoveryBrowser{
 		cachedDNSRecords: make(map[string]*DNSRecord, 255),
 		closed:           false,
+		query:            mdns.Query,
 	}
 
 	return discoveryBrowser
@@ -125,8 +185,7 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 	var targetIPv4 *net.UDPAddr
 	var targetIPv6 *net.UDPAddr
 
-	targetIPv4 = network_ipv4Addr
-	targetIPv6 = network_ipv6Addr
+	targetIPv4, targetIPv6 = service.multicastAddrs()
 
 	// Only look for Network Web Socket DNS-SD services
 	params := &mdns.QueryParam{
@@ -164,12 +223,13 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 
 				// Ignore previously discovered Channel proxy services
 				if service.isActiveProxyService(serviceRecord) {
+					service.refreshProxyService(serviceRecord)
 					continue
 				}
 
 				// Resolve discovered service hash provided against available services
 				var channel *Channel
-				for _, knownService := range service.Channels {
+				for _, knownService := range service.channelList() {
 					if bcrypt.Match(knownService.serviceName, serviceRecord.Hash_BCrypt) {
 						channel = knownService
 						break
@@ -177,6 +237,11 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 				}
 
 				if channel != nil {
+					// Ignore services that this channel must not federate with
+					if !channel.shouldProxy(serviceRecord) {
+						continue
+					}
+
 					// Create new web socket connection toward discovered proxy
 					if dErr := dialProxyFromDNSRecord(serviceRecord, channel); dErr != nil {
 						log.Printf("err: %v", dErr)
@@ -198,7 +263,11 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 	}()
 
 	// Run the mDNS/DNS-SD query
-	err := mdns.Query(params)
+	err := ds.query(params)
+
+	ds.lastErrMu.Lock()
+	ds.lastErr = err
+	ds.lastErrMu.Unlock()
 
 	if err != nil {
 		log.Printf("Could not perform mDNS/DNS-SD query. %v", err)
@@ -206,10 +275,107 @@ func (ds *DiscoveryBrowser) Browse(service *Service, timeoutSeconds int) {
 	}
 }
 
+// Return the error of the most recent mDNS/DNS-SD query, or nil if it succeeded
+func (ds *DiscoveryBrowser) Err() error {
+	ds.lastErrMu.Lock()
+	defer ds.lastErrMu.Unlock()
+
+	return ds.lastErr
+}
+
 func (ds *DiscoveryBrowser) Shutdown() {
 	ds.closed = true
 }
 
+/** Network Web Socket channel browsing interface **/
+
+// A Network Web Socket channel advertised on the local network. Channel
+// names are never advertised so a channel can only be identified by
+// checking it against a known name with Matches.
+type RemoteChannel struct {
+	// Host name of the advertising service (empty if not advertised)
+	Host string
+
+	Addr net.IP
+	Port int
+
+	Hash_Base64 string
+	hash_BCrypt string
+}
+
+// Check whether this remote channel is advertised for the given channel name
+func (rc *RemoteChannel) Matches(name string) bool {
+	return bcrypt.Match(name, rc.hash_BCrypt)
+}
+
+// Return all Network Web Socket channels advertised on the local network
+// within the given timeout, without joining any of them
+func BrowseChannels(timeout time.Duration) ([]RemoteChannel, error) {
+	return NewDiscoveryBrowser().browseChannels(network_ipv4Addr, network_ipv6Addr, timeout)
+}
+
+// Return all Network Web Socket channels advertised to the service's
+// multicast groups within the given timeout, without joining any of them
+func (service *Service) BrowseChannels(timeout time.Duration) ([]RemoteChannel, error) {
+	ipv4Addr, ipv6Addr := service.multicastAddrs()
+	return service.discoveryBrowser.browseChannels(ipv4Addr, ipv6Addr, timeout)
+}
+
+// Return all Network Web Socket channels advertised to the given multicast
+// groups within the given timeout
+func (ds *DiscoveryBrowser) browseChannels(ipv4Addr *net.UDPAddr, ipv6Addr *net.UDPAddr, timeout time.Duration) ([]RemoteChannel, error) {
+	entries := make(chan *mdns.ServiceEntry, 255)
+
+	// Only look for Network Web Socket DNS-SD services
+	params := &mdns.QueryParam{
+		Service:  "_nws._tcp",
+		Domain:   "local",
+		Timeout:  timeout,
+		Entries:  entries,
+		IPv4mdns: ipv4Addr,
+		IPv6mdns: ipv6Addr,
+	}
+
+	// Collect responses as they arrive until the query completes
+	collected := make(chan []RemoteChannel, 1)
+	go func() {
+		channels := make([]RemoteChannel, 0)
+		seen := make(map[string]bool)
+
+		for entry := range entries {
+			record, err := NewServiceRecordFromDNSRecord(entry)
+			if err != nil || seen[record.Hash_Base64] {
+				continue
+			}
+			seen[record.Hash_Base64] = true
+
+			addr := record.AddrV4
+			if addr == nil {
+				addr = record.AddrV6
+			}
+
+			channels = append(channels, RemoteChannel{
+				Host:        record.ServiceHost,
+				Addr:        addr,
+				Port:        record.Port,
+				Hash_Base64: record.Hash_Base64,
+				hash_BCrypt: record.Hash_BCrypt,
+			})
+		}
+
+		collected <- channels
+	}()
+
+	err := ds.query(params)
+	close(entries)
+	channels := <-collected
+
+	if err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
 /** Network Web Socket DNS Record interface **/
 
 type DNSRecord struct {
@@ -218,12 +384,20 @@ type DNSRecord struct {
 	Path        string
 	Hash_Base64 string
 	Hash_BCrypt string
+
+	// Host name of the advertising service (empty if not advertised)
+	ServiceHost string
+
+	// Instance id of the advertising service (empty if not advertised)
+	ServiceInstance string
 }
 
 func NewServiceRecordFromDNSRecord(serviceEntry *mdns.ServiceEntry) (*DNSRecord, error) {
 	servicePath := ""
 	serviceHash_Base64 := ""
 	serviceHash_BCrypt := ""
+	serviceHost := ""
+	serviceInstance := ""
 
 	if serviceEntry.Info == "" {
 		return nil, errors.New("Could not find associated TXT record for advertised Network Web Socket service")
@@ -233,7 +407,13 @@ func NewServiceRecordFromDNSRecord(serviceEntry *mdns.ServiceEntry) (*DNSRecord,
 		return r == '=' || r == ',' || r == ';' || r == ' '
 	})
 	if len(serviceParts) > 1 {
-		for i := 0; i < len(serviceParts); i += 2 {
+		for i := 0; i+1 < len(serviceParts); i += 2 {
+			if strings.ToLower(serviceParts[i]) == "host" {
+				serviceHost = serviceParts[i+1]
+			}
+			if strings.ToLower(serviceParts[i]) == "instance" {
+				serviceInstance = serviceParts[i+1]
+			}
 			if strings.ToLower(serviceParts[i]) == "path" {
 				servicePath = serviceParts[i+1]
 			}
@@ -252,7 +432,7 @@ func NewServiceRecordFromDNSRecord(serviceEntry *mdns.ServiceEntry) (*DNSRecord,
 	}
 
 	// Create and return a new Network Web Socket DNS Record with the parsed information
-	newServiceDNSRecord := &DNSRecord{serviceEntry, servicePath, serviceHash_Base64, serviceHash_BCrypt}
+	newServiceDNSRecord := &DNSRecord{serviceEntry, servicePath, serviceHash_Base64, serviceHash_BCrypt, serviceHost, serviceInstance}
 
 	return newServiceDNSRecord, nil
 }
@@ -0,0 +1,95 @@
+package networkwebsockets
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Application close code of peer connections closed when their channel is drained
+const drainedCloseCode = 4001
+
+// Drain the named channel: send all of its peer connections a 'drain'
+// message with the given reason and reject new connections to it with a
+// 503 error, on this service and on all federated services. Other channels
+// are not affected. If closeAfter is greater than 0, local peer connections
+// still open once it has elapsed are closed. The channel accepts
+// connections again once it has stopped.
+func (service *Service) DrainChannel(channelName string, reason string, closeAfter time.Duration) error {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	if !service.drain(channel, reason) {
+		return nil
+	}
+
+	// Drain the channel on federated services
+	if wireData, err := encodeWireMessage("drain", "", "", reason); err == nil {
+		channel.relayToProxies(nil, wireData)
+	}
+
+	if closeAfter > 0 {
+		forced := func() {
+			atomic.AddUint64(&service.forcedDrainCloses, 1)
+		}
+
+		time.AfterFunc(closeAfter, func() {
+			for _, peer := range channel.peerList() {
+				if err := peer.closeWithin(drainedCloseCode, reason, peer.closeGracePeriod(), forced); err != nil {
+					log.Printf("err: %v", err)
+				}
+			}
+		})
+	}
+
+	return nil
+}
+
+// Return the number of peer connections closed by DrainChannel that were
+// forcibly terminated for not completing the closing handshake within the
+// service's CloseGracePeriod
+func (service *Service) ForcedDrainCloses() uint64 {
+	return atomic.LoadUint64(&service.forcedDrainCloses)
+}
+
+// Whether new connections to the named channel are rejected because it has
+// been drained
+func (service *Service) isDraining(channelName string) bool {
+	service.drainingMu.Lock()
+	defer service.drainingMu.Unlock()
+
+	return service.draining[channelName]
+}
+
+// Accept new connections to the named channel again once the drained
+// channel has stopped, so a later channel of the same name starts afresh
+func (service *Service) undrain(channelName string) {
+	service.drainingMu.Lock()
+	defer service.drainingMu.Unlock()
+
+	delete(service.draining, channelName)
+}
+
+// Stop accepting new connections to a channel and send all of its local peer
+// connections a 'drain' message. Returns false if the channel is already
+// draining.
+func (service *Service) drain(channel *Channel, reason string) bool {
+	service.drainingMu.Lock()
+	if service.draining[channel.serviceName] {
+		service.drainingMu.Unlock()
+		return false
+	}
+	service.draining[channel.serviceName] = true
+	service.drainingMu.Unlock()
+
+	for _, peer := range channel.peerList() {
+		if wireData, err := encodeWireMessage("drain", peer.id, peer.id, reason); err == nil {
+			peer.transport.Write(wireData)
+		}
+	}
+
+	return true
+}
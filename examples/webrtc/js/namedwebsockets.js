@@ -131,7 +131,7 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 				// Create and fire events:
 				//   - 'close' on p2p websocket object
 				//   - 'disconnect' on root websocket object
-				peerWebSocket.__doClose(3000, "Closed", networkWebSocket);
+				peerWebSocket.__doClose(json.code || 3000, json.data || "Closed", networkWebSocket);
 
 				// Remove p2p websocket from root network web socket peers list
 				for (var i = 0; i < networkWebSocket.peers.length; i++) {
@@ -0,0 +1,349 @@
+package networkwebsockets
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Maximum length and number of tokens (operators, fields and literals) of a
+// channel's DeliveryFilter. Filters have no loops, so this bounds the time
+// spent evaluating a filter to a few string operations on the broadcast's
+// fields per token.
+const (
+	maxFilterLength = 1024
+	maxFilterTokens = 64
+)
+
+// Compiled DeliveryFilter of a channel, deciding whether a broadcast is
+// delivered to a local peer
+type deliveryFilter func(peer *Peer, message *WireMessage) bool
+
+// The peer and broadcast fields that filters can refer to
+var (
+	filterStringFields = map[string]func(peer *Peer, message *WireMessage) string{
+		"peer.id":          func(peer *Peer, message *WireMessage) string { return peer.id },
+		"peer.shard":       func(peer *Peer, message *WireMessage) string { return peer.shard },
+		"peer.subprotocol": func(peer *Peer, message *WireMessage) string { return peer.subprotocol },
+		"peer.instance":    func(peer *Peer, message *WireMessage) string { return peer.instance },
+		"msg.source":       func(peer *Peer, message *WireMessage) string { return message.Source },
+		"msg.data":         func(peer *Peer, message *WireMessage) string { return message.Payload },
+		"msg.shard":        func(peer *Peer, message *WireMessage) string { return message.Shard },
+		"msg.coalesce":     func(peer *Peer, message *WireMessage) string { return message.CoalesceKey },
+	}
+
+	filterListFields = map[string]func(peer *Peer, message *WireMessage) []string{
+		"peer.tags": func(peer *Peer, message *WireMessage) []string { return peer.tags },
+	}
+
+	filterMethods = map[string]func(s, arg string) bool{
+		"startsWith": strings.HasPrefix,
+		"endsWith":   strings.HasSuffix,
+		"contains":   strings.Contains,
+	}
+)
+
+// Compile a delivery filter expression, e.g.
+//
+//	"display" in peer.tags && msg.data.startsWith("ui.")
+//
+// Expressions combine string literals, the fields in filterStringFields and
+// filterListFields, ==, !=, in (list membership), the string methods in
+// filterMethods, !, &&, || and parentheses, and must evaluate to a boolean.
+func compileDeliveryFilter(expression string) (deliveryFilter, error) {
+	if len(expression) > maxFilterLength {
+		return nil, fmt.Errorf("Delivery filter is longer than %d characters", maxFilterLength)
+	}
+
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid delivery filter '%s': %v", expression, err)
+	}
+
+	parser := &filterParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err == nil && parser.pos < len(parser.tokens) {
+		err = fmt.Errorf("unexpected '%s'", parser.tokens[parser.pos])
+	}
+	if err == nil && node.boolean == nil {
+		err = errors.New("expression is not a boolean")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid delivery filter '%s': %v", expression, err)
+	}
+
+	return node.boolean, nil
+}
+
+// Split a filter expression into string literals (kept quoted), names
+// (e.g. "peer.tags") and operators
+func tokenizeFilter(expression string) ([]string, error) {
+	tokens := make([]string, 0)
+
+	for i := 0; i < len(expression); {
+		c := rune(expression[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, expression[i:end+1])
+			i = end + 1
+		case c == '_' || unicode.IsLetter(c):
+			end := i
+			for end < len(expression) && (expression[end] == '_' || expression[end] == '.' || unicode.IsLetter(rune(expression[end])) || unicode.IsDigit(rune(expression[end]))) {
+				end++
+			}
+			tokens = append(tokens, expression[i:end])
+			i = end
+		case strings.HasPrefix(expression[i:], "==") || strings.HasPrefix(expression[i:], "!=") ||
+			strings.HasPrefix(expression[i:], "&&") || strings.HasPrefix(expression[i:], "||"):
+			tokens = append(tokens, expression[i:i+2])
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected '%c'", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+// A compiled (sub)expression of a filter. Exactly one of its functions is
+// set, according to the expression's type.
+type filterNode struct {
+	str     func(peer *Peer, message *WireMessage) string
+	list    func(peer *Peer, message *WireMessage) []string
+	boolean deliveryFilter
+}
+
+// Recursive descent parser of filter expressions
+type filterParser struct {
+	tokens []string
+	pos    int
+	read   int
+}
+
+func (parser *filterParser) peek() string {
+	if parser.pos < len(parser.tokens) {
+		return parser.tokens[parser.pos]
+	}
+	return ""
+}
+
+func (parser *filterParser) next() (string, error) {
+	if parser.pos >= len(parser.tokens) {
+		return "", errors.New("unexpected end of expression")
+	}
+
+	parser.read++
+	if parser.read > maxFilterTokens {
+		return "", fmt.Errorf("expression has more than %d tokens", maxFilterTokens)
+	}
+
+	token := parser.tokens[parser.pos]
+	parser.pos++
+	return token, nil
+}
+
+// or := and ("||" and)*
+func (parser *filterParser) parseOr() (*filterNode, error) {
+	left, err := parser.parseAnd()
+	for err == nil && parser.peek() == "||" {
+		parser.next()
+
+		var right *filterNode
+		if right, err = parser.parseAnd(); err == nil {
+			if left.boolean == nil || right.boolean == nil {
+				return nil, errors.New("|| requires boolean operands")
+			}
+			l, r := left.boolean, right.boolean
+			left = &filterNode{boolean: func(peer *Peer, message *WireMessage) bool {
+				return l(peer, message) || r(peer, message)
+			}}
+		}
+	}
+	return left, err
+}
+
+// and := unary ("&&" unary)*
+func (parser *filterParser) parseAnd() (*filterNode, error) {
+	left, err := parser.parseUnary()
+	for err == nil && parser.peek() == "&&" {
+		parser.next()
+
+		var right *filterNode
+		if right, err = parser.parseUnary(); err == nil {
+			if left.boolean == nil || right.boolean == nil {
+				return nil, errors.New("&& requires boolean operands")
+			}
+			l, r := left.boolean, right.boolean
+			left = &filterNode{boolean: func(peer *Peer, message *WireMessage) bool {
+				return l(peer, message) && r(peer, message)
+			}}
+		}
+	}
+	return left, err
+}
+
+// unary := "!" unary | comparison
+func (parser *filterParser) parseUnary() (*filterNode, error) {
+	if parser.peek() != "!" {
+		return parser.parseComparison()
+	}
+	parser.next()
+
+	operand, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if operand.boolean == nil {
+		return nil, errors.New("! requires a boolean operand")
+	}
+	f := operand.boolean
+	return &filterNode{boolean: func(peer *Peer, message *WireMessage) bool {
+		return !f(peer, message)
+	}}, nil
+}
+
+// comparison := value (("==" | "!=" | "in") value)?
+func (parser *filterParser) parseComparison() (*filterNode, error) {
+	left, err := parser.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	operator := parser.peek()
+	if operator != "==" && operator != "!=" && operator != "in" {
+		return left, nil
+	}
+	parser.next()
+
+	right, err := parser.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case operator == "in" && left.str != nil && right.list != nil:
+		s, list := left.str, right.list
+		return &filterNode{boolean: func(peer *Peer, message *WireMessage) bool {
+			value := s(peer, message)
+			for _, item := range list(peer, message) {
+				if item == value {
+					return true
+				}
+			}
+			return false
+		}}, nil
+	case operator != "in" && left.str != nil && right.str != nil:
+		l, r, equal := left.str, right.str, operator == "=="
+		return &filterNode{boolean: func(peer *Peer, message *WireMessage) bool {
+			return (l(peer, message) == r(peer, message)) == equal
+		}}, nil
+	case operator != "in" && left.boolean != nil && right.boolean != nil:
+		l, r, equal := left.boolean, right.boolean, operator == "=="
+		return &filterNode{boolean: func(peer *Peer, message *WireMessage) bool {
+			return (l(peer, message) == r(peer, message)) == equal
+		}}, nil
+	case operator == "in":
+		return nil, errors.New("in requires a string and a list")
+	default:
+		return nil, fmt.Errorf("%s requires operands of the same type", operator)
+	}
+}
+
+// value := string | "true" | "false" | field | field "." method "(" or ")" | "(" or ")"
+func (parser *filterParser) parseValue() (*filterNode, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case token == "(":
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing, err := parser.next(); err != nil || closing != ")" {
+			return nil, errors.New("missing ')'")
+		}
+		return node, nil
+
+	case strings.HasPrefix(token, "\""):
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", token)
+		}
+		return &filterNode{str: func(peer *Peer, message *WireMessage) string { return value }}, nil
+
+	case token == "true" || token == "false":
+		value := token == "true"
+		return &filterNode{boolean: func(peer *Peer, message *WireMessage) bool { return value }}, nil
+	}
+
+	if field, ok := filterStringFields[token]; ok {
+		return &filterNode{str: field}, nil
+	}
+	if field, ok := filterListFields[token]; ok {
+		return &filterNode{list: field}, nil
+	}
+
+	// A string method call, e.g. msg.data.startsWith("ui.")
+	if dot := strings.LastIndex(token, "."); dot >= 0 && parser.peek() == "(" {
+		field, fieldOk := filterStringFields[token[:dot]]
+		method, methodOk := filterMethods[token[dot+1:]]
+		if !fieldOk || !methodOk {
+			return nil, fmt.Errorf("unknown method %s", token)
+		}
+		parser.next()
+
+		arg, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if arg.str == nil {
+			return nil, fmt.Errorf("%s requires a string argument", token)
+		}
+		if closing, err := parser.next(); err != nil || closing != ")" {
+			return nil, errors.New("missing ')'")
+		}
+
+		argument := arg.str
+		return &filterNode{boolean: func(peer *Peer, message *WireMessage) bool {
+			return method(field(peer, message), argument(peer, message))
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field '%s'", token)
+}
+
+// Return the given local peer connections that a broadcast passes the
+// channel's DeliveryFilter for
+func (channel *Channel) filterRecipients(broadcast *WireMessage, peers []*Peer) []*Peer {
+	if channel.filter == nil {
+		return peers
+	}
+
+	recipients := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		if channel.filter(peer, broadcast) {
+			recipients = append(recipients, peer)
+		}
+	}
+	return recipients
+}
@@ -0,0 +1,73 @@
+package networkwebsockets
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Keep a message that could not be written to this proxy connection (e.g.
+// because the link went down mid-write) so it is forwarded again once a new
+// connection to the same remote service comes up, unless it has already
+// failed ForwardRetries times. Messages are only kept for remote services
+// that identified their instance, as replayForwards could never match them
+// to a new connection otherwise.
+func (proxy *Proxy) retainForward(message *queuedMessage) {
+	if proxy.instance == "" {
+		return
+	}
+
+	channel := proxy.base.channel
+
+	if message.attempts >= channel.service.ForwardRetries {
+		log.Printf("Dropped message after %d failed forwarding attempts (%d bytes)", message.attempts+1, len(message.buf))
+		return
+	}
+
+	channel.pendingForwardsMu.Lock()
+	defer channel.pendingForwardsMu.Unlock()
+
+	pending := channel.pendingForwards[proxy.instance]
+	if len(pending) >= sendQueueSize {
+		log.Printf("Dropped message pending forwarding to %s (%d bytes)", proxy.instance, len(message.buf))
+		return
+	}
+
+	channel.pendingForwards[proxy.instance] = append(pending, &queuedMessage{
+		buf:         message.buf,
+		coalesceKey: message.coalesceKey,
+		queuedAt:    message.queuedAt,
+		deadline:    message.deadline,
+		attempts:    message.attempts + 1,
+	})
+}
+
+// Queue the messages that failed to be forwarded to the remote service of
+// this proxy connection over an earlier connection, dropping broadcasts
+// whose deadline has passed in the meantime
+func (proxy *Proxy) replayForwards() {
+	if proxy.instance == "" {
+		return
+	}
+
+	channel := proxy.base.channel
+
+	channel.pendingForwardsMu.Lock()
+	pending := channel.pendingForwards[proxy.instance]
+	delete(channel.pendingForwards, proxy.instance)
+	channel.pendingForwardsMu.Unlock()
+
+	now := time.Now()
+	for _, message := range pending {
+		var wireMessage WireMessage
+		if err := json.Unmarshal(message.buf, &wireMessage); err == nil && wireMessage.Deadline > 0 && now.After(time.Unix(0, wireMessage.Deadline*int64(time.Millisecond))) {
+			atomic.AddUint64(&channel.service.lateBroadcastDrops, 1)
+			continue
+		}
+
+		if err := proxy.base.transport.enqueue(message); err != nil {
+			log.Printf("err: %v", err)
+		}
+	}
+}
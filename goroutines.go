@@ -0,0 +1,49 @@
+package networkwebsockets
+
+import (
+	"sync/atomic"
+)
+
+// Run f in a new goroutine counted against this channel's goroutines
+func (channel *Channel) spawn(f func()) {
+	atomic.AddInt64(&channel.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&channel.goroutines, -1)
+		f()
+	}()
+}
+
+// Return the number of running goroutines attributed to this channel: its
+// dispatcher and shared writer, the read and write pumps of its peer and
+// proxy connections and the workers writing its broadcasts
+func (channel *Channel) goroutineCount() int {
+	return int(atomic.LoadInt64(&channel.goroutines))
+}
+
+// Return the number of goroutines this channel may start before reaching
+// the service's MaxChannelGoroutines, or -1 if there is no limit
+func (channel *Channel) goroutineBudget() int {
+	if channel.service == nil || channel.service.MaxChannelGoroutines <= 0 {
+		return -1
+	}
+
+	if budget := channel.service.MaxChannelGoroutines - channel.goroutineCount(); budget > 0 {
+		return budget
+	}
+	return 0
+}
+
+// Run a pump of this transport in a new goroutine, counted in the
+// transport's goroutines counter if it has one
+func (t *Transport) spawn(pump func()) {
+	if t.goroutines == nil {
+		go pump()
+		return
+	}
+
+	atomic.AddInt64(t.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(t.goroutines, -1)
+		pump()
+	}()
+}
@@ -81,7 +81,7 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 	};
 
 	// Incoming Network Web Socket message dispatcher
-	webSocket.onmessage = function(event) {
+	function onMessage(event) {
 		var json = toJson(event.data);
 
 		if (!json) {
@@ -131,7 +131,7 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 				// Create and fire events:
 				//   - 'close' on p2p websocket object
 				//   - 'disconnect' on root websocket object
-				peerWebSocket.__doClose(3000, "Closed", networkWebSocket);
+				peerWebSocket.__doClose(json.code || 3000, json.data || "Closed", networkWebSocket);
 
 				// Remove p2p websocket from root network web socket peers list
 				for (var i = 0; i < networkWebSocket.peers.length; i++) {
@@ -184,21 +184,61 @@ var _NetworkWebSocket = function (channelName, subprotocols) {
 
 				break;
 
-		}
-	};
+			case "migrate":
+				// move to another channel, keeping our peer id
 
-	webSocket.onclose = function(event) {
+				migrate(json.data, json.correlation);
 
-		// Close all peer connections
+				break;
+
+		}
+	}
+
+	function closePeers() {
 		for (var target in networkWebSocket.peers) {
 			networkWebSocket.peers[target].__doClose(3000, "Closed", networkWebSocket);
 		}
 		networkWebSocket.peers = [];
+	}
+
+	function onClose(event) {
+
+		// Close all peer connections
+		closePeers();
 
 		// Close root connection
 		networkWebSocket.__doClose(3000, "Closed")
 
-	};
+	}
+
+	// Connect to the new channel of a migrate message, presenting its token
+	// to keep our peer id, then close the connection to the current channel.
+	// We stay connected to the current channel if the new connection fails.
+	function migrate(newChannelName, token) {
+		if (!isValidServiceName(newChannelName)) {
+			return;
+		}
+
+		var previousWebSocket = webSocket;
+		var newWebSocket = new WebSocket(endpointUrlBase + newChannelName + "?migrate=" + encodeURIComponent(token || ""), subprotocols);
+
+		newWebSocket.onopen = function(event) {
+			previousWebSocket.onmessage = null;
+			previousWebSocket.onclose = null;
+			previousWebSocket.close();
+
+			// Peers of the current channel are replaced by those of the new channel
+			closePeers();
+
+			webSocket = newWebSocket;
+			networkWebSocket.socket = newWebSocket;
+			webSocket.onmessage = onMessage;
+			webSocket.onclose = onClose;
+		};
+	}
+
+	webSocket.onmessage = onMessage;
+	webSocket.onclose = onClose;
 
 	return networkWebSocket;
 
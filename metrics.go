@@ -0,0 +1,153 @@
+package networkwebsockets
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of one second buckets of peer counts kept per channel, see
+// ChannelMetrics.Peers
+const channelMetricsSeconds = 60
+
+// Number of channels Service.ChannelMetrics reports on if the service sets
+// neither MetricsChannels nor MetricsTopChannels
+const defaultMetricsTopChannels = 20
+
+// Upper bounds of the fan-out duration histogram buckets, in seconds
+var fanOutDurationBounds = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// Upper bounds of the message size histogram buckets, in bytes
+var messageSizeBounds = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// Distribution of observed values over buckets with fixed upper bounds
+type Histogram struct {
+	// Inclusive upper bounds of the buckets, in ascending order
+	Bounds []float64
+
+	// Number of values observed in each bucket, with one more entry than
+	// Bounds counting the values above the last bound
+	Counts []uint64
+
+	// Number and sum of all values observed
+	Count uint64
+	Sum   float64
+}
+
+// Histogram safe for concurrent observations
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+	mu     sync.Mutex
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Count a value in the bucket with the lowest bound it doesn't exceed
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[sort.SearchFloat64s(h.bounds, value)]++
+	h.count++
+	h.sum += value
+}
+
+// Return a copy of the histogram's current counts
+func (h *histogram) snapshot() Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	return Histogram{Bounds: h.bounds, Counts: counts, Count: h.count, Sum: h.sum}
+}
+
+// Distributions of a channel's broadcasts and its peer count over time, see
+// Service.ChannelMetrics
+type ChannelMetrics struct {
+	Name string
+
+	// Time taken to write each broadcast to the channel's local peers, in
+	// seconds
+	FanOutDuration Histogram
+
+	// Payload size of each broadcast to the channel, in bytes
+	MessageSize Histogram
+
+	// Peak number of local peers in each of the last channelMetricsSeconds
+	// seconds, oldest first
+	Peers []int
+}
+
+// Histograms and peer counts collected for a channel
+type channelMetrics struct {
+	fanOutDuration *histogram
+	messageSize    *histogram
+	peers          windowedStats
+}
+
+func newChannelMetrics() *channelMetrics {
+	return &channelMetrics{
+		fanOutDuration: newHistogram(fanOutDurationBounds),
+		messageSize:    newHistogram(messageSizeBounds),
+		peers:          windowedStats{length: channelMetricsSeconds},
+	}
+}
+
+// Count a broadcast of a payload that took fanOut to write to local peers
+func (metrics *channelMetrics) recordBroadcast(payload string, fanOut time.Duration) {
+	metrics.messageSize.observe(float64(len(payload)))
+	metrics.fanOutDuration.observe(fanOut.Seconds())
+}
+
+// Return the metrics of the channels named in the service's MetricsChannels
+// or, if it has none, of the MetricsTopChannels channels with the most
+// peers, so that the number of channels reported on stays bounded however
+// many channels the service has
+func (service *Service) ChannelMetrics() []ChannelMetrics {
+	channels := service.channelList()
+
+	if len(service.MetricsChannels) > 0 {
+		allowed := make(map[string]bool, len(service.MetricsChannels))
+		for _, name := range service.MetricsChannels {
+			allowed[name] = true
+		}
+		selected := make([]*Channel, 0, len(service.MetricsChannels))
+		for _, channel := range channels {
+			if allowed[channel.serviceName] {
+				selected = append(selected, channel)
+			}
+		}
+		channels = selected
+	} else {
+		top := service.MetricsTopChannels
+		if top <= 0 {
+			top = defaultMetricsTopChannels
+		}
+		peers := make(map[*Channel]int, len(channels))
+		for _, channel := range channels {
+			peers[channel] = len(channel.peers)
+		}
+		sort.SliceStable(channels, func(i, j int) bool { return peers[channels[i]] > peers[channels[j]] })
+		if len(channels) > top {
+			channels = channels[:top]
+		}
+	}
+
+	now := time.Now()
+	metrics := make([]ChannelMetrics, 0, len(channels))
+	for _, channel := range channels {
+		metrics = append(metrics, ChannelMetrics{
+			Name:           channel.serviceName,
+			FanOutDuration: channel.metrics.fanOutDuration.snapshot(),
+			MessageSize:    channel.metrics.messageSize.snapshot(),
+			Peers:          channel.metrics.peers.peakPeersSeries(now),
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,52 @@
+package networkwebsockets
+
+import (
+	"net/http"
+)
+
+// A registered HTTP middleware
+type middlewareEntry struct {
+	wrap func(http.Handler) http.Handler
+}
+
+// Use registers an HTTP middleware that wraps all local and proxy
+// endpoints of the service, e.g. for request logging or rate limiting.
+// Middleware runs before websocket connections are upgraded and can reject
+// a request by not calling the handler it wraps. Middleware registered
+// first runs first. It applies to all requests received after Use returns,
+// including on endpoints that are already being served. Call the returned
+// function to unregister the middleware.
+func (service *Service) Use(middleware func(http.Handler) http.Handler) func() {
+	entry := &middlewareEntry{middleware}
+
+	service.middlewareMu.Lock()
+	service.middleware = append(service.middleware, entry)
+	service.middlewareMu.Unlock()
+
+	return func() {
+		service.middlewareMu.Lock()
+		defer service.middlewareMu.Unlock()
+
+		for i, registered := range service.middleware {
+			if registered == entry {
+				service.middleware = append(service.middleware[:i:i], service.middleware[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Wrap a handler with the middleware registered when each request is received
+func (service *Service) withMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service.middlewareMu.Lock()
+		middleware := service.middleware
+		service.middlewareMu.Unlock()
+
+		wrapped := handler
+		for i := len(middleware) - 1; i >= 0; i-- {
+			wrapped = middleware[i].wrap(wrapped)
+		}
+		wrapped.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+package networkwebsockets
+
+import (
+	"sync/atomic"
+)
+
+// Observer receives a copy of every broadcast and direct message delivered
+// by a service, e.g. for recording. Observers are called from a single
+// goroutine, separate from message delivery, so a slow observer never
+// delays delivery. Messages are dropped instead when an observer falls
+// more than ObserverBufferSize messages behind.
+type Observer interface {
+	// Called with the channel name, action ("broadcast" or "message"),
+	// sending peer id, the ids of the local peers the message was delivered
+	// to and the message payload
+	OnMessage(channel string, action string, source string, targets []string, payload string)
+}
+
+// A message waiting to be passed to a service's Observer
+type observation struct {
+	channel string
+	action  string
+	source  string
+	targets []string
+	payload string
+}
+
+// Queue a delivered message for the service's Observer, if any, without blocking
+func (service *Service) observe(channel string, action string, source string, targets []string, payload string) {
+	if service == nil || service.observations == nil {
+		return
+	}
+
+	select {
+	case service.observations <- &observation{channel, action, source, targets, payload}:
+	default:
+		atomic.AddUint64(&service.droppedObservations, 1)
+	}
+}
+
+// Pass queued messages to the service's Observer until the service is stopped
+func (service *Service) runObserver(observations chan *observation, stop chan bool) {
+	for {
+		select {
+		case o := <-observations:
+			service.Observer.OnMessage(o.channel, o.action, o.source, o.targets, o.payload)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Return the number of messages not passed to the service's Observer because
+// it was too far behind
+func (service *Service) DroppedObservations() uint64 {
+	return atomic.LoadUint64(&service.droppedObservations)
+}
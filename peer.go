@@ -2,6 +2,10 @@ package networkwebsockets
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/richtr/websocket"
@@ -18,6 +22,43 @@ type Peer struct {
 	transport *Transport
 
 	active bool
+
+	// Websocket subprotocol negotiated with this peer, if any
+	subprotocol string
+
+	// Shard key this peer connected with, if any
+	shard string
+
+	// Labels this peer connected with, used to address it in admin operations
+	tags []string
+
+	// Stable id of the client instance this peer connected with, if any
+	instance string
+
+	// Whether this peer joined quietly (the "quiet" URL query parameter). Quiet
+	// peers receive broadcasts and presence but their own connect and
+	// disconnect events are not sent to other peers.
+	quiet bool
+
+	// Application close code and reason relayed to other peers on disconnect
+	closeCode   int
+	closeReason string
+
+	// Broadcasts held back until this peer acknowledges earlier broadcasts,
+	// if it advertised a credit window or is on a stop-and-wait channel
+	heldBroadcasts []*queuedMessage
+	creditWindow   int // 0 = no flow control
+	unacked        int
+	ackTimer       *time.Timer
+	ackMu          sync.Mutex
+
+	// Tap streaming copies of this peer's frames, if any (a *peerTap)
+	tapped atomic.Value
+
+	// Times of recent writes to this peer slower than the service's
+	// SlowWriteThreshold
+	slowWrites   []time.Time
+	slowWritesMu sync.Mutex
 }
 
 type PeerMessageHandler struct {
@@ -30,8 +71,30 @@ func (handler *PeerMessageHandler) Read(buf []byte) error {
 		return errors.New("PeerMessageHandler requires an attached Peer object")
 	}
 
+	peer.channel.trace("inbound from peer", peer.id, buf)
+	peer.tapFrame("inbound", buf)
+
+	if service := peer.channel.service; service != nil {
+		service.stats.recordMessage(time.Now())
+	}
+
 	message, err := decodeWireMessage(buf)
 	if err != nil {
+		peer.sendError("malformed_message")
+		return err
+	}
+
+	// Reject messages with fields this service does not know about
+	if service := peer.channel.service; service != nil && service.StrictMessageParsing {
+		if _, err := decodeStrictWireMessage(buf); err != nil {
+			peer.sendError("unknown_field")
+			return err
+		}
+	}
+
+	// Reject application data not encoded with the channel's codec
+	if err := peer.channel.checkCodec(message); err != nil {
+		peer.sendError("invalid_payload")
 		return err
 	}
 
@@ -42,6 +105,84 @@ func (handler *PeerMessageHandler) Read(buf []byte) error {
 		// 'connect' and 'disconnect' events are write-only so will not be handled here
 		return nil
 
+	case "ack":
+
+		// Acknowledge the oldest unacknowledged broadcast received
+		peer.ack()
+
+		return nil
+
+	case "credit":
+
+		// Advertise the number of broadcasts this peer can buffer
+		if message.Count < 1 {
+			return errors.New("Credit window must be at least 1")
+		}
+		peer.setCreditWindow(message.Count)
+
+		return nil
+
+	case "echo":
+
+		// Stamp the echo with the time it was received so the sender can
+		// measure its round trip time and clock skew, and return it to the
+		// sender or pass it on to its target peer
+		target := peer
+		if message.Target != "" && message.Target != peer.id {
+			target = nil
+			for _, _peer := range peer.channel.peers {
+				if _peer.id == message.Target {
+					target = _peer
+					break
+				}
+			}
+			if target == nil {
+				return peer.sendError("unknown_target")
+			}
+
+			// Echoes passed on to another peer are direct messages
+			if service := peer.channel.service; service != nil && service.CanSendDirect != nil {
+				if !service.CanSendDirect(peer.channel.serviceName, peer.id, target.id) {
+					peer.sendError("forbidden")
+					return errors.New("Echo to target is not allowed")
+				}
+			}
+		}
+
+		wireData, err := encodeEchoWireMessage(peer.id, target.id, message.ClientTime, time.Now().UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return err
+		}
+
+		if target == peer {
+			target.transport.Write(wireData)
+			return nil
+		}
+
+		done, ok := peer.channel.acquireDirect(peer.id)
+		if !ok {
+			peer.sendError("throttled")
+			return errors.New("Too many direct messages from source in flight")
+		}
+		if err := target.transport.writeTracked(wireData, done); err != nil {
+			done()
+			return err
+		}
+
+		return nil
+
+	case "response":
+
+		// Respond to a request sent via Service.ScatterGather
+		peer.channel.deliverResponse(WireMessage{
+			Action:      "response",
+			Source:      peer.id,
+			Payload:     message.Payload,
+			Correlation: message.Correlation,
+		})
+
+		return nil
+
 	case "status":
 
 		// Echo peer id back to callee
@@ -57,13 +198,92 @@ func (handler *PeerMessageHandler) Read(buf []byte) error {
 
 	case "broadcast":
 
+		received := time.Now()
+
+		if !peer.channel.allowFanout(peer, message, false) {
+			return peer.sendError("fanout_too_large")
+		}
+
+		if !peer.channel.allowBroadcast() {
+			return peer.sendError("rate_limited")
+		}
+
+		wsBroadcast := &WireMessage{
+			Action:      "broadcast",
+			Source:      peer.id,
+			Target:      "", // target all connections
+			Payload:     message.Payload,
+			CoalesceKey: message.CoalesceKey,
+			Shard:       message.Shard,
+			MaxAge:      message.MaxAge,
+			Deadline:    broadcastDeadline(received, message.MaxAge),
+			fromProxy:   false,
+		}
+		wsBroadcast.TraceParent = peer.channel.service.exportSpan("received", peer.channel.serviceName, peer.id, "", received)
+		peer.channel.broadcastBuffer <- wsBroadcast
+
+		return nil
+
+	case "remotebroadcast":
+
+		received := time.Now()
+
+		if !peer.channel.allowFanout(peer, message, true) {
+			return peer.sendError("fanout_too_large")
+		}
+
+		if !peer.channel.allowBroadcast() {
+			return peer.sendError("rate_limited")
+		}
+
+		// Broadcast to peers owned by remote proxies only
+		wsBroadcast := &WireMessage{
+			Action:      "broadcast",
+			Source:      peer.id,
+			Target:      "", // target all remote connections
+			Payload:     message.Payload,
+			CoalesceKey: message.CoalesceKey,
+			Shard:       message.Shard,
+			MaxAge:      message.MaxAge,
+			Deadline:    broadcastDeadline(received, message.MaxAge),
+			fromProxy:   false,
+			remoteOnly:  true,
+		}
+		wsBroadcast.TraceParent = peer.channel.service.exportSpan("received", peer.channel.serviceName, peer.id, "", received)
+		peer.channel.broadcastBuffer <- wsBroadcast
+
+		return nil
+
+	case "sample":
+
+		received := time.Now()
+
+		// Reject sample sizes that are not a count or a fraction (0-1)
+		if message.Count < 0 || !(message.Fraction >= 0 && message.Fraction <= 1) {
+			return peer.sendError("invalid_sample")
+		}
+
+		if !peer.channel.allowFanout(peer, message, false) {
+			return peer.sendError("fanout_too_large")
+		}
+
+		if !peer.channel.allowBroadcast() {
+			return peer.sendError("rate_limited")
+		}
+
+		// Broadcast to a random sample of local and remote channel peers
 		wsBroadcast := &WireMessage{
-			Action:    "broadcast",
-			Source:    peer.id,
-			Target:    "", // target all connections
-			Payload:   message.Payload,
-			fromProxy: false,
+			Action:   "sample",
+			Source:   peer.id,
+			Payload:  message.Payload,
+			Shard:    message.Shard,
+			Fraction: message.Fraction,
+			Count:    message.Count,
+			Seed:     message.Seed,
+			MaxAge:   message.MaxAge,
+			Deadline: broadcastDeadline(received, message.MaxAge),
 		}
+		wsBroadcast.TraceParent = peer.channel.service.exportSpan("received", peer.channel.serviceName, peer.id, "", received)
 		peer.channel.broadcastBuffer <- wsBroadcast
 
 		return nil
@@ -74,6 +294,18 @@ func (handler *PeerMessageHandler) Read(buf []byte) error {
 			return errors.New("Message must have a target identifier")
 		}
 
+		if service := peer.channel.service; service != nil && service.MaxMessagePayloadSize > 0 && len(message.Payload) > service.MaxMessagePayloadSize {
+			peer.sendError("payload_too_large")
+			return errors.New("Message payload exceeds the maximum allowed size")
+		}
+
+		if service := peer.channel.service; service != nil && service.CanSendDirect != nil {
+			if !service.CanSendDirect(peer.channel.serviceName, peer.id, message.Target) {
+				peer.sendError("forbidden")
+				return errors.New("Message to target is not allowed")
+			}
+		}
+
 		wireData, err := encodeWireMessage("message", peer.id, message.Target, message.Payload)
 
 		if err != nil {
@@ -83,20 +315,37 @@ func (handler *PeerMessageHandler) Read(buf []byte) error {
 		// Relay message to peer channel that matches target
 		for _, _peer := range peer.channel.peers {
 			if _peer.id == message.Target {
-				_peer.transport.Write(wireData)
+				done, ok := peer.channel.acquireDirect(peer.id)
+				if !ok {
+					peer.sendError("throttled")
+					return errors.New("Too many direct messages from source in flight")
+				}
+				if err := _peer.transport.writeTracked(wireData, done); err != nil {
+					done()
+					return err
+				}
+				peer.channel.service.observe(peer.channel.serviceName, "message", peer.id, []string{_peer.id}, message.Payload)
 				return nil
 			}
 		}
 
-		// If we have not delivered the message yet then hunt for a
-		// proxy that owns target peer id in known proxies
-		for _, proxy := range peer.channel.proxies {
-			if proxy.peerIds[message.Target] {
-				proxy.base.transport.Write(wireData)
-				return nil
+		// If we have not delivered the message yet then forward it to the
+		// proxy that owns target peer id
+		if proxy := peer.channel.routeTo(message.Target, nil); proxy != nil {
+			done, ok := peer.channel.acquireDirect(peer.id)
+			if !ok {
+				peer.sendError("throttled")
+				return errors.New("Too many direct messages from source in flight")
+			}
+			if err := proxy.base.transport.writeTracked(wireData, done); err != nil {
+				done()
+				return err
 			}
+			return nil
 		}
 
+		peer.sendError("unknown_target")
+
 	}
 
 	return errors.New("Could not find target for message")
@@ -112,15 +361,75 @@ func (handler *PeerMessageHandler) Write(buf []byte) error {
 		return errors.New("Peer is not active")
 	}
 
-	peer.transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	peer.channel.trace("outbound to peer", peer.id, buf)
+	peer.tapFrame("outbound", buf)
+
+	started := time.Now()
+	peer.transport.conn.SetWriteDeadline(started.Add(writeWait))
 	peer.transport.conn.WriteMessage(websocket.TextMessage, buf)
+	peer.recordWrite(started, time.Since(started))
 
 	return nil
 }
 
+// Count a write to this peer that took longer than the service's
+// SlowWriteThreshold as a strike, and close the peer once it has
+// SlowWriteStrikes strikes within SlowWriteWindow
+func (peer *Peer) recordWrite(started time.Time, duration time.Duration) {
+	service := peer.channel.service
+	if service == nil || service.SlowWriteThreshold <= 0 || duration <= service.SlowWriteThreshold {
+		return
+	}
+
+	peer.slowWritesMu.Lock()
+	peer.slowWrites = append(peer.recentSlowWrites(started), started)
+	strikes := len(peer.slowWrites)
+	if service.SlowWriteStrikes > 0 && strikes >= service.SlowWriteStrikes {
+		peer.slowWrites = nil
+	}
+	peer.slowWritesMu.Unlock()
+
+	if service.SlowWriteStrikes > 0 && strikes >= service.SlowWriteStrikes {
+		log.Printf("Closing peer %s after %d slow writes", peer.id, strikes)
+		go peer.Close(slowConsumerCloseCode, "Slow consumer")
+	}
+}
+
+// Return the number of slow writes to this peer within the service's
+// SlowWriteWindow
+func (peer *Peer) writeStrikes(now time.Time) int {
+	peer.slowWritesMu.Lock()
+	defer peer.slowWritesMu.Unlock()
+
+	return len(peer.recentSlowWrites(now))
+}
+
+// Return the times of slow writes to this peer within the service's
+// SlowWriteWindow before now. Must be called with slowWritesMu held.
+func (peer *Peer) recentSlowWrites(now time.Time) []time.Time {
+	window := time.Duration(0)
+	if service := peer.channel.service; service != nil {
+		window = service.SlowWriteWindow
+	}
+
+	recent := make([]time.Time, 0, len(peer.slowWrites)+1)
+	for _, slowWrite := range peer.slowWrites {
+		if window <= 0 || now.Sub(slowWrite) <= window {
+			recent = append(recent, slowWrite)
+		}
+	}
+	return recent
+}
+
 func NewPeer(conn *websocket.Conn) *Peer {
+	return newPeer(conn, GenerateId())
+}
+
+// Create a peer connection with the given peer id
+func newPeer(conn *websocket.Conn, id string) *Peer {
 	peerConn := &Peer{
-		id: GenerateId(),
+		id:          id,
+		subprotocol: conn.Subprotocol(),
 	}
 
 	// Create a new peer socket message handler
@@ -146,18 +455,36 @@ func (peer *Peer) Start(channel *Channel) error {
 
 	peer.channel = channel
 
-	// Start connection read/write pumps
+	if channel.service != nil {
+		peer.transport.lateDrops = &channel.service.lateBroadcastDrops
+		peer.transport.goroutines = &channel.goroutines
+
+		if channel.service.WriterModel == "channel" {
+			peer.transport.writer = channel.sharedWriter()
+		}
+	}
+
+	// Start connection read/write pumps. Messages the peer sends before it
+	// is registered with the channel (e.g. a broadcast sent right after
+	// connecting) are held until other peers have been told it connected.
+	peer.transport.readGate = make(chan bool)
 	peer.transport.Start()
-	go func() {
-		<-peer.transport.StopNotify()
-		peer.Stop()
-	}()
+	channel.spawn(func() {
+		select {
+		case <-peer.transport.StopNotify():
+			peer.Stop()
+		case <-peer.transport.closed:
+			// Stopped already
+		}
+	})
 
 	peer.active = true
 
 	// Add reference to this peer connection to channel
 	peer.addConnection()
 
+	close(peer.transport.readGate)
+
 	return nil
 }
 
@@ -169,11 +496,21 @@ func (peer *Peer) Stop() error {
 	// Remove references to this peer connection from channel
 	peer.removeConnection()
 
+	peer.ackMu.Lock()
+	if peer.ackTimer != nil {
+		peer.ackTimer.Stop()
+	}
+	peer.ackMu.Unlock()
+
+	if tap, ok := peer.tapped.Load().(*peerTap); ok && tap != nil {
+		peer.untap(tap)
+	}
+
 	// Close websocket connection
 	peer.transport.Stop()
 
 	// If no more local peers are connected then remove the current Network Web Socket service
-	if len(peer.channel.peers) == 0 {
+	if len(peer.channel.peers) == 0 && !peer.channel.persistent {
 		peer.channel.Stop()
 	}
 
@@ -182,56 +519,341 @@ func (peer *Peer) Stop() error {
 	return nil
 }
 
+// Close this peer connection with an application close code in the range
+// 4000-4999 and a reason. Both are relayed to all other channel peers in
+// the resulting 'disconnect' message. The connection is torn down when the
+// peer completes the closing handshake or, if it does not, once the
+// service's CloseGracePeriod has elapsed.
+func (peer *Peer) Close(code int, reason string) error {
+	return peer.closeWithin(code, reason, peer.closeGracePeriod(), nil)
+}
+
+// Return the time allowed for this peer to complete the closing handshake
+func (peer *Peer) closeGracePeriod() time.Duration {
+	if service := peer.channel.service; service != nil && service.CloseGracePeriod > 0 {
+		return service.CloseGracePeriod
+	}
+	return defaultCloseGracePeriod
+}
+
+// Check that a close code is in the application range 4000-4999
+func checkCloseCode(code int) error {
+	if code < 4000 || code > 4999 {
+		return fmt.Errorf("Close code %d is outside the application range 4000-4999", code)
+	}
+	return nil
+}
+
+// Close this peer connection like Close, forcing the connection closed if
+// the peer has not completed the closing handshake within wait and then
+// calling forced, if it is not nil
+func (peer *Peer) closeWithin(code int, reason string, wait time.Duration, forced func()) error {
+	if err := checkCloseCode(code); err != nil {
+		return err
+	}
+
+	if !peer.active {
+		return errors.New("Peer cannot be closed because it is not currently active")
+	}
+
+	peer.closeCode = code
+	peer.closeReason = reason
+
+	// Synthetic peers have no closing handshake to wait for
+	if peer.transport.conn == nil {
+		return peer.Stop()
+	}
+
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	if err := peer.transport.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait)); err != nil {
+		return peer.Stop()
+	}
+
+	// Force the connection closed if the peer does not respond to the
+	// close frame. Closing the connection wakes up the transport read pump,
+	// which stops this peer.
+	time.AfterFunc(wait, func() {
+		if peer.active && forced != nil {
+			forced()
+		}
+		peer.transport.closeConn()
+	})
+
+	return nil
+}
+
+// Send a broadcast to this peer. Peers that have advertised a credit window,
+// and all peers of channels in stop-and-wait mode (with a window of 1), are
+// only sent broadcasts while they have fewer unacknowledged broadcasts than
+// their window. Other broadcasts are held back until they acknowledge some.
+// Broadcasts not written or sent by the deadline (if not zero) are dropped.
+func (peer *Peer) writeBroadcast(wireData []byte, coalesceKey string, deadline time.Time) {
+	peer.ackMu.Lock()
+	defer peer.ackMu.Unlock()
+
+	if peer.creditWindow == 0 {
+		if !peer.channel.options.StopAndWait {
+			peer.transport.writeBefore(wireData, coalesceKey, deadline)
+			return
+		}
+		peer.creditWindow = 1
+	}
+
+	if peer.unacked < peer.creditWindow {
+		peer.writeUnacked(wireData)
+		return
+	}
+
+	if coalesceKey != "" {
+		for _, message := range peer.heldBroadcasts {
+			if message.coalesceKey == coalesceKey {
+				message.buf = wireData
+				message.deadline = deadline
+				return
+			}
+		}
+	}
+
+	if len(peer.heldBroadcasts) >= sendQueueSize {
+		log.Printf("err: Peer broadcast queue is full. Broadcast dropped")
+		return
+	}
+
+	peer.heldBroadcasts = append(peer.heldBroadcasts, &queuedMessage{wireData, coalesceKey, time.Now(), deadline, nil, 0})
+}
+
+// Send a broadcast to this peer that it must acknowledge. On channels in
+// stop-and-wait mode this peer is closed if it does not acknowledge its
+// broadcasts in time. Must be called with ackMu held.
+func (peer *Peer) writeUnacked(wireData []byte) {
+	peer.unacked++
+	peer.transport.Write(wireData)
+
+	if peer.channel.options.StopAndWait && peer.ackTimer == nil {
+		peer.startAckTimer()
+	}
+}
+
+// Close this peer if it does not acknowledge a broadcast in time. Must be
+// called with ackMu held.
+func (peer *Peer) startAckTimer() {
+	timeout := peer.channel.options.AckTimeout
+	if timeout <= 0 {
+		timeout = defaultAckTimeout
+	}
+
+	peer.ackTimer = time.AfterFunc(timeout, func() {
+		log.Printf("Closing peer %s that did not acknowledge a broadcast within %v", peer.id, timeout)
+		peer.transport.closeConn()
+	})
+}
+
+// Send held broadcasts while this peer has fewer unacknowledged broadcasts
+// than its credit window. Must be called with ackMu held.
+func (peer *Peer) sendHeldBroadcasts() {
+	for peer.unacked < peer.creditWindow && len(peer.heldBroadcasts) > 0 {
+		message := peer.heldBroadcasts[0]
+		peer.heldBroadcasts[0] = nil // allow to be garbage-collected
+		peer.heldBroadcasts = peer.heldBroadcasts[1:]
+
+		if !message.deadline.IsZero() && time.Now().After(message.deadline) {
+			if peer.transport.lateDrops != nil {
+				atomic.AddUint64(peer.transport.lateDrops, 1)
+			}
+			continue
+		}
+
+		peer.writeUnacked(message.buf)
+	}
+}
+
+// Record that this peer has acknowledged its oldest unacknowledged broadcast
+// and send it any held broadcasts it now has credit for
+func (peer *Peer) ack() {
+	peer.ackMu.Lock()
+	defer peer.ackMu.Unlock()
+
+	if peer.unacked == 0 {
+		return
+	}
+
+	peer.unacked--
+
+	if peer.ackTimer != nil {
+		peer.ackTimer.Stop()
+		peer.ackTimer = nil
+	}
+
+	peer.sendHeldBroadcasts()
+
+	// Keep waiting for acknowledgements of broadcasts still outstanding
+	if peer.channel.options.StopAndWait && peer.unacked > 0 && peer.ackTimer == nil {
+		peer.startAckTimer()
+	}
+}
+
+// Set the number of broadcasts this peer can be sent before it must
+// acknowledge them, at most 1 on channels in stop-and-wait mode
+func (peer *Peer) setCreditWindow(window int) {
+	peer.ackMu.Lock()
+	defer peer.ackMu.Unlock()
+
+	if peer.channel.options.StopAndWait && window > 1 {
+		window = 1
+	}
+
+	peer.creditWindow = window
+
+	peer.sendHeldBroadcasts()
+}
+
+// Whether this peer should receive broadcasts targeting the given shard key
+// (all peers receive broadcasts that do not target a shard)
+func (peer *Peer) inShard(shard string) bool {
+	return shard == "" || peer.shard == shard
+}
+
+// Whether this peer connected with the given tag
+func (peer *Peer) hasTag(tag string) bool {
+	for _, _tag := range peer.tags {
+		if _tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Report a rejected request back to this peer, and close its connection
+// if the service's ErrorPolicy for the reason is "close"
+func (peer *Peer) sendError(reason string) error {
+	wireData, err := encodeWireMessage("error", peer.id, peer.id, reason)
+	if err != nil {
+		return err
+	}
+
+	service := peer.channel.service
+	if service == nil || service.ErrorPolicy[reason] != "close" {
+		return peer.transport.Write(wireData)
+	}
+
+	// Send the close frame once the error has been written ahead of it, or
+	// once the grace period has passed if the error is still queued by then
+	var once sync.Once
+	closeAfterError := func() {
+		once.Do(func() {
+			go func() {
+				if !peer.active {
+					return
+				}
+				if err := peer.Close(errorCloseCode, reason); err != nil {
+					log.Printf("err: %v", err)
+				}
+			}()
+		})
+	}
+
+	if err := peer.transport.writeTracked(wireData, closeAfterError); err != nil {
+		return err
+	}
+	time.AfterFunc(peer.closeGracePeriod(), closeAfterError)
+
+	return nil
+}
+
 // Set up a new Channel connection instance
 func (peer *Peer) addConnection() {
+	// Bootstrap this peer's presence state before adding it to the broadcast
+	// list. Messages are delivered in the order they are queued so this peer
+	// is informed of all existing peer connections before it receives any
+	// broadcast messages.
+
+	// Inform this peer of all the other peer connections we own
+	for _, _peer := range peer.channel.peers {
+		if _peer.quiet {
+			continue
+		}
+		if wireData, err := encodeWireMessage("connect", peer.id, _peer.id, ""); err == nil {
+			peer.transport.Write(wireData)
+		}
+	}
+
+	// Inform this peer of all the peer connections other connected proxies own
+	for _, proxy := range peer.channel.proxies {
+		for peerId, _ := range proxy.peerIds {
+			if wireData, err := encodeWireMessage("connect", proxy.base.id, peerId, ""); err == nil {
+				peer.transport.Write(wireData)
+			}
+		}
+	}
+
 	// Add this websocket instance to Network Web Socket broadcast list
-	peer.channel.peers = append(peer.channel.peers, peer)
+	add := func() {
+		peer.channel.peers = append(peer.channel.peers, peer)
+		peer.channel.metrics.peers.recordPeers(time.Now(), 1)
+		if service := peer.channel.service; service != nil {
+			service.stats.recordPeers(time.Now(), 1)
+		}
+	}
 
+	// Quiet peers change the channel's presence without an event
+	if peer.quiet {
+		peer.channel.subscriptionsMu.Lock()
+		add()
+		peer.channel.subscriptionsMu.Unlock()
+		return
+	}
+
+	peer.channel.publish(add, WireMessage{Action: "connect", Target: peer.id})
+
+	// Inform other local peer connections that we now own this peer
 	for _, _peer := range peer.channel.peers {
 		if _peer.id != peer.id {
-			// Inform other local peer connections that we now own this peer
 			if wireData, err := encodeWireMessage("connect", _peer.id, peer.id, ""); err == nil {
 				_peer.transport.Write(wireData)
 			}
-
-			// Inform this peer of all the other peer connections we own
-			if wireData, err := encodeWireMessage("connect", peer.id, _peer.id, ""); err == nil {
-				peer.transport.Write(wireData)
-			}
 		}
 	}
 
+	// Inform all proxy connections that we now own this peer connection
 	for _, proxy := range peer.channel.proxies {
-		// Inform all proxy connections that we now own this peer connection
 		if proxy.writeable {
 			if wireData, err := encodeWireMessage("connect", proxy.base.id, peer.id, ""); err == nil {
 				proxy.base.transport.Write(wireData)
 			}
 		}
-		// Inform current peer of all the peer connections other connected proxies own
-		for peerId, _ := range proxy.peerIds {
-			if wireData, err := encodeWireMessage("connect", proxy.base.id, peerId, ""); err == nil {
-				peer.transport.Write(wireData)
-			}
-		}
 	}
 }
 
 // Tear down an existing Channel connection instance
 func (peer *Peer) removeConnection() {
-	for i, conn := range peer.channel.peers {
-		if conn.id == peer.id {
-			peer.channel.peers[i] = nil
-			peer.channel.peers = append(peer.channel.peers[:i], peer.channel.peers[i+1:]...)
-			break
+	remove := func() {
+		for i, conn := range peer.channel.peers {
+			if conn.id == peer.id {
+				peer.channel.peers[i] = nil
+				peer.channel.peers = append(peer.channel.peers[:i], peer.channel.peers[i+1:]...)
+				peer.channel.metrics.peers.recordPeers(time.Now(), -1)
+				if service := peer.channel.service; service != nil {
+					service.stats.recordPeers(time.Now(), -1)
+				}
+				break
+			}
 		}
 	}
 
+	if peer.quiet {
+		peer.channel.subscriptionsMu.Lock()
+		remove()
+		peer.channel.subscriptionsMu.Unlock()
+		return
+	}
+
+	peer.channel.publish(remove, WireMessage{Action: "disconnect", Target: peer.id, Code: peer.closeCode, Payload: peer.closeReason})
+
 	// Inform all local peer connections that we no longer own this peer connection
 	for _, _peer := range peer.channel.peers {
 		// don't notify peer if its id matches the peer's id
 		if _peer.id != peer.id {
-			if wireData, err := encodeWireMessage("disconnect", _peer.id, peer.id, ""); err == nil {
+			if wireData, err := encodeDisconnectWireMessage(_peer.id, peer.id, peer.closeCode, peer.closeReason); err == nil {
 				_peer.transport.Write(wireData)
 			}
 		}
@@ -240,7 +862,7 @@ func (peer *Peer) removeConnection() {
 	// Inform all proxy connections that we no longer own this peer connection
 	for _, proxy := range peer.channel.proxies {
 		if proxy.writeable {
-			if wireData, err := encodeWireMessage("disconnect", proxy.base.id, peer.id, ""); err == nil {
+			if wireData, err := encodeDisconnectWireMessage(proxy.base.id, peer.id, peer.closeCode, peer.closeReason); err == nil {
 				proxy.base.transport.Write(wireData)
 			}
 		}
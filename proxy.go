@@ -2,7 +2,7 @@ package networkwebsockets
 
 import (
 	"errors"
-	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/richtr/websocket"
@@ -21,6 +21,60 @@ type Proxy struct {
 
 	// Whether this proxy connection is writeable
 	writeable bool
+
+	// Remote network address of this proxy connection
+	host string
+
+	// Instance id of the service at the other end of this proxy connection,
+	// empty if it is not known
+	instance string
+
+	// Time (in unix nanoseconds) the DNS-SD record this proxy connection was
+	// dialed from was last seen, accessed atomically
+	lastSeen int64
+}
+
+// Description of an active proxy connection between this service and a remote service
+type FederationLink struct {
+	// Remote network address of the federated service
+	Host string
+
+	// Name of the channel federated over this link
+	Channel string
+
+	// "inbound" for proxy connections accepted by this service,
+	// "outbound" for proxy connections dialed by this service
+	Direction string
+}
+
+// Classification of the services discovered on the local network by whether
+// they federate a channel with this service. Services are identified by the
+// network address ("<ip>:<proxy port>") they were dialed at.
+type FederationCoverage struct {
+	// Services linked on the channel that have announced channel peers
+	WithPeers []string
+
+	// Services linked on the channel without channel peers, and services
+	// linked on other channels only
+	WithoutPeers []string
+
+	// Services advertising the channel that could not be dialed
+	Unreachable []string
+}
+
+// Description of a message waiting to be forwarded over a proxy connection
+type PendingForward struct {
+	// Remote network address of the proxy connection
+	Host string
+
+	// Name of the channel the message belongs to
+	Channel string
+
+	// The wire message waiting to be forwarded
+	Data string
+
+	// When the message was queued for forwarding
+	QueuedAt time.Time
 }
 
 type ProxyMessageHandler struct {
@@ -33,48 +87,138 @@ func (handler *ProxyMessageHandler) Read(buf []byte) error {
 		return errors.New("ProxyMessageHandler requires an attached Proxy object")
 	}
 
+	proxy.base.channel.trace("inbound from proxy", proxy.host, buf)
+
 	message, err := decodeWireMessage(buf)
 	if err != nil {
 		return err
 	}
 
+	channel := proxy.base.channel
+
+	// Rewrite or reject messages received from remote services
+	if service := channel.service; service != nil && service.FederationMiddleware != nil {
+		if err := service.FederationMiddleware(channel.serviceName, &message); err != nil {
+			return err
+		}
+	}
+
 	switch message.Action {
 	case "connect":
 
-		proxy.peerIds[message.Target] = true
+		// Ignore our own peer connections relayed back to us
+		if channel.isLocalPeer(message.Target) {
+			return nil
+		}
+
+		channel.publish(func() { proxy.peerIds[message.Target] = true }, WireMessage{Action: "connect", Target: message.Target})
+		channel.setRoute(message.Target, proxy)
 
 		// Inform all local peer connections that this proxy owns this peer connection
-		for _, peer := range proxy.base.channel.peers {
+		for _, peer := range channel.peers {
 			if wireData, err := encodeWireMessage("connect", peer.id, message.Target, ""); err == nil {
 				peer.transport.Write(wireData)
 			}
 		}
 
+		// Inform all other proxy connections of a pinned channel we own
+		if channel.isRelay() {
+			if wireData, err := encodeWireMessage("connect", proxy.base.id, message.Target, ""); err == nil {
+				channel.relayToProxies(proxy, wireData)
+			}
+		}
+
 		return nil
 
 	case "disconnect":
 
-		delete(proxy.peerIds, message.Target)
+		// Ignore our own peer connections relayed back to us
+		if channel.isLocalPeer(message.Target) {
+			return nil
+		}
+
+		channel.publish(func() { delete(proxy.peerIds, message.Target) }, WireMessage{Action: "disconnect", Target: message.Target, Code: message.Code, Payload: message.Payload})
+		channel.removeRoute(message.Target, proxy)
 
 		// Inform all local peer connections that this proxy no longer owns this peer connection
-		for _, peer := range proxy.base.channel.peers {
-			if wireData, err := encodeWireMessage("disconnect", peer.id, message.Target, ""); err == nil {
+		for _, peer := range channel.peers {
+			if wireData, err := encodeDisconnectWireMessage(peer.id, message.Target, message.Code, message.Payload); err == nil {
 				peer.transport.Write(wireData)
 			}
 		}
 
+		// Inform all other proxy connections of a pinned channel we own
+		if channel.isRelay() {
+			if wireData, err := encodeDisconnectWireMessage(proxy.base.id, message.Target, message.Code, message.Payload); err == nil {
+				channel.relayToProxies(proxy, wireData)
+			}
+		}
+
 		return nil
 
 	case "broadcast":
 
+		received := time.Now()
+
+		// Ignore broadcasts from our own peer connections relayed back to us
+		if channel.isLocalPeer(message.Source) {
+			return nil
+		}
+
+		// Drop broadcasts that were already stale when they arrived
+		if message.Deadline > 0 {
+			deadline := time.Unix(0, message.Deadline*int64(time.Millisecond)).Add(channel.service.clockSkewTolerance())
+			if received.After(deadline) {
+				if channel.service != nil {
+					atomic.AddUint64(&channel.service.lateBroadcastDrops, 1)
+				}
+				return nil
+			}
+		}
+
+		// Deliver sampled broadcasts to their target peer only, or forward
+		// them to the proxy that owns the target peer of a pinned channel we own
+		if message.Target != "" {
+			if channel.isLocalPeer(message.Target) {
+				wsSample := &WireMessage{
+					Action:    "sample",
+					Source:    message.Source,
+					Target:    message.Target,
+					Payload:   message.Payload,
+					Shard:     message.Shard,
+					Clock:     message.Clock,
+					MaxAge:    message.MaxAge,
+					Deadline:  message.Deadline,
+					fromProxy: true,
+				}
+				wsSample.TraceParent = channel.service.exportSpan("received", channel.serviceName, message.Source, message.TraceParent, received)
+
+				channel.broadcastBuffer <- wsSample
+				return nil
+			}
+			if channel.isRelay() {
+				if _proxy := channel.routeTo(message.Target, proxy); _proxy != nil {
+					channel.forwardSample(_proxy, &message, message.Target)
+					return nil
+				}
+			}
+			return errors.New("Sampled broadcast target could not be found. Not sent.")
+		}
+
 		// broadcast message on to given target
 		wsBroadcast := &WireMessage{
-			Action:    "broadcast",
-			Source:    message.Source,
-			Target:    "", // target all connections
-			Payload:   message.Payload,
-			fromProxy: true,
+			Action:      "broadcast",
+			Source:      message.Source,
+			Target:      "", // target all connections
+			Payload:     message.Payload,
+			CoalesceKey: message.CoalesceKey,
+			Shard:       message.Shard,
+			Clock:       message.Clock,
+			MaxAge:      message.MaxAge,
+			Deadline:    message.Deadline,
+			fromProxy:   true,
 		}
+		wsBroadcast.TraceParent = channel.service.exportSpan("received", channel.serviceName, message.Source, message.TraceParent, received)
 
 		proxy.base.channel.broadcastBuffer <- wsBroadcast
 
@@ -90,16 +234,44 @@ func (handler *ProxyMessageHandler) Read(buf []byte) error {
 				if wireData, err := encodeWireMessage("message", message.Source, message.Target, message.Payload); err == nil {
 					peer.transport.Write(wireData)
 				}
+				channel.service.observe(channel.serviceName, "message", message.Source, []string{peer.id}, message.Payload)
 				messageSent = true
 				break
 			}
 		}
 
+		// Forward message to the proxy that owns the target peer of a pinned channel we own
+		if !messageSent && channel.isRelay() {
+			if _proxy := channel.routeTo(message.Target, proxy); _proxy != nil {
+				if wireData, err := encodeWireMessage("message", message.Source, message.Target, message.Payload); err == nil {
+					_proxy.base.transport.Write(wireData)
+				}
+				messageSent = true
+			}
+		}
+
 		if !messageSent {
-			fmt.Errorf("P2P message target could not be found. Not sent.")
+			return errors.New("P2P message target could not be found. Not sent.")
+		}
+
+		return nil
+
+	case "drain":
+
+		// Stop accepting new connections to this channel, as the remote service does
+		if channel.service != nil && channel.service.drain(channel, message.Payload) && channel.isRelay() {
+			channel.relayToProxies(proxy, buf)
 		}
 
 		return nil
+
+	case "clusterstatus":
+
+		if channel.service == nil {
+			return nil
+		}
+
+		return channel.service.handleStatusMessage(proxy, message)
 	}
 
 	return errors.New("Could not find target for message")
@@ -115,20 +287,27 @@ func (handler *ProxyMessageHandler) Write(buf []byte) error {
 		return errors.New("Proxy is not active")
 	}
 
-	proxy.base.transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	proxy.base.transport.conn.WriteMessage(websocket.TextMessage, buf)
+	proxy.base.channel.trace("outbound to proxy", proxy.host, buf)
 
-	return nil
+	proxy.base.transport.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return proxy.base.transport.conn.WriteMessage(websocket.TextMessage, buf)
 }
 
 func NewProxy(conn *websocket.Conn, isWriteable bool) *Proxy {
+	return newProxy(conn, isWriteable, GenerateId())
+}
+
+// Create a proxy connection with the given proxy id
+func newProxy(conn *websocket.Conn, isWriteable bool, id string) *Proxy {
 	proxyConn := &Proxy{
 		base: Peer{
-			id: GenerateId(),
+			id:          id,
+			subprotocol: conn.Subprotocol(),
 		},
 		Hash_Base64: "",
 		writeable:   isWriteable,
 		peerIds:     make(map[string]bool),
+		host:        conn.RemoteAddr().String(),
 	}
 
 	// Create a new peer socket message handler
@@ -154,12 +333,20 @@ func (proxy *Proxy) Start(channel *Channel) error {
 
 	proxy.base.channel = channel
 
+	if channel.service != nil {
+		proxy.base.transport.abandonAfter = channel.service.ForwardTimeout
+		proxy.base.transport.goroutines = &channel.goroutines
+		if channel.service.ForwardRetries > 0 && proxy.instance != "" {
+			proxy.base.transport.writeFailed = proxy.retainForward
+		}
+	}
+
 	// Start connection read/write pumps
 	proxy.base.transport.Start()
-	go func() {
+	channel.spawn(func() {
 		<-proxy.base.transport.StopNotify()
 		proxy.Stop()
-	}()
+	})
 
 	proxy.base.active = true
 
@@ -181,7 +368,7 @@ func (proxy *Proxy) Stop() error {
 	proxy.base.transport.Stop()
 
 	// If no more local peers are connected then remove the current Network Web Socket service
-	if len(proxy.base.channel.peers) == 0 {
+	if len(proxy.base.channel.peers) == 0 && !proxy.base.channel.persistent {
 		proxy.base.channel.Stop()
 	}
 
@@ -194,33 +381,84 @@ func (proxy *Proxy) setHash_Base64(hash string) {
 	proxy.Hash_Base64 = hash
 }
 
+func (proxy *Proxy) direction() string {
+	if proxy.writeable {
+		return "inbound"
+	}
+	return "outbound"
+}
+
 // Set up a new Channel connection instance
 func (proxy *Proxy) addConnection() {
 	proxy.base.channel.proxies = append(proxy.base.channel.proxies, proxy)
 
+	if service := proxy.base.channel.service; service != nil && service.OnFederationLinkUp != nil {
+		service.OnFederationLinkUp(proxy.host, proxy.base.channel.serviceName)
+	}
+
 	if proxy.writeable {
-		// Inform this proxy of all the peer connections we own
+		// Inform this proxy of all the peer connections we own. This replays
+		// current presence to services that join the channel mid-session.
 		for _, peer := range proxy.base.channel.peers {
+			if peer.quiet {
+				continue
+			}
 			if wireData, err := encodeWireMessage("connect", proxy.base.id, peer.id, ""); err == nil {
 				proxy.base.transport.Write(wireData)
 			}
 		}
+
+		// Inform this proxy of all the peer connections other proxies of a
+		// pinned channel we own
+		if proxy.base.channel.isRelay() {
+			for _, _proxy := range proxy.base.channel.proxies {
+				for peerId, _ := range _proxy.peerIds {
+					if wireData, err := encodeWireMessage("connect", proxy.base.id, peerId, ""); err == nil {
+						proxy.base.transport.Write(wireData)
+					}
+				}
+			}
+		}
 	}
+
+	proxy.replayForwards()
 }
 
 // Tear down an existing Channel connection instance
 func (proxy *Proxy) removeConnection() {
+	// The peers this proxy owned leave the channel with it
+	peerIds := make([]string, 0, len(proxy.peerIds))
+	for peerId, _ := range proxy.peerIds {
+		peerIds = append(peerIds, peerId)
+	}
+	for _, peerId := range peerIds {
+		proxy.base.channel.publish(func() { delete(proxy.peerIds, peerId) }, WireMessage{Action: "disconnect", Target: peerId})
+	}
+
+	removed := false
 	for i, conn := range proxy.base.channel.proxies {
 		if proxy.base.id == conn.base.id {
 			proxy.base.channel.proxies[i] = nil // allow to be garbage-collected
 			proxy.base.channel.proxies = append(proxy.base.channel.proxies[:i], proxy.base.channel.proxies[i+1:]...)
+			removed = true
 			break
 		}
 	}
 
+	proxy.base.channel.removeRoutes(proxy)
+
+	// Only report links that were still registered against this channel
+	if service := proxy.base.channel.service; removed && service != nil && service.OnFederationLinkDown != nil {
+		service.OnFederationLinkDown(proxy.host, proxy.base.channel.serviceName)
+	}
+
 	if proxy.writeable {
-		// Inform this proxy of all the peer connections we no longer own
+		// Inform this proxy of all the peer connections we no longer own,
+		// except quiet peers it was never told about
 		for _, peer := range proxy.base.channel.peers {
+			if peer.quiet {
+				continue
+			}
 			if wireData, err := encodeWireMessage("disconnect", proxy.base.id, peer.id, ""); err == nil {
 				proxy.base.transport.Write(wireData)
 			}
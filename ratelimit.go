@@ -0,0 +1,215 @@
+package networkwebsockets
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket limiting the combined rate of broadcasts sent by the local
+// peers of a channel, which also measures the rate of accepted broadcasts
+type broadcastLimiter struct {
+	tokens float64
+	last   time.Time
+
+	// Broadcasts accepted in the current and previous one second windows
+	windowStart   time.Time
+	windowCount   int
+	previousCount int
+
+	mu sync.Mutex
+}
+
+// Whether a broadcast may be sent now, given a rate (broadcasts per second,
+// 0 = unlimited) and a burst size. Accepted broadcasts are counted.
+func (l *broadcastLimiter) allow(now time.Time, rate float64, burst int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+
+		if l.last.IsZero() {
+			l.tokens = float64(burst)
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * rate
+			if l.tokens > float64(burst) {
+				l.tokens = float64(burst)
+			}
+		}
+		l.last = now
+
+		if l.tokens < 1 {
+			return false
+		}
+		l.tokens--
+	}
+
+	l.roll(now)
+	l.windowCount++
+
+	return true
+}
+
+// Return the number of broadcasts accepted during the last second
+func (l *broadcastLimiter) rate(now time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.roll(now)
+
+	// Weight the previous window by how much of it overlaps the last second
+	elapsed := now.Sub(l.windowStart).Seconds()
+	return float64(l.previousCount)*(1-elapsed) + float64(l.windowCount)
+}
+
+// Start a new one second window if the current one has ended. Must be
+// called with mu held.
+func (l *broadcastLimiter) roll(now time.Time) {
+	elapsed := now.Sub(l.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+
+	if elapsed < 2*time.Second {
+		l.previousCount = l.windowCount
+		l.windowStart = l.windowStart.Add(time.Second)
+	} else {
+		l.previousCount = 0
+		l.windowStart = now
+	}
+	l.windowCount = 0
+}
+
+// Token bucket pacing websocket upgrades of a service. Unlike
+// broadcastLimiter it lets requests reserve future tokens, so short bursts
+// wait their turn instead of being rejected.
+type upgradeLimiter struct {
+	tokens float64
+	last   time.Time
+
+	mu sync.Mutex
+}
+
+// Reserve a token for an upgrade now, given a rate (upgrades per second)
+// and a burst size, and return how long the upgrade must wait for it. No
+// token is reserved, and false returned, if the wait would exceed maxWait.
+func (l *upgradeLimiter) reserve(now time.Time, rate float64, burst int, maxWait time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+
+	var wait time.Duration
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+
+	l.tokens--
+	return wait, true
+}
+
+// Wait for the service's MaxUpgradeRate to allow another websocket upgrade.
+// Returns false at once if the wait would exceed MaxUpgradeWait.
+func (service *Service) admitUpgrade() bool {
+	if service.MaxUpgradeRate <= 0 {
+		return true
+	}
+
+	maxWait := service.MaxUpgradeWait
+	if maxWait <= 0 {
+		maxWait = defaultMaxUpgradeWait
+	}
+
+	wait, ok := service.upgrades.reserve(time.Now(), service.MaxUpgradeRate, service.UpgradeBurst, maxWait)
+	if ok && wait > 0 {
+		time.Sleep(wait)
+	}
+	return ok
+}
+
+// Count a direct message from a local peer as in flight until it has been
+// written to (or dropped for) its target's connection, unless the peer
+// already has the service's MaxInflightDirectPerSource messages in flight.
+// Returns the function to call once the message has left the queue.
+func (channel *Channel) acquireDirect(source string) (func(), bool) {
+	max := 0
+	if channel.service != nil {
+		max = channel.service.MaxInflightDirectPerSource
+	}
+	if max <= 0 {
+		return func() {}, true
+	}
+
+	channel.inflightMu.Lock()
+	defer channel.inflightMu.Unlock()
+
+	if channel.inflightDirect[source] >= max {
+		return nil, false
+	}
+	channel.inflightDirect[source]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			channel.inflightMu.Lock()
+			defer channel.inflightMu.Unlock()
+
+			if channel.inflightDirect[source]--; channel.inflightDirect[source] <= 0 {
+				delete(channel.inflightDirect, source)
+			}
+		})
+	}, true
+}
+
+// Check whether the fan-out cost of a broadcast from source is within the
+// service's MaxBroadcastFanout, counting the peers of matching subtree
+// channels and of other services it would be delivered to
+func (channel *Channel) allowFanout(source *Peer, message WireMessage, remoteOnly bool) bool {
+	if channel.service == nil || channel.service.MaxBroadcastFanout <= 0 {
+		return true
+	}
+
+	recipients := 0
+	if !remoteOnly {
+		for _, peer := range channel.peers {
+			if peer != source {
+				recipients++
+			}
+		}
+		if !isSubtreeChannelName(channel.serviceName) {
+			for _, subtree := range channel.service.channelList() {
+				if subtree.matchesSubtree(channel.serviceName) {
+					recipients += len(subtree.peers)
+				}
+			}
+		}
+	}
+	for _, proxy := range channel.proxies {
+		recipients += len(proxy.peerIds)
+	}
+
+	return recipients*len(message.Payload) <= channel.service.MaxBroadcastFanout
+}
+
+// Whether a local peer of this channel may send a broadcast now, according
+// to the channel's MaxBroadcastRate
+func (channel *Channel) allowBroadcast() bool {
+	return channel.limiter.allow(time.Now(), channel.options.MaxBroadcastRate, channel.options.BroadcastBurst)
+}
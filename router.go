@@ -0,0 +1,48 @@
+package networkwebsockets
+
+// Router chooses which peer connections of a channel receive each
+// broadcast. Every service consults its own Router for its local peer
+// connections only, so broadcasts federated to other services are routed
+// by their Routers.
+type Router interface {
+	// Called with the channel name, the id of the peer that sent the
+	// broadcast, the broadcast and the ids of the channel's local peer
+	// connections (including the sender if it is local). Returns the ids of
+	// the peers to deliver the broadcast to. The sender is never delivered
+	// its own broadcast.
+	Route(channel string, source string, message *WireMessage, peerIds []string) []string
+}
+
+// Router that delivers broadcasts to all peers of a channel. This is the
+// default Router of a service.
+type AllPeersRouter struct{}
+
+func (router AllPeersRouter) Route(channel string, source string, message *WireMessage, peerIds []string) []string {
+	return peerIds
+}
+
+// Return the given local peer connections that a broadcast should be
+// delivered to according to the service's Router
+func (channel *Channel) route(broadcast *WireMessage, peers []*Peer) []*Peer {
+	if channel.service == nil || channel.service.Router == nil {
+		return peers
+	}
+
+	peerIds := make([]string, len(peers))
+	for i, peer := range peers {
+		peerIds[i] = peer.id
+	}
+
+	routed := make(map[string]bool)
+	for _, id := range channel.service.Router.Route(channel.serviceName, broadcast.Source, broadcast, peerIds) {
+		routed[id] = true
+	}
+
+	recipients := make([]*Peer, 0, len(routed))
+	for _, peer := range peers {
+		if routed[peer.id] {
+			recipients = append(recipients, peer)
+		}
+	}
+	return recipients
+}
@@ -0,0 +1,57 @@
+package networkwebsockets
+
+// Record that a remote peer of the channel is owned by the service at the
+// other end of proxy, as announced by the proxy's presence messages. Later
+// announcements of the same peer from another proxy (e.g. after the link it
+// was announced over went down and the peer was relayed over another link)
+// replace the earlier route.
+func (channel *Channel) setRoute(peerId string, proxy *Proxy) {
+	channel.routesMu.Lock()
+	channel.routes[peerId] = proxy
+	channel.routesMu.Unlock()
+}
+
+// Forget the route to a remote peer that disconnected, if it still goes
+// through proxy
+func (channel *Channel) removeRoute(peerId string, proxy *Proxy) {
+	channel.routesMu.Lock()
+	if channel.routes[peerId] == proxy {
+		delete(channel.routes, peerId)
+	}
+	channel.routesMu.Unlock()
+}
+
+// Forget all routes through a proxy connection that is going away
+func (channel *Channel) removeRoutes(proxy *Proxy) {
+	channel.routesMu.Lock()
+	for peerId, _proxy := range channel.routes {
+		if _proxy == proxy {
+			delete(channel.routes, peerId)
+		}
+	}
+	channel.routesMu.Unlock()
+}
+
+// Return the proxy connection to forward a direct message for a remote peer
+// to, other than except, or nil if no connected proxy owns the peer. Routes
+// missing from the table are looked up in the proxies' presence and cached.
+func (channel *Channel) routeTo(peerId string, except *Proxy) *Proxy {
+	channel.routesMu.RLock()
+	proxy, ok := channel.routes[peerId]
+	channel.routesMu.RUnlock()
+
+	if ok && proxy != except {
+		return proxy
+	}
+
+	for _, _proxy := range channel.proxies {
+		if _proxy != except && _proxy.peerIds[peerId] {
+			if !ok {
+				channel.setRoute(peerId, _proxy)
+			}
+			return _proxy
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package networkwebsockets
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
@@ -8,8 +10,11 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -21,6 +26,7 @@ var (
 	serviceNameRegexStr  = "[A-Za-z0-9\\+=\\*\\._-]{1,255}"
 	isValidCreateRequest = regexp.MustCompile(fmt.Sprintf("^/%s$", serviceNameRegexStr))
 	isValidProxyRequest  = regexp.MustCompile(fmt.Sprintf("^/%s$", serviceNameRegexStr))
+	isValidChannelName   = regexp.MustCompile(fmt.Sprintf("^%s$", serviceNameRegexStr))
 
 	// TLS-SRP configuration components
 	Salt       = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
@@ -29,8 +35,53 @@ var (
 
 // Generate a new random identifier
 func GenerateId() string {
-	rand.Seed(time.Now().UTC().UnixNano())
-	return fmt.Sprintf("%d", rand.Int())
+	idRandomMu.Lock()
+	defer idRandomMu.Unlock()
+
+	return fmt.Sprintf("%d", idRandom.Int())
+}
+
+// Source of GenerateId and of services without a RandomSource, seeded once
+var (
+	idRandom   = rand.New(rand.NewSource(time.Now().UTC().UnixNano()))
+	idRandomMu sync.Mutex
+)
+
+// Generate a peer, proxy or request id from the service's RandomSource, if
+// set, or with GenerateId otherwise
+func (service *Service) generateId() string {
+	if service == nil || service.RandomSource == nil {
+		return GenerateId()
+	}
+	return fmt.Sprintf("%d", service.randomInt63())
+}
+
+// Return a seed for random sampling from the service's RandomSource, if
+// set, or from the current time otherwise
+func (service *Service) randomSeed() int64 {
+	if service == nil || service.RandomSource == nil {
+		return time.Now().UnixNano()
+	}
+	return service.randomInt63()
+}
+
+// Return a random number from the service's RandomSource, if set, or from
+// the source of GenerateId otherwise
+func (service *Service) randomInt63() int64 {
+	if service == nil || service.RandomSource == nil {
+		idRandomMu.Lock()
+		defer idRandomMu.Unlock()
+
+		return idRandom.Int63()
+	}
+
+	service.randomMu.Lock()
+	defer service.randomMu.Unlock()
+
+	if service.random == nil {
+		service.random = rand.New(service.RandomSource)
+	}
+	return service.random.Int63()
 }
 
 type HTTPHandler interface {
@@ -45,6 +96,13 @@ type DefaultServiceHandler struct {
 func (sh *DefaultServiceHandler) ServeLocalRequest(w http.ResponseWriter, r *http.Request) {
 	service := sh.service
 
+	// Reject unsupported methods before any other request processing. Admin
+	// routes accept the methods of adminRouteMethods instead.
+	isAdminRequest := service != nil && service.AdminUIEnabled && (r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/"))
+	if !isAdminRequest && !checkRequestMethod(w, r, "GET") {
+		return
+	}
+
 	if service == nil {
 		http.Error(w, fmt.Sprintln("This interface is not attached to a service"), 403)
 		return
@@ -56,8 +114,9 @@ func (sh *DefaultServiceHandler) ServeLocalRequest(w http.ResponseWriter, r *htt
 		return
 	}
 
-	if r.Method != "GET" {
-		http.Error(w, "Method Not Allowed", 405)
+	// Serve admin interface, if enabled
+	if isAdminRequest {
+		service.serveAdminRequest(w, r)
 		return
 	}
 
@@ -94,34 +153,96 @@ func (sh *DefaultServiceHandler) ServeLocalRequest(w http.ResponseWriter, r *htt
 		return
 	}
 
+	// Reject connection attempts from temporarily banned addresses. Only
+	// websocket upgrades count as connection attempts.
+	if !service.checkBanPolicy(r) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	// Reject new connections to drained channels
+	if service.isDraining(serviceName) {
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+
+	// Reject unsigned, expired or tampered channel URLs
+	if !service.checkChannelSignature(serviceName, r) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	// Reject new connections while the service is overloaded
+	if service.isOverloaded() {
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+
+	// Reject new connections that could not be federated
+	if service.RejectConnectionsWithoutDiscovery && service.DiscoveryError() != nil {
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+
+	// Pace bursts of new connections
+	if !service.admitUpgrade() {
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+
 	// Resolve to network web socket channel
 	channel := service.GetChannelByName(serviceName)
+
+	// Handle connections that duplicate an open connection of the same client instance
+	instance := r.URL.Query().Get("instance")
+	if duplicate := channel.peerWithInstance(instance); duplicate != nil {
+		switch service.DuplicateInstancePolicy {
+		case "reject":
+			http.Error(w, "Conflict", 409)
+			return
+		case "replace":
+			if err := duplicate.Close(replacedCloseCode, "Replaced by a new connection"); err != nil {
+				log.Printf("err: %v", err)
+			}
+		}
+	}
+
 	if channel == nil {
 		channel = NewChannel(service, serviceName)
+	} else if channel.goroutineBudget() == 0 {
+		http.Error(w, "Service Unavailable", 503)
+		return
 	}
 
 	// Serve network web socket channel peer
-	ws, err := upgradeHTTPToWebSocket(w, r)
+	ws, err := upgradeHTTPToWebSocket(w, r, service.ReadBufferSize, service.WriteBufferSize)
 	if err != nil {
 		http.Error(w, "Bad Request", 400)
 		return
 	}
 
 	// Create, bind and start a new peer connection
-	peer := NewPeer(ws)
+	peer := newPeer(ws, service.generateId())
+	if id, ok := service.claimMigration(r.URL.Query().Get("migrate"), serviceName); ok && !channel.isLocalPeer(id) {
+		peer.id = id
+	}
+	peer.shard = r.URL.Query().Get("shard")
+	peer.tags = r.URL.Query()["tag"]
+	peer.instance = instance
+	peer.quiet, _ = strconv.ParseBool(r.URL.Query().Get("quiet"))
 	peer.Start(channel)
 }
 
 func (sh *DefaultServiceHandler) ServeProxyRequest(w http.ResponseWriter, r *http.Request) {
 	service := sh.service
 
-	if service == nil {
-		http.Error(w, fmt.Sprintln("This interface is not attached to a service"), 403)
+	// Reject unsupported methods before any other request processing
+	if !checkRequestMethod(w, r, "GET") {
 		return
 	}
 
-	if r.Method != "GET" {
-		http.Error(w, "Method Not Allowed", 405)
+	if service == nil {
+		http.Error(w, fmt.Sprintln("This interface is not attached to a service"), 403)
 		return
 	}
 
@@ -135,6 +256,19 @@ func (sh *DefaultServiceHandler) ServeProxyRequest(w http.ResponseWriter, r *htt
 		return
 	}
 
+	// Reject connection attempts from temporarily banned addresses. Only
+	// websocket upgrades count as connection attempts.
+	if !service.checkBanPolicy(r) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	// Reject new connections while the service is overloaded
+	if service.isOverloaded() {
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+
 	requestedWebSocketSubProtocols := r.Header.Get("Sec-Websocket-Protocol")
 	if requestedWebSocketSubProtocols != "nws-proxy-draft-01" {
 		http.Error(w, "Bad Request", 400)
@@ -142,16 +276,17 @@ func (sh *DefaultServiceHandler) ServeProxyRequest(w http.ResponseWriter, r *htt
 	}
 
 	// Resolve servicePath to an active named websocket service
-	for _, channel := range service.Channels {
+	for _, channel := range service.channelList() {
 		if channel.proxyPath == r.URL.Path {
-			ws, err := upgradeHTTPToWebSocket(w, r)
+			ws, err := upgradeHTTPToWebSocket(w, r, service.ReadBufferSize, service.WriteBufferSize)
 			if err != nil {
 				http.Error(w, "Bad Request", 400)
 				return
 			}
 
 			// Create, bind and start a new proxy connection
-			proxy := NewProxy(ws, true)
+			proxy := newProxy(ws, true, service.generateId())
+			proxy.instance = r.Header.Get("X-Nws-Instance")
 			proxy.Start(channel)
 
 			return
@@ -173,8 +308,292 @@ type Service struct {
 	// All Network Web Socket channels that this service manages
 	Channels map[string]*Channel
 
+	// Guards Channels while channels are added and removed, see channelList
+	channelsMu sync.RWMutex
+
+	// Channel names mapped to the Host of the service that owns them. Other
+	// services only federate a pinned channel with its owner, which relays
+	// all messages and presence for the channel between them.
+	ChannelHostPolicy map[string]string
+
+	// Channel names mapped to the options applied to those channels when
+	// they are created (channels not listed use the default options)
+	ChannelOptions map[string]ChannelOptions
+
+	// Optional callbacks invoked with the remote address and channel name
+	// whenever a proxy connection is established or torn down
+	OnFederationLinkUp   func(host string, channel string)
+	OnFederationLinkDown func(host string, channel string)
+
+	// Optional function applied to every message received over a proxy
+	// connection before it is delivered locally. It may modify the message
+	// or return an error to drop it.
+	FederationMiddleware func(channel string, message *WireMessage) error
+
+	// Maximum number of proxy connections to federated services dialed at
+	// the same time, e.g. when many channels federate with many services at
+	// startup (0 = no limit). Further dials wait for a dial to finish.
+	MaxConcurrentFederationDials int
+	federationDials              chan bool
+	federationDialsMu            sync.Mutex
+
+	// Time after which a proxy connection dialed to a discovered service is
+	// closed if the service's advertisement has not been seen again, e.g.
+	// because the service vanished without an mDNS goodbye packet
+	// (0 = never). Advertisements are looked for every 10 seconds, so this
+	// should be longer than that.
+	DiscoveryTTL time.Duration
+
+	// Multicast IPv4 group and port channels are advertised and
+	// discovered on (empty and 0 = 224.0.0.251 and 5406). Services on
+	// different groups or ports do not discover each other, e.g. to keep
+	// independent clusters on the same network apart. The IPv6 group is
+	// ff02::fb by default and otherwise the link-local group ending in the
+	// IPv4 group (e.g. ff02::efff:1 for 239.255.0.1), on the same port.
+	MulticastAddress string
+	MulticastPort    int
+
+	// Messages waiting longer than this to be forwarded over a proxy
+	// connection (e.g. to an unresponsive remote service) are abandoned
+	// (0 = never abandon messages)
+	ForwardTimeout time.Duration
+
+	// Number of times a message that could not be forwarded over a proxy
+	// connection because the connection went down is queued again on the
+	// next connection to the same service (0 = messages are not retried).
+	// Broadcasts whose deadline has passed by then are dropped instead.
+	ForwardRetries int
+
+	// Optional Router choosing which local peer connections receive each
+	// broadcast (nil = all peers of the channel, see AllPeersRouter)
+	Router Router
+
+	// Optional function called with the channel name and the source and
+	// target peer ids of every direct message sent by a local peer. Direct
+	// messages are only relayed if it returns true.
+	CanSendDirect func(channel string, from string, to string) bool
+
+	// Whether messages from local peers with fields this service does not
+	// know about (e.g. typos or fields of a newer protocol version) are
+	// rejected with an "unknown_field" error instead of having those fields
+	// ignored
+	StrictMessageParsing bool
+
+	// Optional exporter passed a span for each stage of every broadcast's
+	// journey. Services federated with this service link their spans of
+	// the same broadcast into one trace if they have a SpanExporter too.
+	SpanExporter SpanExporter
+
+	// Maximum payload size, in bytes, of direct messages relayed between
+	// peers (0 = no limit other than the maximum websocket frame size)
+	MaxMessagePayloadSize int
+
+	// Maximum number of goroutines a channel uses to write each broadcast
+	// to its peer connections (0 or 1 = write to one peer after another).
+	// Writes only queue messages for each connection's write pump, so
+	// parallel writes pay off for very large channels on machines with many
+	// cores, at the cost of more goroutines, which each channel keeps
+	// until it is stopped (see the BroadcastConcurrency benchmarks). Each
+	// peer still receives broadcasts in the order they were sent.
+	BroadcastConcurrency int
+
+	// How writes to peer connections are scheduled: "peer" (or "", the
+	// default) gives each peer connection its own write goroutine, so a
+	// slow peer never delays the others; "channel" writes to all peer
+	// connections of a channel from a single goroutine, a batch of messages
+	// for one peer after another, saving goroutines on services with many small channels at
+	// the cost of a slow peer delaying the rest of its channel (see the
+	// WriterModel benchmarks). Proxy connections always have their own
+	// write goroutine.
+	WriterModel string
+
+	// Total number of messages queued for writing across all connections at
+	// which the service starts rejecting new connections with a 503 error,
+	// until the queued messages drain below it again (0 = never reject)
+	LoadSheddingHighWaterMark int
+
+	// Time allowed for a peer to complete the closing handshake after it is
+	// closed via ClosePeer or DrainChannel before its connection is
+	// forcibly closed. See ForcedDrainCloses.
+	CloseGracePeriod time.Duration
+
+	// Writes to a peer connection that take longer than this count as a
+	// strike against the peer (0 = writes are not timed). A peer with
+	// SlowWriteStrikes strikes within SlowWriteWindow (0 = ever) is
+	// closed as a chronically slow consumer, while a peer that is only
+	// occasionally slow stays connected. Writes that fail outright, after
+	// the write timeout of 10 seconds, still close the connection at once.
+	SlowWriteThreshold time.Duration
+	SlowWriteStrikes   int
+	SlowWriteWindow    time.Duration
+
+	// How far the clocks of federated services may differ from this
+	// service's clock when checking the deadline of broadcasts they
+	// forward (0 = defaultClockSkewTolerance). Forwarded broadcasts that
+	// arrive after their deadline plus the tolerance are dropped.
+	ClockSkewTolerance time.Duration
+
+	// Maximum rate (upgrades per second, 0 = no limit) at which the service
+	// upgrades new peer connections, with bursts of up to UpgradeBurst (at
+	// least 1) upgraded at once. Connections beyond the rate wait their turn
+	// for up to MaxUpgradeWait (0 = defaultMaxUpgradeWait) and are then
+	// rejected with a 503 error. Unlike BanPolicy this limits the combined
+	// rate of all clients.
+	MaxUpgradeRate float64
+	UpgradeBurst   int
+	MaxUpgradeWait time.Duration
+	upgrades       upgradeLimiter
+
+	// Optional observer passed a copy of every broadcast and direct message
+	// delivered by this service. Must be set before Start is called.
+	Observer Observer
+
+	// Maximum number of messages waiting to be passed to Observer
+	ObserverBufferSize int
+
+	observations        chan *observation
+	observerStop        chan bool
+	droppedObservations uint64
+
+	// Options of channels registered via PreRegisterChannel before Start
+	preRegisteredChannels map[string]ChannelOptions
+
+	// Policy for temporarily banning remote addresses that make connection
+	// attempts too often (the zero value never bans). Only websocket
+	// upgrades count as connection attempts. All local peers connect from
+	// the same loopback address, so they share one count and one ban.
+	BanPolicy BanPolicy
+
+	// Recent connection attempts and ban expiry times by remote address
+	connectAttempts map[string][]time.Time
+	bans            map[string]time.Time
+	bansMu          sync.Mutex
+
+	// What to do when a peer connects to a channel with the same instance id
+	// (the "instance" URL query parameter) as an open connection of the
+	// channel, e.g. when a client reconnects in a loop without closing its
+	// earlier connections: "replace" closes the open connection, "reject"
+	// rejects the new connection with a 409 error and "" (the default)
+	// allows both connections
+	DuplicateInstancePolicy string
+
+	// What to do with a peer connection after rejecting one of its messages,
+	// by rejection reason (e.g. "malformed_message" or "unknown_target"):
+	// "close" closes the connection after sending the peer the error and
+	// "keep-alive" (the default for reasons not listed) only sends the error
+	ErrorPolicy map[string]string
+
+	// Maximum number of direct messages from a single peer that may be
+	// waiting to be written to their targets' connections at once (0 = no
+	// limit). Further direct messages from the peer are rejected with a
+	// "throttled" error until earlier ones have been written.
+	MaxInflightDirectPerSource int
+
+	// Maximum fan-out cost of a single broadcast (or sample broadcast) from
+	// a local peer, the size of its data in bytes times the number of
+	// local, subtree channel and federated peers it could be delivered to
+	// (0 = no limit). More costly broadcasts are rejected with a
+	// "fanout_too_large" error.
+	MaxBroadcastFanout int
+
+	// Maximum number of goroutines attributed to a single channel (0 = no
+	// limit). Channels at the limit write broadcasts without additional
+	// workers and reject new peer connections with a 503 error.
+	MaxChannelGoroutines int
+
+	// Optional source of all randomness of the service: its instance id,
+	// peer, proxy, request and span ids, DNS-SD service names, TLS-SRP salt
+	// and broadcast samples. Set it before Start to a source with a fixed
+	// seed (e.g. rand.NewSource(1)) for deterministic behaviour in tests.
+	// nil (the default) seeds them from the current time.
+	RandomSource rand.Source
+	random       *rand.Rand
+	randomMu     sync.Mutex
+
+	// Optional secret that channel URLs must be signed with (see
+	// SignChannel). When set, connections to channel URLs without a valid,
+	// unexpired signature are rejected with a 403 error.
+	URLSigningSecret []byte
+
+	// Whether to reject new local connections with a 503 error while
+	// discovery of other services on the network is failing, instead of
+	// accepting connections to channels that cannot be federated
+	RejectConnectionsWithoutDiscovery bool
+
+	// Whether to disable Nagle's algorithm (TCP_NODELAY) on accepted
+	// connections (default true). Messages are then sent as soon as they are
+	// written, for the lowest latency. Set to false to let the operating
+	// system coalesce small messages into fewer packets, trading latency for
+	// throughput on bandwidth-sensitive channels.
+	NoDelay bool
+
+	// Sizes, in bytes, of the I/O buffers of each websocket connection the
+	// service accepts or dials (default 8192). Messages larger than a
+	// buffer are still read and written, in several steps, so smaller
+	// buffers save memory on services with many connections that send
+	// small messages, while larger buffers speed up large messages.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Whether to serve an admin page at /admin, showing the current
+	// channels, peers and federation links of this service, and the
+	// combined status of all federated services at /admin/cluster-status
+	// and per channel metrics at /admin/metrics (see ChannelMetrics).
+	// Like all other local endpoints it is only accessible from the local
+	// machine, and all admin endpoints require the AdminToken.
+	AdminUIEnabled bool
+
+	// Token that requests to the admin page, its status data and admin
+	// actions, tapping a peer's traffic at POST /admin/tap (see TapPeer) and
+	// closing a peer at POST /admin/close (see ClosePeer), must present as a
+	// bearer token or a token query parameter (e.g. /admin?token=<token>).
+	// All admin endpoints are disabled if empty.
+	AdminToken string
+
+	// Names of the channels ChannelMetrics reports on. If empty it reports on
+	// the MetricsTopChannels channels with the most peers (default 20).
+	MetricsChannels    []string
+	MetricsTopChannels int
+
+	// How long frame tracing stays enabled after a call to EnableChannelTrace
+	ChannelTraceDuration time.Duration
+
+	// Frame tracing expiry times by channel name
+	channelTraces   map[string]time.Time
+	channelTracesMu sync.Mutex
+
+	// Number of broadcasts dropped for peers because their maximum age passed
+	lateBroadcastDrops uint64
+
+	// Number of peer connections forcibly closed while draining a channel
+	forcedDrainCloses uint64
+
+	// Per second counts of local peer messages and connections, see Stats
+	stats windowedStats
+
+	// HTTP middleware wrapping all local and proxy endpoints (see Use)
+	middleware   []*middlewareEntry
+	middlewareMu sync.Mutex
+
+	// Names of channels that no longer accept new connections (see DrainChannel)
+	draining   map[string]bool
+	drainingMu sync.Mutex
+
+	// Peers asked to move to another channel, by the token they reconnect
+	// with to keep their peer id (see MigrateChannel)
+	migrations   map[string]migration
+	migrationsMu sync.Mutex
+
+	// ClusterStatus requests collecting responses by correlation id
+	statusRequests   map[string]chan hostStatusResponse
+	statusRequestsMu sync.Mutex
+
 	discoveryBrowser *DiscoveryBrowser
 
+	// Unique id of this service instance, advertised with its channels so
+	// that it recognises (and does not federate with) its own advertisements
+	instanceId string
+
 	done chan int // blocks until .Stop() is called on this service
 
 	localListener net.Listener
@@ -203,6 +622,32 @@ func NewService(host string, port int) *Service {
 
 		Channels: make(map[string]*Channel),
 
+		ChannelHostPolicy: make(map[string]string),
+
+		ChannelOptions: make(map[string]ChannelOptions),
+
+		CloseGracePeriod: defaultCloseGracePeriod,
+
+		NoDelay: true,
+
+		ReadBufferSize:  8192,
+		WriteBufferSize: 8192,
+
+		ObserverBufferSize: 512,
+
+		ChannelTraceDuration: 5 * time.Minute,
+
+		channelTraces: make(map[string]time.Time),
+
+		draining: make(map[string]bool),
+
+		migrations: make(map[string]migration),
+
+		preRegisteredChannels: make(map[string]ChannelOptions),
+
+		connectAttempts: make(map[string][]time.Time),
+		bans:            make(map[string]time.Time),
+
 		discoveryBrowser: NewDiscoveryBrowser(),
 
 		done: make(chan int),
@@ -214,13 +659,143 @@ func NewService(host string, port int) *Service {
 	return service
 }
 
+// Validate checks the service configuration for problems without starting
+// the service. All problems found are reported together in the returned error.
+func (service *Service) Validate() error {
+	problems := make([]string, 0)
+
+	if service.Host == "" {
+		problems = append(problems, "Host must not be empty")
+	}
+
+	if service.Port <= 1024 || service.Port >= 65534 {
+		problems = append(problems, fmt.Sprintf("Port %d is outside the range 1025-65533", service.Port))
+	}
+
+	if service.Handler == nil {
+		problems = append(problems, "Handler must not be nil")
+	}
+
+	if service.MaxMessagePayloadSize < 0 {
+		problems = append(problems, fmt.Sprintf("MaxMessagePayloadSize %d must not be negative", service.MaxMessagePayloadSize))
+	} else if service.MaxMessagePayloadSize > maxMessageSize {
+		problems = append(problems, fmt.Sprintf("MaxMessagePayloadSize %d exceeds the maximum websocket message size of %d", service.MaxMessagePayloadSize, maxMessageSize))
+	}
+
+	if service.ReadBufferSize < 0 || service.WriteBufferSize < 0 {
+		problems = append(problems, fmt.Sprintf("ReadBufferSize %d and WriteBufferSize %d must not be negative", service.ReadBufferSize, service.WriteBufferSize))
+	}
+
+	if service.ChannelTraceDuration < 0 {
+		problems = append(problems, fmt.Sprintf("ChannelTraceDuration %v must not be negative", service.ChannelTraceDuration))
+	}
+
+	switch service.DuplicateInstancePolicy {
+	case "", "replace", "reject":
+	default:
+		problems = append(problems, fmt.Sprintf("DuplicateInstancePolicy '%s' must be \"replace\", \"reject\" or empty", service.DuplicateInstancePolicy))
+	}
+
+	switch service.WriterModel {
+	case "", "peer", "channel":
+	default:
+		problems = append(problems, fmt.Sprintf("WriterModel '%s' must be \"peer\", \"channel\" or empty", service.WriterModel))
+	}
+
+	errorReasons := make([]string, 0, len(service.ErrorPolicy))
+	for reason, _ := range service.ErrorPolicy {
+		errorReasons = append(errorReasons, reason)
+	}
+	sort.Strings(errorReasons)
+
+	for _, reason := range errorReasons {
+		switch service.ErrorPolicy[reason] {
+		case "", "keep-alive", "close":
+		default:
+			problems = append(problems, fmt.Sprintf("ErrorPolicy '%s' for '%s' must be \"keep-alive\", \"close\" or empty", service.ErrorPolicy[reason], reason))
+		}
+	}
+
+	policyNames := make([]string, 0, len(service.ChannelHostPolicy))
+	for name, _ := range service.ChannelHostPolicy {
+		policyNames = append(policyNames, name)
+	}
+	sort.Strings(policyNames)
+
+	for _, name := range policyNames {
+		if !isValidChannelName.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("ChannelHostPolicy channel name '%s' is not a valid channel name", name))
+		}
+		if service.ChannelHostPolicy[name] == "" {
+			problems = append(problems, fmt.Sprintf("ChannelHostPolicy channel '%s' must be pinned to a non-empty host", name))
+		}
+	}
+
+	optionNames := make([]string, 0, len(service.ChannelOptions))
+	for name, _ := range service.ChannelOptions {
+		optionNames = append(optionNames, name)
+	}
+	sort.Strings(optionNames)
+
+	for _, name := range optionNames {
+		if !isValidChannelName.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("ChannelOptions channel name '%s' is not a valid channel name", name))
+		}
+		if filter := service.ChannelOptions[name].DeliveryFilter; filter != "" {
+			if _, err := compileDeliveryFilter(filter); err != nil {
+				problems = append(problems, fmt.Sprintf("ChannelOptions of '%s': %v", name, err))
+			}
+		}
+		switch codec := service.ChannelOptions[name].EnforceCodec; codec {
+		case "", "json", "base64":
+		default:
+			problems = append(problems, fmt.Sprintf("ChannelOptions of '%s': EnforceCodec '%s' must be \"json\", \"base64\" or empty", name, codec))
+		}
+	}
+
+	if service.MulticastAddress != "" {
+		if ip := net.ParseIP(service.MulticastAddress); ip == nil || ip.To4() == nil || !ip.IsMulticast() {
+			problems = append(problems, fmt.Sprintf("MulticastAddress '%s' must be an IPv4 multicast address", service.MulticastAddress))
+		}
+	}
+
+	if service.MulticastPort < 0 || service.MulticastPort > 65535 {
+		problems = append(problems, fmt.Sprintf("MulticastPort %d must be between 0 and 65535", service.MulticastPort))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid service configuration: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
 func (service *Service) Start() <-chan int {
-	// Start HTTP/Network Web Socket creation server
-	service.StartHTTPServer()
+	// Identify this service instance now its RandomSource, if any, is set
+	service.instanceId = service.generateId()
+
+	// Start HTTP/Network Web Socket creation server (unless already
+	// started on a listener provided via .ListenWith())
+	if service.localListener == nil {
+		service.StartHTTPServer()
+	}
+
+	// Start passing delivered messages to the observer
+	if service.Observer != nil {
+		service.observations = make(chan *observation, service.ObserverBufferSize)
+		service.observerStop = make(chan bool)
+		go service.runObserver(service.observations, service.observerStop)
+	}
 
 	// Start TLS-SRP Network Web Socket (wss) proxy server
 	service.StartProxyServer()
 
+	// Create pre-registered channels now they can be advertised
+	for name, options := range service.preRegisteredChannels {
+		service.createPreRegisteredChannel(name, options)
+	}
+	service.preRegisteredChannels = make(map[string]ChannelOptions)
+
 	// Start mDNS/DNS-SD Network Web Socket discovery service
 	service.StartDiscoveryBrowser(10)
 
@@ -228,23 +803,77 @@ func (service *Service) Start() <-chan int {
 }
 
 func (service *Service) StartHTTPServer() {
+	// Listen and on loopback address + port
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", service.Port))
+	if err != nil {
+		log.Fatal("Could not serve web server. ", err)
+	}
+
+	if err := service.ListenWith(listener); err != nil {
+		log.Fatal("Could not serve web server. ", err)
+	}
+}
+
+// ListenWith serves the HTTP/Network Web Socket creation endpoints on the
+// provided listener instead of on localhost at the service's Port. The
+// service's Port is updated to the port the listener is bound to. Call
+// ListenWith before Start to use it in place of StartHTTPServer.
+func (service *Service) ListenWith(listener net.Listener) error {
+	// Obtain and store the port of the local endpoint
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return err
+	}
+
+	if service.Port, err = strconv.Atoi(port); err != nil {
+		return err
+	}
+
 	// Create a new custom http server multiplexer
 	serveMux := http.NewServeMux()
 
 	// Serve network web socket creation endpoints for localhost clients
-	serveMux.HandleFunc("/", service.Handler.ServeLocalRequest)
+	serveMux.Handle("/", service.withMiddleware(http.HandlerFunc(service.Handler.ServeLocalRequest)))
 
-	// Listen and on loopback address + port
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", service.Port))
+	service.localListener = &noDelayListener{listener, service.NoDelay}
+
+	log.Printf("Serving Network Web Socket Creator Proxy at address [ ws://localhost:%d/ ]", service.Port)
+
+	go http.Serve(service.localListener, serveMux)
+
+	return nil
+}
+
+// A net.Listener that sets TCP_NODELAY on the connections it accepts
+type noDelayListener struct {
+	net.Listener
+	noDelay bool
+}
+
+func (l *noDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
 	if err != nil {
-		log.Fatal("Could not serve web server. ", err)
+		return nil, err
 	}
 
-	service.localListener = listener
+	if tcpConn, ok := conn.(interface {
+		SetNoDelay(bool) error
+	}); ok {
+		if err := tcpConn.SetNoDelay(l.noDelay); err != nil {
+			log.Printf("err: %v", err)
+		}
+	}
 
-	log.Printf("Serving Network Web Socket Creator Proxy at address [ ws://localhost:%d/ ]", service.Port)
+	return conn, nil
+}
 
-	go http.Serve(listener, serveMux)
+// Addr returns the address the HTTP/Network Web Socket creation endpoints
+// are served on, or nil if they are not being served
+func (service *Service) Addr() net.Addr {
+	if service.localListener == nil {
+		return nil
+	}
+	return service.localListener.Addr()
 }
 
 func (service *Service) StartProxyServer() {
@@ -252,13 +881,13 @@ func (service *Service) StartProxyServer() {
 	serveMux := http.NewServeMux()
 
 	// Serve secure network web socket proxy endpoints for network clients
-	serveMux.HandleFunc("/", service.Handler.ServeProxyRequest)
+	serveMux.Handle("/", service.withMiddleware(http.HandlerFunc(service.Handler.ServeProxyRequest)))
 
 	// Generate random server salt for use in TLS-SRP data storage
 	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	b := make([]rune, 32)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		b[i] = letters[service.randomInt63()%int64(len(letters))]
 	}
 	srpSaltKey := string(b)
 
@@ -269,11 +898,13 @@ func (service *Service) StartProxyServer() {
 	}
 
 	// Listen on all addresses + port
-	tlsSrpListener, err := tls.Listen("tcp", ":0", tlsServerConfig)
+	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
 		log.Fatal("Could not serve proxy server. ", err)
 	}
 
+	tlsSrpListener := tls.NewListener(&noDelayListener{listener, service.NoDelay}, tlsServerConfig)
+
 	service.netListener = tlsSrpListener
 
 	// Obtain and store the port of the proxy endpoint
@@ -297,13 +928,55 @@ func (service *Service) StartDiscoveryBrowser(timeoutSeconds int) {
 
 		for !service.discoveryBrowser.closed {
 			service.discoveryBrowser.Browse(service, timeoutSeconds)
+			service.expireProxyServices(time.Now())
 		}
 	}()
 }
 
+// Return the error of the most recent discovery of other services on the
+// network, or nil if discovery is working
+func (service *Service) DiscoveryError() error {
+	if service.discoveryBrowser == nil {
+		return nil
+	}
+	return service.discoveryBrowser.Err()
+}
+
+// Return the number of broadcasts dropped for peers that could not be
+// written to before the broadcast's maximum age ("maxAge") passed, counting
+// broadcasts from other services that arrived too late once
+func (service *Service) DroppedLateBroadcasts() uint64 {
+	return atomic.LoadUint64(&service.lateBroadcastDrops)
+}
+
+// Return the time by which the deadline of broadcasts forwarded by other
+// services may have passed before they are dropped
+func (service *Service) clockSkewTolerance() time.Duration {
+	if service == nil || service.ClockSkewTolerance <= 0 {
+		return defaultClockSkewTolerance
+	}
+	return service.ClockSkewTolerance
+}
+
+// Return the semaphore limiting concurrent proxy connection dials, or nil
+// if they are not limited
+func (service *Service) federationDialSlots() chan bool {
+	if service == nil || service.MaxConcurrentFederationDials <= 0 {
+		return nil
+	}
+
+	service.federationDialsMu.Lock()
+	defer service.federationDialsMu.Unlock()
+
+	if service.federationDials == nil {
+		service.federationDials = make(chan bool, service.MaxConcurrentFederationDials)
+	}
+	return service.federationDials
+}
+
 // Check whether we know the given service name
 func (service *Service) GetChannelByName(serviceName string) *Channel {
-	for _, channel := range service.Channels {
+	for _, channel := range service.channelList() {
 		if channel.serviceName == serviceName {
 			return channel
 		}
@@ -311,9 +984,648 @@ func (service *Service) GetChannelByName(serviceName string) *Channel {
 	return nil
 }
 
+// Return a snapshot of the service's channels that is safe to iterate while
+// channels are added and removed
+func (service *Service) channelList() []*Channel {
+	service.channelsMu.RLock()
+	defer service.channelsMu.RUnlock()
+
+	channels := make([]*Channel, 0, len(service.Channels))
+	for _, channel := range service.Channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Register a channel that always exists with the given options, whether or
+// not any peers are connected to it. Pre-registered channels ignore
+// ChannelOptions and are created when the service is started, or
+// immediately if the service has already been started.
+func (service *Service) PreRegisterChannel(name string, options ChannelOptions) error {
+	if !isValidChannelName.MatchString(name) {
+		return fmt.Errorf("'%s' is not a valid channel name", name)
+	}
+
+	if service.GetChannelByName(name) != nil {
+		return fmt.Errorf("Channel '%s' already exists", name)
+	}
+
+	if _, ok := service.preRegisteredChannels[name]; ok {
+		return fmt.Errorf("Channel '%s' is already pre-registered", name)
+	}
+
+	// Channels can only be advertised once the proxy server is listening
+	if service.ProxyPort == 0 {
+		service.preRegisteredChannels[name] = options
+		return nil
+	}
+
+	service.createPreRegisteredChannel(name, options)
+
+	return nil
+}
+
+func (service *Service) createPreRegisteredChannel(name string, options ChannelOptions) {
+	channel := newChannelWithOptions(service, name, options)
+	channel.persistent = true
+}
+
+// Log every frame sent or received on the named channel, including on
+// channels created later with that name, for ChannelTraceDuration or until
+// DisableChannelTrace is called
+func (service *Service) EnableChannelTrace(name string) {
+	expiry := time.Now().Add(service.ChannelTraceDuration)
+
+	service.channelTracesMu.Lock()
+	service.channelTraces[name] = expiry
+	service.channelTracesMu.Unlock()
+
+	if channel := service.GetChannelByName(name); channel != nil {
+		channel.setTraceExpiry(expiry)
+	}
+}
+
+// Stop logging frames sent or received on the named channel
+func (service *Service) DisableChannelTrace(name string) {
+	service.channelTracesMu.Lock()
+	delete(service.channelTraces, name)
+	service.channelTracesMu.Unlock()
+
+	if channel := service.GetChannelByName(name); channel != nil {
+		channel.setTraceExpiry(time.Time{})
+	}
+}
+
+func (service *Service) channelTraceExpiry(name string) (time.Time, bool) {
+	service.channelTracesMu.Lock()
+	defer service.channelTracesMu.Unlock()
+
+	expiry, ok := service.channelTraces[name]
+	if ok && time.Now().After(expiry) {
+		delete(service.channelTraces, name)
+		return expiry, false
+	}
+	return expiry, ok
+}
+
+// Description of the current state of a channel managed by this service
+type ChannelSnapshot struct {
+	Name string
+
+	Peers   []ConnectionSnapshot
+	Proxies []ConnectionSnapshot
+
+	// Total number of messages queued for writing to the channel's connections
+	QueueDepth int
+
+	// Number of broadcasts accepted from local peers during the last second
+	BroadcastRate float64
+
+	// Number of running goroutines attributed to the channel (its
+	// dispatcher, connection pumps and broadcast writers)
+	Goroutines int
+}
+
+// Description of the current state of a peer or proxy connection
+type ConnectionSnapshot struct {
+	Id string
+
+	// Tags of peer connections
+	Tags []string
+
+	// Websocket subprotocol negotiated with the connection, if any
+	Subprotocol string
+
+	// Number of messages queued for writing to the connection
+	QueueDepth int
+
+	// Number of slow writes to the connection within the service's
+	// SlowWriteWindow
+	WriteStrikes int
+}
+
+// Return a snapshot of the current state of all channels
+func (service *Service) Snapshot() []ChannelSnapshot {
+	channels := service.channelList()
+	snapshots := make([]ChannelSnapshot, 0, len(channels))
+	for _, channel := range channels {
+		snapshots = append(snapshots, channel.snapshot())
+	}
+	return snapshots
+}
+
+// Return a snapshot of the current state of this channel
+func (channel *Channel) snapshot() ChannelSnapshot {
+	snapshot := ChannelSnapshot{
+		Name:          channel.serviceName,
+		Peers:         make([]ConnectionSnapshot, 0, len(channel.peers)),
+		Proxies:       make([]ConnectionSnapshot, 0, len(channel.proxies)),
+		BroadcastRate: channel.limiter.rate(time.Now()),
+		Goroutines:    channel.goroutineCount(),
+	}
+	for _, peer := range channel.peers {
+		depth := peer.transport.queueDepth()
+		snapshot.Peers = append(snapshot.Peers, ConnectionSnapshot{peer.id, peer.tags, peer.subprotocol, depth, peer.writeStrikes(time.Now())})
+		snapshot.QueueDepth += depth
+	}
+	for _, proxy := range channel.proxies {
+		depth := proxy.base.transport.queueDepth()
+		snapshot.Proxies = append(snapshot.Proxies, ConnectionSnapshot{proxy.base.id, nil, proxy.base.subprotocol, depth, 0})
+		snapshot.QueueDepth += depth
+	}
+	return snapshot
+}
+
+// Return the number of messages queued for writing across all of this
+// channel's peer and proxy connections
+func (channel *Channel) queueDepth() int {
+	depth := 0
+	for _, peer := range channel.peers {
+		depth += peer.transport.queueDepth()
+	}
+	for _, proxy := range channel.proxies {
+		depth += proxy.base.transport.queueDepth()
+	}
+	return depth
+}
+
+// Whether the total number of messages queued for writing across all
+// connections has reached the service's LoadSheddingHighWaterMark
+func (service *Service) isOverloaded() bool {
+	if service.LoadSheddingHighWaterMark <= 0 {
+		return false
+	}
+
+	depth := 0
+	for _, channel := range service.channelList() {
+		depth += channel.queueDepth()
+	}
+	return depth >= service.LoadSheddingHighWaterMark
+}
+
+// Return a snapshot of all active proxy connections across all channels
+func (service *Service) FederationLinks() []FederationLink {
+	links := make([]FederationLink, 0)
+	for _, channel := range service.channelList() {
+		for _, proxy := range channel.proxies {
+			links = append(links, FederationLink{
+				Host:      proxy.host,
+				Channel:   channel.serviceName,
+				Direction: proxy.direction(),
+			})
+		}
+	}
+	return links
+}
+
+// Classify the services discovered on the local network by whether they
+// federate the named channel with this service: services linked on the
+// channel with and without channel peers, services linked on other channels
+// only (reported without peers) and services advertising the channel that
+// could not be dialed. Only links dialed by this service are considered, as
+// the remote address of links accepted by this service does not identify
+// the remote service.
+func (service *Service) ChannelFederationCoverage(name string) (FederationCoverage, error) {
+	channel := service.GetChannelByName(name)
+	if channel == nil {
+		return FederationCoverage{}, fmt.Errorf("Channel '%s' could not be found", name)
+	}
+
+	coverage := FederationCoverage{
+		WithPeers:    make([]string, 0),
+		WithoutPeers: make([]string, 0),
+		Unreachable:  make([]string, 0),
+	}
+
+	classified := make(map[string]bool)
+	for _, proxy := range channel.proxies {
+		if proxy.writeable || classified[proxy.host] {
+			continue
+		}
+		classified[proxy.host] = true
+		if len(proxy.peerIds) > 0 {
+			coverage.WithPeers = append(coverage.WithPeers, proxy.host)
+		} else {
+			coverage.WithoutPeers = append(coverage.WithoutPeers, proxy.host)
+		}
+	}
+
+	for _, _channel := range service.channelList() {
+		for _, proxy := range _channel.proxies {
+			if !proxy.writeable && !classified[proxy.host] {
+				classified[proxy.host] = true
+				coverage.WithoutPeers = append(coverage.WithoutPeers, proxy.host)
+			}
+		}
+	}
+
+	channel.dialFailuresMu.Lock()
+	for host, _ := range channel.dialFailures {
+		if !classified[host] {
+			coverage.Unreachable = append(coverage.Unreachable, host)
+		}
+	}
+	channel.dialFailuresMu.Unlock()
+
+	sort.Strings(coverage.WithPeers)
+	sort.Strings(coverage.WithoutPeers)
+	sort.Strings(coverage.Unreachable)
+
+	return coverage, nil
+}
+
+// Return all messages currently waiting to be forwarded over proxy connections
+func (service *Service) PendingForwards() []PendingForward {
+	forwards := make([]PendingForward, 0)
+	for _, channel := range service.channelList() {
+		for _, proxy := range channel.proxies {
+			for _, message := range proxy.base.transport.queuedMessages() {
+				forwards = append(forwards, PendingForward{
+					Host:     proxy.host,
+					Channel:  channel.serviceName,
+					Data:     string(message.buf),
+					QueuedAt: message.queuedAt,
+				})
+			}
+		}
+	}
+	return forwards
+}
+
+// Discard all messages waiting to be forwarded over proxy connections to the
+// given remote host and return the number of messages discarded
+func (service *Service) CancelPendingForwards(host string) int {
+	cancelled := 0
+	for _, channel := range service.channelList() {
+		for _, proxy := range channel.proxies {
+			if proxy.host == host {
+				cancelled += proxy.base.transport.discardQueue()
+			}
+		}
+	}
+	return cancelled
+}
+
+// Close a local peer connection on the named channel with an application
+// close code in the range 4000-4999 and a reason
+func (service *Service) ClosePeer(channelName string, peerId string, code int, reason string) error {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	for _, peer := range channel.peers {
+		if peer.id == peerId {
+			return peer.Close(code, reason)
+		}
+	}
+
+	return fmt.Errorf("Peer '%s' could not be found in channel '%s'", peerId, channelName)
+}
+
+// Stop advertising the named channel on the network, so that services
+// starting up no longer discover and federate with it, while keeping its
+// existing proxy connections open
+func (service *Service) PauseAdvertisement(channelName string) error {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	if channel.discoveryService != nil {
+		channel.discoveryService.Shutdown()
+		channel.discoveryService = nil
+	}
+
+	return nil
+}
+
+// Advertise the named channel on the network again after a call to
+// PauseAdvertisement
+func (service *Service) ResumeAdvertisement(channelName string) error {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	channel.advertise(service.ProxyPort, service.generateId())
+
+	return nil
+}
+
+// Send a direct message from this service to a peer connection of the named
+// channel. Messages to peers connected to a federated service are
+// forwarded over the proxy connection that owns the peer. The message is
+// received without a source peer id.
+func (service *Service) SendMessage(channelName string, peerId string, data string) error {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	wireData, err := encodeWireMessage("message", "", peerId, data)
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range channel.peers {
+		if peer.id == peerId {
+			service.observe(channel.serviceName, "message", "", []string{peer.id}, data)
+			return peer.transport.Write(wireData)
+		}
+	}
+
+	if proxy := channel.routeTo(peerId, nil); proxy != nil {
+		return proxy.base.transport.Write(wireData)
+	}
+
+	return fmt.Errorf("Peer '%s' could not be found in channel '%s'", peerId, channelName)
+}
+
+// Ask all local peer connections of a channel to move to another channel by
+// sending them a 'migrate' message naming the new channel, and return the
+// number of peers asked. Migration is best-effort: peers reconnect to the
+// new channel themselves, keeping their peer id if they present the
+// message's token within migrationTimeout, and peers that ignore the
+// message stay connected to the old channel.
+func (service *Service) MigrateChannel(from string, to string) (int, error) {
+	if !isValidChannelName.MatchString(to) {
+		return 0, fmt.Errorf("'%s' is not a valid channel name", to)
+	}
+
+	channel := service.GetChannelByName(from)
+	if channel == nil {
+		return 0, fmt.Errorf("Channel '%s' could not be found", from)
+	}
+
+	migrated := 0
+	for _, peer := range channel.peers {
+		token := service.generateId()
+		if wireData, err := encodeCorrelatedWireMessage("migrate", peer.id, peer.id, to, token); err == nil {
+			service.migrationsMu.Lock()
+			service.migrations[token] = migration{peerId: peer.id, channel: to, expiry: time.Now().Add(migrationTimeout)}
+			service.migrationsMu.Unlock()
+
+			peer.transport.Write(wireData)
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// A peer asked to move to another channel by MigrateChannel
+type migration struct {
+	peerId  string
+	channel string
+	expiry  time.Time
+}
+
+// Return the peer id a connection to the named channel presenting a
+// migration token keeps, if the token was issued for the channel and has
+// not expired. Tokens can only be claimed once.
+func (service *Service) claimMigration(token string, channelName string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+
+	service.migrationsMu.Lock()
+	defer service.migrationsMu.Unlock()
+
+	now := time.Now()
+	for _token, migration := range service.migrations {
+		if now.After(migration.expiry) {
+			delete(service.migrations, _token)
+		}
+	}
+
+	migration, ok := service.migrations[token]
+	if !ok || migration.channel != channelName {
+		return "", false
+	}
+	delete(service.migrations, token)
+	return migration.peerId, true
+}
+
+// Send a request to all local peer connections of the named channel and
+// return the responses sent back by peers before the timeout elapses.
+// Responses received after the timeout are dropped.
+func (service *Service) ScatterGather(channelName string, payload string, timeout time.Duration) ([]WireMessage, error) {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return nil, fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	return channel.scatterGather(payload, timeout), nil
+}
+
+// Return all local peer connections, across all channels, that connected with the given tag
+func (service *Service) peersWithTag(tag string) []*Peer {
+	peers := make([]*Peer, 0)
+	for _, channel := range service.channelList() {
+		for _, peer := range channel.peers {
+			if peer.hasTag(tag) {
+				peers = append(peers, peer)
+			}
+		}
+	}
+	return peers
+}
+
+// Return the number of local peer connections that connected with the given tag
+func (service *Service) CountPeersWithTag(tag string) int {
+	return len(service.peersWithTag(tag))
+}
+
+// Send a broadcast message from this service to all local peer connections
+// that connected with the given tag and return the number of peers sent to
+func (service *Service) BroadcastToPeersWithTag(tag string, data string) int {
+	wireData, err := encodeWireMessage("broadcast", "", "", data)
+	if err != nil {
+		return 0
+	}
+
+	peers := service.peersWithTag(tag)
+	for _, peer := range peers {
+		peer.transport.Write(wireData)
+	}
+	return len(peers)
+}
+
+// Broadcast the same message on each of the named channels, to their local
+// peer connections and federated services, as if sent by the peer with the
+// given id (empty for no source peer). Channels are published to
+// independently: the returned map holds, by channel name, the error that
+// kept the message from being broadcast on a channel, or nil if it was
+// broadcast.
+func (service *Service) PublishMulti(channelNames []string, from string, data string) map[string]error {
+	results := make(map[string]error, len(channelNames))
+
+	for _, name := range channelNames {
+		channel := service.GetChannelByName(name)
+		if channel == nil {
+			results[name] = fmt.Errorf("Channel '%s' could not be found", name)
+			continue
+		}
+
+		wsBroadcast := &WireMessage{
+			Action:    "broadcast",
+			Source:    from,
+			Payload:   data,
+			fromProxy: false,
+		}
+		wsBroadcast.TraceParent = service.exportSpan("received", channel.serviceName, from, "", time.Now())
+
+		select {
+		case channel.broadcastBuffer <- wsBroadcast:
+			results[name] = nil
+		default:
+			results[name] = fmt.Errorf("Channel '%s' broadcast buffer is full. Message dropped", name)
+		}
+	}
+
+	return results
+}
+
+// Close all local peer connections that connected with the given tag with an
+// application close code in the range 4000-4999 and a reason, and return
+// the number of peers closed
+func (service *Service) ClosePeersWithTag(tag string, code int, reason string) (int, error) {
+	closed := 0
+	for _, peer := range service.peersWithTag(tag) {
+		if err := peer.Close(code, reason); err != nil {
+			return closed, err
+		}
+		closed++
+	}
+	return closed, nil
+}
+
+// HTTP method each admin route accepts: GET for reads and POST for actions
+var adminRouteMethods = map[string]string{
+	"/admin":                "GET",
+	"/admin/":               "GET",
+	"/admin/status":         "GET",
+	"/admin/cluster-status": "GET",
+	"/admin/metrics":        "GET",
+	"/admin/tap":            "POST",
+	"/admin/close":          "POST",
+}
+
+// Serve the admin page and the status data it displays, and admin actions
+func (service *Service) serveAdminRequest(w http.ResponseWriter, r *http.Request) {
+	method, ok := adminRouteMethods[r.URL.Path]
+	if !ok {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	if !checkRequestMethod(w, r, method) {
+		return
+	}
+	if !service.checkAdminToken(w, r) {
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin", "/admin/":
+		adminHTML, err := Asset("_templates/admin.html")
+		if err != nil {
+			// Asset was not found.
+			http.Error(w, "Not Found", 404)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(adminHTML)
+
+	case "/admin/status":
+		status := struct {
+			Channels        []ChannelSnapshot
+			FederationLinks []FederationLink
+		}{service.Snapshot(), service.FederationLinks()}
+
+		statusJSON, err := json.Marshal(status)
+		if err != nil {
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(statusJSON)
+
+	case "/admin/cluster-status":
+		statusJSON, err := json.Marshal(service.ClusterStatus(clusterStatusTimeout))
+		if err != nil {
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(statusJSON)
+
+	case "/admin/metrics":
+		metricsJSON, err := json.Marshal(service.ChannelMetrics())
+		if err != nil {
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(metricsJSON)
+
+	case "/admin/tap":
+		service.serveTapRequest(w, r)
+
+	case "/admin/close":
+		service.serveCloseRequest(w, r)
+	}
+}
+
+// Check the request presents the service's AdminToken, as a bearer token or
+// in a token query parameter (for opening the admin page in a browser),
+// otherwise respond with a 401 error
+func (service *Service) checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if service.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(service.AdminToken)) != 1 {
+		http.Error(w, "Unauthorized", 401)
+		return false
+	}
+	return true
+}
+
+// Serve POST /admin/close?channel=<name>&peer=<id>&code=<code>&reason=<reason>,
+// closing a local peer connection like ClosePeer
+func (service *Service) serveCloseRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	code, err := strconv.Atoi(query.Get("code"))
+	if err == nil {
+		err = checkCloseCode(code)
+	}
+	if err != nil {
+		http.Error(w, "Invalid close code", 400)
+		return
+	}
+
+	if err := service.ClosePeer(query.Get("channel"), query.Get("peer"), code, query.Get("reason")); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
 // Check whether a DNS-SD derived Network Web Socket hash is owned by the current proxy instance
 func (service *Service) isOwnProxyService(serviceRecord *DNSRecord) bool {
-	for _, channel := range service.Channels {
+	// Records advertised by this service, including those of channels it
+	// no longer has, that may still be cached on the network
+	if serviceRecord.ServiceInstance != "" && serviceRecord.ServiceInstance == service.instanceId {
+		return true
+	}
+
+	for _, channel := range service.channelList() {
 		if channel.serviceHash == serviceRecord.Hash_Base64 {
 			return true
 		}
@@ -323,7 +1635,7 @@ func (service *Service) isOwnProxyService(serviceRecord *DNSRecord) bool {
 
 // Check whether a DNS-SD derived Network Web Socket hash is currently connected as a service
 func (service *Service) isActiveProxyService(serviceRecord *DNSRecord) bool {
-	for _, channel := range service.Channels {
+	for _, channel := range service.channelList() {
 		for _, proxy := range channel.proxies {
 			if proxy.Hash_Base64 == serviceRecord.Hash_Base64 {
 				return true
@@ -333,6 +1645,53 @@ func (service *Service) isActiveProxyService(serviceRecord *DNSRecord) bool {
 	return false
 }
 
+// Record that the DNS-SD record of connected proxy services was seen again
+func (service *Service) refreshProxyService(serviceRecord *DNSRecord) {
+	now := time.Now().UnixNano()
+	for _, channel := range service.channelList() {
+		for _, proxy := range channel.proxies {
+			if proxy.Hash_Base64 == serviceRecord.Hash_Base64 {
+				atomic.StoreInt64(&proxy.lastSeen, now)
+			}
+		}
+	}
+}
+
+// Close proxy connections dialed to discovered services whose DNS-SD record
+// has not been seen for longer than the service's DiscoveryTTL, and forget
+// failed dials to services that have not been retried (and so were not
+// advertised) for as long
+func (service *Service) expireProxyServices(now time.Time) {
+	if service.DiscoveryTTL <= 0 {
+		return
+	}
+
+	expired := make([]*Proxy, 0)
+	for _, channel := range service.channelList() {
+		channel.dialFailuresMu.Lock()
+		for addr, failed := range channel.dialFailures {
+			if now.Sub(failed) > service.DiscoveryTTL {
+				delete(channel.dialFailures, addr)
+			}
+		}
+		channel.dialFailuresMu.Unlock()
+
+		for _, proxy := range channel.proxies {
+			if proxy.Hash_Base64 == "" {
+				continue
+			}
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&proxy.lastSeen))) > service.DiscoveryTTL {
+				expired = append(expired, proxy)
+			}
+		}
+	}
+
+	for _, proxy := range expired {
+		log.Printf("Proxy named web socket connection to %s expired: service no longer advertised", proxy.host)
+		proxy.Stop()
+	}
+}
+
 // Stop stops the server gracefully, and shuts down the running goroutine.
 // Stop should be called after a Start(s), otherwise it will block forever.
 func (service *Service) Stop() {
@@ -348,6 +1707,10 @@ func (service *Service) Stop() {
 		service.netListener.Close()
 	}
 
+	if service.observerStop != nil {
+		close(service.observerStop)
+	}
+
 	service.done <- 1
 }
 
@@ -374,6 +1737,21 @@ func (service *Service) checkRequestIsFromLocalHost(host string) bool {
 	return false
 }
 
+// Check the request method is one of the allowed methods, otherwise
+// respond with a 405 error listing the allowed methods
+func checkRequestMethod(w http.ResponseWriter, r *http.Request, allowedMethods ...string) bool {
+	for _, method := range allowedMethods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	http.Error(w, "Method Not Allowed", 405)
+
+	return false
+}
+
 /** Simple in-memory storage table for TLS-SRP usernames/passwords **/
 
 type CredentialsStore map[string]string
@@ -0,0 +1,54 @@
+package networkwebsockets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Return the query string ("expires=<unix time>&signature=<hmac>") of a
+// signed URL granting access to the named channel until expires, for use
+// with Service.URLSigningSecret
+func (service *Service) SignChannel(channelName string, expires time.Time) string {
+	expiresStr := strconv.FormatInt(expires.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expiresStr)
+	query.Set("signature", service.channelSignature(channelName, expiresStr))
+	return query.Encode()
+}
+
+// Return the hex encoded HMAC-SHA256 of a channel name and expiry time
+func (service *Service) channelSignature(channelName string, expires string) string {
+	mac := hmac.New(sha256.New, service.URLSigningSecret)
+	fmt.Fprintf(mac, "%s\n%s", channelName, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether a request to connect to the named channel carries an unexpired
+// signature, or the service does not require signed URLs
+func (service *Service) checkChannelSignature(channelName string, r *http.Request) bool {
+	if len(service.URLSigningSecret) == 0 {
+		return true
+	}
+
+	query := r.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return false
+	}
+
+	expected, _ := hex.DecodeString(service.channelSignature(channelName, query.Get("expires")))
+	return hmac.Equal(signature, expected)
+}
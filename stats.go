@@ -0,0 +1,154 @@
+package networkwebsockets
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of one second buckets kept for windowed statistics, bounding the
+// longest window Stats can aggregate over
+const statsBuckets = 3600
+
+// Aggregate statistics of a service over a time window, see Service.Stats
+type WindowStats struct {
+	// Length of the window the statistics cover
+	Window time.Duration
+
+	// Number of messages received from local peers during the window and
+	// their average rate per second
+	Messages          uint64
+	MessagesPerSecond float64
+
+	// Highest number of local peers connected at once during the window
+	PeakPeers int
+}
+
+// Counters of one second of service activity
+type statsBucket struct {
+	// Unix time of the second the bucket counts, older buckets are stale
+	second int64
+
+	messages   uint64
+	startPeers int
+	peakPeers  int
+}
+
+// Ring of per second activity counters, reused as time goes on
+type windowedStats struct {
+	// Number of buckets in the ring, statsBuckets if 0
+	length int
+
+	buckets []statsBucket
+	peers   int
+	mu      sync.Mutex
+}
+
+// Return the number of seconds the ring of buckets covers
+func (stats *windowedStats) size() int64 {
+	if stats.length > 0 {
+		return int64(stats.length)
+	}
+	return statsBuckets
+}
+
+// Return the bucket counting the second of now, resetting it if it last
+// counted an earlier second. Must be called with mu held.
+func (stats *windowedStats) bucket(now time.Time) *statsBucket {
+	if stats.buckets == nil {
+		stats.buckets = make([]statsBucket, stats.size())
+	}
+
+	second := now.Unix()
+	bucket := &stats.buckets[second%stats.size()]
+	if bucket.second != second {
+		*bucket = statsBucket{second: second, startPeers: stats.peers, peakPeers: stats.peers}
+	}
+	return bucket
+}
+
+// Count a message received from a local peer
+func (stats *windowedStats) recordMessage(now time.Time) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.bucket(now).messages++
+}
+
+// Count local peers connecting (delta > 0) or disconnecting (delta < 0)
+func (stats *windowedStats) recordPeers(now time.Time, delta int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	bucket := stats.bucket(now)
+	stats.peers += delta
+	if stats.peers > bucket.peakPeers {
+		bucket.peakPeers = stats.peers
+	}
+}
+
+// Aggregate the buckets of the window ending at now, which is rounded up to
+// whole seconds and limited to the seconds the ring covers
+func (stats *windowedStats) aggregate(now time.Time, window time.Duration) WindowStats {
+	seconds := int64((window + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	} else if seconds > stats.size() {
+		seconds = stats.size()
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	result := WindowStats{
+		Window:    time.Duration(seconds) * time.Second,
+		PeakPeers: stats.peers,
+	}
+
+	if stats.buckets != nil {
+		for second := now.Unix() - seconds + 1; second <= now.Unix(); second++ {
+			bucket := stats.buckets[second%stats.size()]
+			if bucket.second != second {
+				continue
+			}
+			result.Messages += bucket.messages
+			if bucket.peakPeers > result.PeakPeers {
+				result.PeakPeers = bucket.peakPeers
+			}
+		}
+	}
+
+	result.MessagesPerSecond = float64(result.Messages) / result.Window.Seconds()
+
+	return result
+}
+
+// Return the peak number of local peers in each second the ring covers,
+// oldest first and ending with the second of now
+func (stats *windowedStats) peakPeersSeries(now time.Time) []int {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	series := make([]int, stats.size())
+	// Walk back from now, seconds without a bucket ended with as many peers
+	// as the following second started with
+	peers := stats.peers
+	for i := len(series) - 1; i >= 0; i-- {
+		second := now.Unix() - int64(len(series)-1-i)
+		if stats.buckets != nil {
+			if bucket := stats.buckets[second%stats.size()]; bucket.second == second {
+				series[i] = bucket.peakPeers
+				peers = bucket.startPeers
+				continue
+			}
+		}
+		series[i] = peers
+	}
+	return series
+}
+
+// Return the number and rate of messages received from local peers and the
+// peak number of local peers over the last window (e.g. the last minute or
+// hour, at most statsBuckets seconds)
+func (service *Service) Stats(window time.Duration) WindowStats {
+	return service.stats.aggregate(time.Now(), window)
+}
@@ -0,0 +1,126 @@
+package networkwebsockets
+
+import (
+	"fmt"
+)
+
+// Number of events a channel subscription holds for its consumer before the
+// subscription is ended
+const subscriptionBufferSize = 512
+
+// A subscription to the presence and broadcasts of a channel, see
+// Service.SubscribeChannel
+type channelSubscription struct {
+	events chan WireMessage
+	closed bool
+}
+
+// Stream a consistent view of the named channel: first a "connect" message
+// for each peer currently in the channel (local or owned by federated
+// services), then a "snapshot" message marking the end of the snapshot and
+// then, as they happen, "connect" and "disconnect" messages for peers
+// joining and leaving and the "broadcast" messages delivered on the channel.
+// No change is missed, or included in both the snapshot and the live
+// events. Quiet peers are left out, as they are for the channel's peers.
+//
+// The returned channel of events is closed when the returned stop function
+// is called, when the channel is stopped or when the consumer falls more
+// than subscriptionBufferSize events behind, in which case it should
+// subscribe again for a new snapshot.
+func (service *Service) SubscribeChannel(channelName string) (<-chan WireMessage, func(), error) {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return nil, nil, fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	subscription := &channelSubscription{events: make(chan WireMessage, subscriptionBufferSize)}
+
+	channel.subscriptionsMu.Lock()
+	defer channel.subscriptionsMu.Unlock()
+
+	seen := make(map[string]bool)
+	snapshot := func(peerId string) {
+		if !seen[peerId] {
+			seen[peerId] = true
+			channel.notify(subscription, WireMessage{Action: "connect", Target: peerId})
+		}
+	}
+	for _, peer := range channel.peers {
+		if !peer.quiet {
+			snapshot(peer.id)
+		}
+	}
+	for _, proxy := range channel.proxies {
+		for peerId, _ := range proxy.peerIds {
+			snapshot(peerId)
+		}
+	}
+	channel.notify(subscription, WireMessage{Action: "snapshot"})
+
+	channel.subscriptions = append(channel.subscriptions, subscription)
+
+	stop := func() {
+		channel.subscriptionsMu.Lock()
+		channel.unsubscribe(subscription)
+		channel.subscriptionsMu.Unlock()
+	}
+
+	return subscription.events, stop, nil
+}
+
+// Apply a change to the channel's presence and pass the resulting event to
+// all of the channel's subscriptions, so that subscribing sees the channel
+// either before or after the change
+func (channel *Channel) publish(change func(), event WireMessage) {
+	channel.subscriptionsMu.Lock()
+	defer channel.subscriptionsMu.Unlock()
+
+	if change != nil {
+		change()
+	}
+
+	// Subscriptions that have fallen behind are removed while notifying
+	subscriptions := append([]*channelSubscription(nil), channel.subscriptions...)
+	for _, subscription := range subscriptions {
+		channel.notify(subscription, event)
+	}
+}
+
+// Pass an event to a subscription, ending the subscription if its consumer
+// has fallen too far behind. Must be called with subscriptionsMu held.
+func (channel *Channel) notify(subscription *channelSubscription, event WireMessage) {
+	if subscription.closed {
+		return
+	}
+
+	select {
+	case subscription.events <- event:
+	default:
+		channel.unsubscribe(subscription)
+	}
+}
+
+// End a subscription. Must be called with subscriptionsMu held.
+func (channel *Channel) unsubscribe(subscription *channelSubscription) {
+	for i, _subscription := range channel.subscriptions {
+		if _subscription == subscription {
+			channel.subscriptions = append(channel.subscriptions[:i], channel.subscriptions[i+1:]...)
+			break
+		}
+	}
+
+	if !subscription.closed {
+		subscription.closed = true
+		close(subscription.events)
+	}
+}
+
+// End all subscriptions of the channel
+func (channel *Channel) unsubscribeAll() {
+	channel.subscriptionsMu.Lock()
+	defer channel.subscriptionsMu.Unlock()
+
+	for len(channel.subscriptions) > 0 {
+		channel.unsubscribe(channel.subscriptions[0])
+	}
+}
@@ -0,0 +1,166 @@
+package networkwebsockets
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Behavior of synthetic peers, see Service.SpawnSyntheticPeers
+type SyntheticPeerConfig struct {
+	// Number of messages per second each synthetic peer consumes (0 = as
+	// fast as they are written). Messages arriving faster queue up like
+	// they do for a slow client.
+	ConsumeRate float64
+
+	// Number of broadcasts per second each synthetic peer publishes (0 =
+	// none)
+	PublishRate float64
+
+	// Data of the broadcasts synthetic peers publish
+	Payload string
+}
+
+// A group of synthetic peers connected to a channel
+type SyntheticPeers struct {
+	peers []*Peer
+
+	// Broadcasts received by and sent by all peers of the group (including
+	// broadcasts the channel rejected), accessed atomically
+	received  uint64
+	published uint64
+
+	stop     chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Message handler of a synthetic peer, consuming the messages written to it
+type syntheticMessageHandler struct {
+	peers *SyntheticPeers
+
+	// Time to spend consuming each message
+	interval time.Duration
+}
+
+func (handler *syntheticMessageHandler) Read(buf []byte) error { return nil }
+
+func (handler *syntheticMessageHandler) Write(buf []byte) error {
+	if handler.interval > 0 {
+		time.Sleep(handler.interval)
+	}
+
+	if message, err := decodeWireMessage(buf); err == nil && message.Action == "broadcast" {
+		atomic.AddUint64(&handler.peers.received, 1)
+	}
+
+	return nil
+}
+
+// Connect count synthetic peers to the named channel, creating the channel
+// if needed, for load testing a service from within its process. Synthetic
+// peers have no websocket connection but otherwise take part in the
+// channel like other peers: they are announced to and included in the
+// presence of the channel, receive its broadcasts (at the configured rate)
+// and publish broadcasts of their own (at the configured rate, subject to
+// the channel's limits). Stop the returned group to disconnect them.
+func (service *Service) SpawnSyntheticPeers(channelName string, count int, config SyntheticPeerConfig) (*SyntheticPeers, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("Synthetic peer count %d must be positive", count)
+	}
+
+	if config.ConsumeRate < 0 || config.PublishRate < 0 {
+		return nil, errors.New("Synthetic peer ConsumeRate and PublishRate must not be negative")
+	}
+
+	if !isValidCreateRequest.MatchString("/" + channelName) {
+		return nil, fmt.Errorf("Channel name '%s' is not valid", channelName)
+	}
+
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		channel = NewChannel(service, channelName)
+	}
+
+	peers := &SyntheticPeers{
+		peers: make([]*Peer, 0, count),
+		stop:  make(chan bool),
+	}
+
+	handler := &syntheticMessageHandler{peers: peers}
+	if config.ConsumeRate > 0 {
+		handler.interval = time.Duration(float64(time.Second) / config.ConsumeRate)
+	}
+
+	for i := 0; i < count; i++ {
+		peer := &Peer{
+			id:        service.generateId(),
+			transport: NewTransport(nil, handler),
+		}
+		if err := peer.Start(channel); err != nil {
+			peers.Stop()
+			return nil, err
+		}
+		peers.peers = append(peers.peers, peer)
+
+		if config.PublishRate > 0 {
+			peers.wg.Add(1)
+			go peers.publish(peer, config)
+		}
+	}
+
+	return peers, nil
+}
+
+// Publish broadcasts from a synthetic peer until the group is stopped
+func (peers *SyntheticPeers) publish(peer *Peer, config SyntheticPeerConfig) {
+	defer peers.wg.Done()
+
+	wireData, err := encodeWireMessage("broadcast", "", "", config.Payload)
+	if err != nil {
+		return
+	}
+
+	handler := &PeerMessageHandler{peer}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / config.PublishRate))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := handler.Read(wireData); err == nil {
+				atomic.AddUint64(&peers.published, 1)
+			}
+		case <-peers.stop:
+			return
+		}
+	}
+}
+
+// Return the number of broadcasts the group's peers have consumed
+func (peers *SyntheticPeers) Received() uint64 {
+	return atomic.LoadUint64(&peers.received)
+}
+
+// Return the number of broadcasts the group's peers have sent, including
+// broadcasts rejected by the channel's limits
+func (peers *SyntheticPeers) Published() uint64 {
+	return atomic.LoadUint64(&peers.published)
+}
+
+// Disconnect all peers of the group
+func (peers *SyntheticPeers) Stop() {
+	peers.stopOnce.Do(func() {
+		close(peers.stop)
+		peers.wg.Wait()
+
+		for _, peer := range peers.peers {
+			if peer.active {
+				peer.Stop()
+			}
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package networkwebsockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Number of frames a tap holds for its observer before dropping frames
+const tapBufferSize = 255
+
+// Duration of taps requested from /admin/tap without a duration
+const defaultTapDuration = time.Minute
+
+// A copy of a frame sent to or received from a tapped peer
+type TappedFrame struct {
+	// "inbound" (received from the peer) or "outbound" (sent to the peer)
+	Direction string
+
+	Data string
+
+	Time time.Time
+}
+
+// A tap on a peer's traffic, see Service.TapPeer
+type peerTap struct {
+	frames chan TappedFrame
+	timer  *time.Timer
+	closed bool
+	mu     sync.Mutex
+}
+
+// Stream copies of all frames sent to and received from a local peer
+// connection of the named channel, without altering their delivery. The
+// returned channel of frames is closed when the tap expires after the given
+// duration, when the returned stop function is called or when the peer
+// disconnects. Frames are dropped while the channel is full, so a slow
+// observer never delays the peer. Tapping a peer replaces any earlier tap
+// on it.
+func (service *Service) TapPeer(channelName string, peerId string, duration time.Duration) (<-chan TappedFrame, func(), error) {
+	channel := service.GetChannelByName(channelName)
+	if channel == nil {
+		return nil, nil, fmt.Errorf("Channel '%s' could not be found", channelName)
+	}
+
+	for _, peer := range channel.peers {
+		if peer.id == peerId {
+			tap := &peerTap{frames: make(chan TappedFrame, tapBufferSize)}
+			stop := func() { peer.untap(tap) }
+
+			// Hold the lock so the tap cannot expire before its timer is set
+			tap.mu.Lock()
+			tap.timer = time.AfterFunc(duration, stop)
+			tap.mu.Unlock()
+
+			if previous, ok := peer.tapped.Swap(tap).(*peerTap); ok && previous != nil {
+				previous.close()
+			}
+
+			return tap.frames, stop, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("Peer '%s' could not be found in channel '%s'", peerId, channelName)
+}
+
+// Pass a copy of a frame to this peer's tap, if it is tapped
+func (peer *Peer) tapFrame(direction string, buf []byte) {
+	tap, _ := peer.tapped.Load().(*peerTap)
+	if tap == nil {
+		return
+	}
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if tap.closed {
+		return
+	}
+	select {
+	case tap.frames <- TappedFrame{direction, string(buf), time.Now()}:
+	default:
+	}
+}
+
+// Remove the given tap from this peer, if it is still tapped by it, and
+// close the tap
+func (peer *Peer) untap(tap *peerTap) {
+	peer.tapped.CompareAndSwap(tap, (*peerTap)(nil))
+	tap.close()
+}
+
+func (tap *peerTap) close() {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if tap.closed {
+		return
+	}
+	tap.closed = true
+	tap.timer.Stop()
+	close(tap.frames)
+}
+
+// Serve POST /admin/tap?channel=<name>&peer=<id>&duration=<duration>, streaming
+// the tapped frames of a peer as newline-delimited JSON until the tap
+// expires or the request is closed
+func (service *Service) serveTapRequest(w http.ResponseWriter, r *http.Request) {
+	duration := defaultTapDuration
+	if value := r.URL.Query().Get("duration"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid tap duration", 400)
+			return
+		}
+		duration = parsed
+	}
+
+	frames, stop, err := service.TapPeer(r.URL.Query().Get("channel"), r.URL.Query().Get("peer"), duration)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(frame); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
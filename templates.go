@@ -25,6 +25,108 @@ func bindata_read(data []byte, name string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+func templates_admin_html() ([]byte, error) {
+	return bindata_read([]byte{
+		0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x03, 0xa5, 0x56,
+		0x5b, 0x53, 0xe3, 0x36, 0x14, 0x7e, 0x4e, 0x7e, 0x85, 0x6a, 0x66, 0x76,
+		0xec, 0x12, 0x6c, 0xa0, 0x2f, 0x4c, 0x2e, 0x74, 0x76, 0x81, 0x2d, 0x74,
+		0x28, 0xbb, 0x5d, 0xd2, 0x69, 0x3b, 0x99, 0x74, 0x46, 0x58, 0x27, 0xb1,
+		0xc0, 0xb6, 0x5c, 0x49, 0x21, 0xd0, 0x5d, 0xfe, 0x7b, 0xcf, 0x91, 0xe4,
+		0x24, 0x50, 0xa0, 0x9d, 0xed, 0x4b, 0xa2, 0xcb, 0xb9, 0x7c, 0xe7, 0x3b,
+		0x17, 0x79, 0xf8, 0xcd, 0xf1, 0x87, 0xa3, 0xf1, 0xef, 0x1f, 0x4f, 0x58,
+		0x61, 0xab, 0xf2, 0xb0, 0x3b, 0x6c, 0xff, 0x80, 0x8b, 0xc3, 0x6e, 0x67,
+		0x68, 0xa5, 0x2d, 0xe1, 0xf0, 0x02, 0xec, 0x52, 0xe9, 0x1b, 0xf6, 0x2b,
+		0x5c, 0xb1, 0x4b, 0x95, 0xdf, 0x80, 0x35, 0xec, 0xad, 0xa8, 0x64, 0x3d,
+		0xcc, 0xbc, 0x40, 0x17, 0x45, 0x8d, 0xbd, 0xa7, 0x55, 0xe7, 0x4a, 0x89,
+		0x7b, 0xf6, 0x99, 0xcd, 0x54, 0x6d, 0x77, 0x66, 0xbc, 0x92, 0xe5, 0x7d,
+		0x9f, 0x19, 0x5e, 0x9b, 0x1d, 0x03, 0x5a, 0xce, 0x06, 0xac, 0xe2, 0x7a,
+		0x2e, 0xeb, 0x3e, 0xdb, 0x87, 0x6a, 0xc0, 0x1e, 0xba, 0x1d, 0xcb, 0xaf,
+		0x4a, 0x40, 0x85, 0x2b, 0xa5, 0x05, 0xe8, 0x9d, 0x5c, 0x95, 0x25, 0x6f,
+		0x0c, 0xf4, 0x59, 0xbb, 0x6a, 0x55, 0x76, 0xae, 0x94, 0xb5, 0xaa, 0xda,
+		0xd0, 0x2c, 0x7a, 0xcc, 0x8a, 0x95, 0x6a, 0x9f, 0xed, 0x35, 0x77, 0xcc,
+		0xa8, 0x52, 0x0a, 0xb6, 0x95, 0xe7, 0xf9, 0x80, 0x35, 0x5c, 0x08, 0x59,
+		0xcf, 0xfb, 0x6c, 0x37, 0xfd, 0x0e, 0x2a, 0xfc, 0x3d, 0x20, 0x4d, 0x0b,
+		0x77, 0x76, 0x87, 0x97, 0x72, 0x8e, 0x20, 0x4a, 0x98, 0xd9, 0x60, 0x8b,
+		0xec, 0xf0, 0xfc, 0x66, 0xae, 0xd5, 0xa2, 0x16, 0x7d, 0xb6, 0x05, 0x00,
+		0xee, 0x66, 0x6b, 0xd1, 0x08, 0x6e, 0x81, 0xfc, 0x20, 0x22, 0x85, 0x6e,
+		0xb6, 0x0e, 0x0e, 0x0e, 0xdc, 0xd5, 0x30, 0x0b, 0x41, 0x0f, 0x33, 0x4f,
+		0xd8, 0x90, 0x82, 0x27, 0xde, 0x8a, 0xbd, 0xd7, 0x48, 0xc3, 0x5b, 0x62,
+		0xac, 0xd8, 0x3f, 0x3c, 0x2a, 0x78, 0x5d, 0x43, 0x69, 0xf0, 0x6c, 0xdf,
+		0xf1, 0x4d, 0x64, 0xe0, 0x02, 0x57, 0x21, 0x05, 0xb4, 0xd4, 0x87, 0xb8,
+		0x6d, 0x65, 0x91, 0xf3, 0xc2, 0xed, 0x3f, 0x02, 0x68, 0xb3, 0xde, 0x69,
+		0x75, 0x27, 0x61, 0xbd, 0xff, 0x79, 0x01, 0x0b, 0x04, 0x5d, 0x81, 0x31,
+		0x7c, 0xde, 0x9e, 0x67, 0x68, 0x8a, 0x8c, 0x67, 0x2b, 0xeb, 0x43, 0xeb,
+		0xf2, 0x25, 0xc5, 0x28, 0xca, 0x03, 0x96, 0x88, 0xe4, 0xda, 0x40, 0xb2,
+		0x80, 0xc8, 0xc3, 0x0d, 0x2e, 0xbf, 0x0e, 0xeb, 0x6a, 0x33, 0xe6, 0xf3,
+		0xff, 0x83, 0xb3, 0x21, 0x10, 0xaf, 0x80, 0x7c, 0x0f, 0x58, 0x0c, 0xdc,
+		0x4a, 0x55, 0xb3, 0x52, 0xd6, 0x37, 0x5f, 0x85, 0xf7, 0x54, 0x19, 0xbb,
+		0xda, 0x1c, 0x4b, 0x0d, 0x39, 0xd9, 0xfb, 0x0f, 0xe0, 0x9c, 0xc7, 0x97,
+		0xc0, 0x35, 0x4e, 0x24, 0xd4, 0x13, 0x09, 0x35, 0xbe, 0x73, 0x72, 0x2d,
+		0x1b, 0x8b, 0xb2, 0xf1, 0x6c, 0x51, 0x3b, 0x47, 0x71, 0xc2, 0x3e, 0xe3,
+		0x4d, 0xbb, 0x65, 0x5a, 0x2d, 0xe3, 0x1c, 0xca, 0xd2, 0xd0, 0x79, 0xa7,
+		0x73, 0xcb, 0x35, 0xb3, 0x9a, 0x8d, 0x98, 0x50, 0xf9, 0xa2, 0x82, 0xda,
+		0xa6, 0xb9, 0x06, 0xb4, 0x79, 0x52, 0x02, 0xed, 0xe2, 0xc8, 0xea, 0x28,
+		0x19, 0xa0, 0xe0, 0x4c, 0x69, 0x16, 0x93, 0xb4, 0x44, 0xe1, 0xdd, 0x01,
+		0xfe, 0x0d, 0x99, 0xb3, 0x93, 0x96, 0x50, 0xcf, 0x6d, 0x81, 0x27, 0xdb,
+		0xdb, 0xde, 0xa6, 0x37, 0x2a, 0x5e, 0x33, 0x2a, 0xbc, 0xd1, 0x8e, 0x15,
+		0x29, 0xf5, 0xd0, 0x11, 0x76, 0x38, 0x5e, 0xa0, 0x86, 0x33, 0x39, 0x91,
+		0x53, 0x7f, 0xab, 0x53, 0xde, 0x34, 0x50, 0x8b, 0xa3, 0x42, 0x96, 0x22,
+		0xb6, 0xc2, 0x29, 0x61, 0xb7, 0x74, 0x34, 0xd8, 0x85, 0xae, 0x11, 0x39,
+		0x1e, 0x3c, 0x6c, 0x86, 0x37, 0x93, 0x65, 0x19, 0x4b, 0xd1, 0xa3, 0x38,
+		0x37, 0x43, 0x74, 0xac, 0x6e, 0x00, 0x9a, 0x83, 0x0d, 0x68, 0xde, 0xdd,
+		0x9f, 0x09, 0xd4, 0x70, 0xa6, 0x97, 0xe8, 0x07, 0x58, 0xec, 0xa4, 0xd3,
+		0x99, 0xd4, 0xc6, 0x3a, 0xcf, 0x21, 0x2c, 0x7f, 0xac, 0xa1, 0x52, 0xb7,
+		0x10, 0x10, 0x3d, 0x15, 0x6c, 0xf1, 0x3d, 0xc7, 0x16, 0x21, 0x7a, 0x86,
+		0x2c, 0x6f, 0x63, 0x33, 0x4e, 0x4a, 0x11, 0x09, 0x23, 0x0d, 0x49, 0x6b,
+		0xf1, 0x51, 0x90, 0x1a, 0x45, 0x41, 0xc7, 0xc6, 0x72, 0xbb, 0xd8, 0x08,
+		0xb2, 0xed, 0x3a, 0x74, 0x39, 0x99, 0xf6, 0x98, 0x2b, 0xee, 0xb0, 0x76,
+		0xb5, 0xe4, 0xd6, 0x83, 0xee, 0x0b, 0xf0, 0xbc, 0xb5, 0xb4, 0x1d, 0x23,
+		0x2f, 0xa4, 0x35, 0xf8, 0x40, 0xb5, 0x27, 0xf2, 0x6d, 0xce, 0x5a, 0x10,
+		0x69, 0xb3, 0x30, 0x45, 0x3c, 0x09, 0xdb, 0xf4, 0x82, 0x57, 0xd0, 0x6b,
+		0xb5, 0x53, 0xd7, 0xfc, 0xc1, 0xc3, 0xc6, 0xa9, 0x9f, 0x3b, 0xff, 0x38,
+		0x77, 0x7d, 0x7d, 0x0c, 0x8d, 0x2d, 0xa6, 0x89, 0x83, 0xbf, 0xc6, 0x7f,
+		0xed, 0xf1, 0x5f, 0x53, 0x31, 0x3e, 0x63, 0x1b, 0x6f, 0x56, 0xe8, 0x1d,
+		0x7c, 0xe2, 0x84, 0xaa, 0x6c, 0x53, 0x76, 0x72, 0xed, 0x91, 0x77, 0x1c,
+		0x61, 0xcf, 0xe2, 0xa6, 0x9b, 0xf4, 0x0c, 0xab, 0x2a, 0x76, 0x2b, 0x9a,
+		0x3a, 0xec, 0xcb, 0x17, 0x64, 0x33, 0x49, 0xaf, 0x95, 0xac, 0xe3, 0xa8,
+		0xc7, 0xa2, 0x24, 0x88, 0x3d, 0x46, 0xdb, 0xf1, 0xf5, 0xf0, 0xf0, 0x2f,
+		0xac, 0xaf, 0x07, 0xcd, 0x39, 0x65, 0xea, 0x05, 0xf2, 0x29, 0x8b, 0x6b,
+		0xe6, 0x9f, 0xe8, 0xb4, 0x09, 0x70, 0xa9, 0x0e, 0x51, 0xd0, 0xba, 0xcd,
+		0x90, 0x2f, 0x82, 0x94, 0xc6, 0x51, 0x58, 0xae, 0x86, 0xd1, 0x34, 0x54,
+		0x19, 0x61, 0xa4, 0xfe, 0x59, 0xcf, 0xef, 0x55, 0x12, 0x8c, 0x1f, 0x02,
+		0xee, 0xd6, 0x4f, 0xcd, 0x50, 0x60, 0x1b, 0xe7, 0x7e, 0x60, 0x85, 0x62,
+		0xf3, 0x99, 0x7a, 0xa9, 0xdf, 0x56, 0x93, 0x2b, 0x79, 0xd2, 0xff, 0xd1,
+		0x39, 0x37, 0x96, 0xb5, 0xef, 0x64, 0xc4, 0xb6, 0x59, 0x0d, 0x4b, 0x76,
+		0x8c, 0xbb, 0x18, 0x45, 0xd5, 0xb9, 0xca, 0x79, 0x09, 0x63, 0x59, 0xc1,
+		0xa5, 0xd5, 0xf8, 0x1e, 0xc7, 0x49, 0x18, 0x00, 0x59, 0xc6, 0xc6, 0xea,
+		0x06, 0x70, 0x24, 0x14, 0xc0, 0x38, 0xbd, 0x8d, 0xf8, 0x64, 0xcf, 0x81,
+		0x2d, 0xb9, 0x61, 0x0a, 0x5b, 0x0b, 0x8d, 0x2d, 0x25, 0x15, 0x55, 0xa3,
+		0xc1, 0xa0, 0x2b, 0xdc, 0x5b, 0xe5, 0x84, 0x3d, 0x9b, 0x0c, 0x5b, 0xaa,
+		0xc1, 0x54, 0xda, 0xae, 0x9f, 0x17, 0xce, 0xd6, 0x88, 0xc5, 0x25, 0x3a,
+		0x24, 0x8a, 0x52, 0x03, 0x5c, 0xe7, 0x45, 0x5a, 0x71, 0x9b, 0x17, 0x71,
+		0x36, 0xf9, 0xfe, 0xcd, 0xd4, 0xc9, 0x8c, 0xe2, 0xc9, 0x1f, 0x6f, 0xa6,
+		0xdf, 0x26, 0x59, 0x12, 0x0a, 0x62, 0xb2, 0xe7, 0x5a, 0x6c, 0xd5, 0xab,
+		0x3e, 0x94, 0x78, 0xdd, 0xa5, 0x77, 0x05, 0x55, 0x20, 0x45, 0xf5, 0xdb,
+		0x4f, 0xe7, 0xa7, 0xd6, 0x36, 0x9f, 0xe0, 0xcf, 0x05, 0x18, 0xeb, 0x42,
+		0xe9, 0xe0, 0x6d, 0x4a, 0x78, 0xe3, 0xe8, 0x87, 0x93, 0x31, 0x95, 0x55,
+		0xe6, 0x82, 0xc9, 0x3c, 0xca, 0x68, 0x25, 0x63, 0xc0, 0x06, 0xbd, 0x53,
+		0x7c, 0x39, 0x70, 0x18, 0x44, 0x6f, 0x17, 0xb6, 0x50, 0x5a, 0xfe, 0xe5,
+		0xe0, 0x92, 0xe6, 0x3b, 0x44, 0x8c, 0xd5, 0x4e, 0x1c, 0x0a, 0xc8, 0x95,
+		0x80, 0x5f, 0x3e, 0x9d, 0x1d, 0xa9, 0xaa, 0x51, 0x35, 0xcd, 0x60, 0x1f,
+		0x21, 0x62, 0x8e, 0xa2, 0x64, 0xed, 0xb9, 0x2e, 0x15, 0xa7, 0xc1, 0xfd,
+		0xe8, 0xf5, 0xc0, 0xa2, 0x92, 0x33, 0x16, 0x3b, 0xb7, 0x9e, 0xac, 0xd1,
+		0x88, 0xed, 0xef, 0xee, 0xb6, 0x8d, 0x15, 0xc6, 0xd1, 0x8f, 0x97, 0x1f,
+		0x2e, 0xd2, 0x86, 0x6b, 0x03, 0x4e, 0x14, 0x79, 0x46, 0x57, 0x06, 0xc6,
+		0x98, 0xdf, 0x64, 0xa3, 0x13, 0xd6, 0x11, 0xd4, 0x62, 0x95, 0xbe, 0x96,
+		0x25, 0xdc, 0x62, 0x64, 0x67, 0x98, 0x1f, 0x7d, 0xcb, 0xcb, 0xd8, 0x1f,
+		0xf7, 0xd8, 0xde, 0x2e, 0x7a, 0x23, 0x5a, 0x1f, 0x12, 0x27, 0x83, 0x5f,
+		0x4b, 0xe1, 0xa1, 0x1b, 0x66, 0xfe, 0x71, 0xc4, 0x97, 0xd9, 0x7d, 0x6e,
+		0xfe, 0x0d, 0x04, 0x35, 0xac, 0xe0, 0x86, 0x0a, 0x00, 0x00,
+	},
+		"_templates/admin.html",
+	)
+}
+
 func templates_console_html() ([]byte, error) {
 	return bindata_read([]byte{
 		0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x00, 0xff, 0xec, 0x5c,
@@ -418,5 +520,6 @@ func AssetNames() []string {
 
 // _bindata is a table, holding each asset generator, mapped to its name.
 var _bindata = map[string]func() ([]byte, error){
+	"_templates/admin.html":   templates_admin_html,
 	"_templates/console.html": templates_console_html,
 }
@@ -0,0 +1,96 @@
+package networkwebsockets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A stage of a broadcast's journey through a service, passed to the
+// service's SpanExporter. The spans of a broadcast on every federated
+// service share its TraceId and link to each other through ParentId.
+type Span struct {
+	// Hex encoded 16 byte trace id and 8 byte span ids, as in W3C Trace Context
+	TraceId  string
+	SpanId   string
+	ParentId string // empty for the span a broadcast's trace starts with
+
+	// "received" (from a peer or proxy), "routed" (to local peers),
+	// "delivered" (to local peers) or "forwarded" (to a proxy)
+	Name string
+
+	Channel string
+
+	// Id of the peer the broadcast was sent by
+	Source string
+
+	Start time.Time
+	End   time.Time
+}
+
+// SpanExporter is passed the spans of every broadcast received by a service,
+// e.g. to export them to a tracing backend such as OpenTelemetry.
+// ExportSpan is called from the goroutines delivering broadcasts, so it must
+// not block.
+type SpanExporter interface {
+	ExportSpan(span Span)
+}
+
+// Export a span of a broadcast as a child of the span identified by the
+// given traceparent, or as the first span of a new trace if parent is empty
+// or invalid. Returns the traceparent identifying the new span, to be
+// propagated to the broadcast's next stages, or "" if the service has no
+// SpanExporter.
+func (service *Service) exportSpan(name, channel, source, parent string, start time.Time) string {
+	if service == nil || service.SpanExporter == nil {
+		return ""
+	}
+
+	traceId, parentId := parseTraceParent(parent)
+	if traceId == "" {
+		traceId = service.randomHex(16)
+	}
+
+	span := Span{
+		TraceId:  traceId,
+		SpanId:   service.randomHex(8),
+		ParentId: parentId,
+		Name:     name,
+		Channel:  channel,
+		Source:   source,
+		Start:    start,
+		End:      time.Now(),
+	}
+	service.SpanExporter.ExportSpan(span)
+
+	return fmt.Sprintf("00-%s-%s-01", span.TraceId, span.SpanId)
+}
+
+// Return the trace and span ids of a W3C traceparent ("00-<trace id>-<span id>-<flags>"),
+// or empty strings if it is not valid
+func parseTraceParent(traceParent string) (traceId, spanId string) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", ""
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+// Return size random bytes, hex encoded, from the service's RandomSource if
+// set, or from crypto/rand otherwise
+func (service *Service) randomHex(size int) string {
+	b := make([]byte, size)
+	if service.RandomSource == nil {
+		rand.Read(b)
+	} else {
+		for i := range b {
+			b[i] = byte(service.randomInt63())
+		}
+	}
+	return hex.EncodeToString(b)
+}
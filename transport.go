@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	tls "github.com/richtr/go-tls-srp"
@@ -25,6 +26,40 @@ const (
 
 	// Maximum message size allowed from any websocket.
 	maxMessageSize = 8192
+
+	// Time allowed for a websocket to respond to a close frame before its
+	// connection is closed anyway.
+	defaultCloseGracePeriod = 5 * time.Second
+
+	// Time peers asked to move to another channel have to reconnect to it
+	// and keep their peer id (see MigrateChannel)
+	migrationTimeout = 30 * time.Second
+
+	// Application close code of peer connections replaced by a new
+	// connection of the same client instance.
+	replacedCloseCode = 4000
+
+	// Application close code of peer connections closed for writing too
+	// slowly too often (see Service.SlowWriteThreshold).
+	slowConsumerCloseCode = 4002
+
+	// Application close code of peer connections closed for a rejected
+	// message under the "close" ErrorPolicy (see Service.ErrorPolicy).
+	errorCloseCode = 4003
+
+	// Time allowed for a peer to acknowledge a broadcast on a stop-and-wait channel.
+	defaultAckTimeout = 30 * time.Second
+
+	// Time by which the clock of a federated service may be ahead of this
+	// service's clock before broadcasts it forwards are dropped too early.
+	defaultClockSkewTolerance = 250 * time.Millisecond
+
+	// Time a websocket upgrade may wait for the service's MaxUpgradeRate to
+	// allow it before it is rejected.
+	defaultMaxUpgradeWait = time.Second
+
+	// Maximum number of messages queued for writing to any websocket.
+	sendQueueSize = 512
 )
 
 type MessageHandler interface {
@@ -34,7 +69,9 @@ type MessageHandler interface {
 
 // JSON structure to message sending
 type WireMessage struct {
-	// Proxy message type: "connect", "disconnect", "message", "broadcast"
+	// Proxy message type: "connect", "disconnect", "message", "broadcast", "error", "ack",
+	// "request", "response", "sample", "credit",
+	// "migrate", "drain", "echo", "clusterstatus"
 	Action string `json:"action"`
 
 	Source string `json:"source,omitempty"`
@@ -44,8 +81,84 @@ type WireMessage struct {
 	// Message contents
 	Payload string `json:"data,omitempty"`
 
+	// Application close code of "disconnect" messages (reason is in Payload)
+	Code int `json:"code,omitempty"`
+
+	// Name of the channel a broadcast was sent on, set on broadcasts delivered
+	// to subtree channels (e.g. "house.livingroom.*")
+	Channel string `json:"channel,omitempty"`
+
+	// Broadcasts with the same source and coalesce key replace each other while
+	// queued for delivery on channels that coalesce broadcasts
+	CoalesceKey string `json:"coalesce,omitempty"`
+
+	// Fraction (0-1) or number of channel peers a "sample" message is
+	// delivered to, chosen at random (deterministically if Seed is set).
+	// Count is also the window size of "credit" messages.
+	Fraction float64 `json:"fraction,omitempty"`
+	Count    int     `json:"count,omitempty"`
+	Seed     int64   `json:"seed,omitempty"`
+
+	// Identifies the request of a "request" message that a "response"
+	// message responds to
+	Correlation string `json:"correlation,omitempty"`
+
+	// Broadcasts with a shard key are only delivered to peers that connected
+	// with the same shard key
+	Shard string `json:"shard,omitempty"`
+
+	// Times (in milliseconds since the unix epoch) an "echo" message was
+	// sent by a peer and received by the service
+	ClientTime int64 `json:"clientTime,omitempty"`
+	ServerTime int64 `json:"serverTime,omitempty"`
+
+	// Maximum time (in milliseconds) a broadcast may wait to be written to
+	// each peer, after which it is dropped for that peer (0 = no limit)
+	MaxAge int `json:"maxAge,omitempty"`
+
+	// Time (in milliseconds since the unix epoch) a broadcast with a maxAge
+	// expires, set by the service its sender is connected to when it is
+	// forwarded to other services so they can drop it once it is stale
+	Deadline int64 `json:"deadline,omitempty"`
+
+	// Vector clock of broadcasts on channels with the VectorClocks option
+	Clock VectorClock `json:"clock,omitempty"`
+
+	// W3C traceparent of the span a broadcast was forwarded in, set between
+	// services with a SpanExporter
+	TraceParent string `json:"traceparent,omitempty"`
+
 	// Whether this message originated from a Proxy object
 	fromProxy bool `json:"-"`
+
+	// Whether this message should only be sent to proxy connections
+	remoteOnly bool `json:"-"`
+}
+
+// A message queued for writing to a websocket
+type queuedMessage struct {
+	buf []byte
+
+	// Queued messages with the same non-empty key replace each other
+	coalesceKey string
+
+	queuedAt time.Time
+
+	// Queued messages not written by this time are dropped (zero = never)
+	deadline time.Time
+
+	// Called once the message has been written or dropped, if not nil
+	done func()
+
+	// Number of earlier links the message failed to be forwarded over
+	attempts int
+}
+
+// Report that a queued message has left the queue
+func (message *queuedMessage) release() {
+	if message.done != nil {
+		message.done()
+	}
 }
 
 type Transport struct {
@@ -53,6 +166,39 @@ type Transport struct {
 	handler MessageHandler
 	open    bool
 	done    chan int // blocks until .Stop() is called
+
+	// Outbound messages waiting to be written by the write pump
+	queue   []*queuedMessage
+	queueMu sync.Mutex
+	queued  chan bool // signals the write pump that messages are queued
+
+	// Serializes all writes to the websocket connection
+	writeMu sync.Mutex
+
+	// Queued messages waiting longer than this are abandoned instead of
+	// written (0 = never abandon queued messages)
+	abandonAfter time.Duration
+
+	// Counts queued messages dropped because their deadline passed, if not nil
+	lateDrops *uint64
+
+	// Called with each queued message the handler failed to write, before
+	// the message is released, if not nil
+	writeFailed func(message *queuedMessage)
+
+	// Counts the running read and write pumps of this transport, if not nil
+	goroutines *int64
+
+	// Writes queued messages instead of this transport's own write pump,
+	// if not nil
+	writer *channelWriter
+
+	// If not nil, the read pump holds incoming messages until this is
+	// closed, e.g. until the connection is fully registered
+	readGate chan bool
+
+	closed    chan bool // closed when .Stop() is called
+	closeOnce sync.Once
 }
 
 func NewTransport(conn *websocket.Conn, handler MessageHandler) *Transport {
@@ -61,6 +207,11 @@ func NewTransport(conn *websocket.Conn, handler MessageHandler) *Transport {
 		handler: handler,
 
 		done: make(chan int, 1),
+
+		queue:  make([]*queuedMessage, 0),
+		queued: make(chan bool, 1),
+
+		closed: make(chan bool),
 	}
 
 	return transport
@@ -68,10 +219,20 @@ func NewTransport(conn *websocket.Conn, handler MessageHandler) *Transport {
 
 func (t *Transport) Start() {
 	var wg sync.WaitGroup
-	wg.Add(2)
 
-	go t.readPump(&wg)
-	go t.writePump(&wg)
+	if t.writer != nil {
+		t.writer.add(t)
+	} else {
+		wg.Add(1)
+		t.spawn(func() { t.writePump(&wg) })
+	}
+
+	// Transports without a websocket connection (e.g. of synthetic peers)
+	// have nothing to read
+	if t.conn != nil {
+		wg.Add(1)
+		t.spawn(func() { t.readPump(&wg) })
+	}
 
 	t.open = true
 
@@ -79,8 +240,36 @@ func (t *Transport) Start() {
 }
 
 func (t *Transport) Stop() {
+	// Write any queued messages before closing the connection
+	t.flush()
+
 	t.open = false
 
+	if t.writer != nil {
+		t.writer.remove(t)
+	}
+
+	if t.conn != nil {
+		t.conn.Close()
+	}
+
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+}
+
+// Close the websocket connection, which ends the read pump and so notifies
+// StopNotify. Transports without a connection notify StopNotify directly.
+// Use Stop instead to write queued messages first.
+func (t *Transport) closeConn() {
+	if t.conn == nil {
+		select {
+		case t.done <- 1:
+		default:
+		}
+		return
+	}
+
 	t.conn.Close()
 }
 
@@ -100,7 +289,32 @@ func (t *Transport) Read(buf []byte) error {
 	return t.handler.Read(buf)
 }
 
+// Queue a message to be written to the websocket
 func (t *Transport) Write(buf []byte) error {
+	return t.WriteCoalesced(buf, "")
+}
+
+// Queue a message to be written to the websocket, replacing any message
+// with the same coalesce key that is still waiting to be written
+func (t *Transport) WriteCoalesced(buf []byte, coalesceKey string) error {
+	return t.writeBefore(buf, coalesceKey, time.Time{})
+}
+
+// Queue a message to be written to the websocket, coalesced like
+// WriteCoalesced, that is dropped if it is not written by the deadline
+// (zero = never)
+func (t *Transport) writeBefore(buf []byte, coalesceKey string, deadline time.Time) error {
+	return t.enqueue(&queuedMessage{buf, coalesceKey, time.Now(), deadline, nil, 0})
+}
+
+// Queue a message to be written to the websocket, calling done once it has
+// been written or dropped. done is not called if an error is returned.
+func (t *Transport) writeTracked(buf []byte, done func()) error {
+	return t.enqueue(&queuedMessage{buf, "", time.Now(), time.Time{}, done, 0})
+}
+
+// Queue a message, replacing any queued message with the same coalesce key
+func (t *Transport) enqueue(queued *queuedMessage) error {
 	if !t.open {
 		return errors.New("Transport is not currently active for writing")
 	}
@@ -109,7 +323,129 @@ func (t *Transport) Write(buf []byte) error {
 		return errors.New("Cannot write message. Transport does not have a handler assigned")
 	}
 
-	return t.handler.Write(buf)
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+
+	if queued.coalesceKey != "" {
+		for _, message := range t.queue {
+			if message.coalesceKey == queued.coalesceKey {
+				message.release()
+				message.buf = queued.buf
+				message.deadline = queued.deadline
+				message.done = queued.done
+				return nil
+			}
+		}
+	}
+
+	if len(t.queue) >= sendQueueSize {
+		return errors.New("Transport send queue is full. Message dropped")
+	}
+
+	t.queue = append(t.queue, queued)
+
+	// Wake up the write pump
+	if t.writer != nil {
+		t.writer.wake(t)
+		return nil
+	}
+	select {
+	case t.queued <- true:
+	default:
+	}
+
+	return nil
+}
+
+// Return the number of messages waiting to be written to the websocket
+func (t *Transport) queueDepth() int {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+
+	return len(t.queue)
+}
+
+// Return a copy of all messages waiting to be written to the websocket
+func (t *Transport) queuedMessages() []queuedMessage {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+
+	messages := make([]queuedMessage, len(t.queue))
+	for i, message := range t.queue {
+		messages[i] = *message
+	}
+	return messages
+}
+
+// Discard all messages waiting to be written to the websocket and return
+// the number of messages discarded
+func (t *Transport) discardQueue() int {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+
+	discarded := len(t.queue)
+	for _, message := range t.queue {
+		message.release()
+	}
+	t.queue = make([]*queuedMessage, 0)
+	return discarded
+}
+
+// Remove and return the next queued message, or nil if the queue is empty
+func (t *Transport) dequeue() *queuedMessage {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+
+	if len(t.queue) == 0 {
+		return nil
+	}
+
+	message := t.queue[0]
+	t.queue[0] = nil // allow to be garbage-collected
+	t.queue = t.queue[1:]
+
+	return message
+}
+
+// Write all queued messages to the websocket connection
+func (t *Transport) flush() {
+	t.flushUpTo(0)
+}
+
+// Write at most max queued messages (all queued messages if max <= 0) to
+// the websocket connection and return whether messages remain queued
+func (t *Transport) flushUpTo(max int) bool {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	for n := 0; max <= 0 || n < max; n++ {
+		message := t.dequeue()
+		if message == nil {
+			return false
+		}
+
+		if age := time.Since(message.queuedAt); t.abandonAfter > 0 && age > t.abandonAfter {
+			log.Printf("Abandoned message queued for %v (%d bytes)", age, len(message.buf))
+			message.release()
+			continue
+		}
+		if !message.deadline.IsZero() && time.Now().After(message.deadline) {
+			if t.lateDrops != nil {
+				atomic.AddUint64(t.lateDrops, 1)
+			}
+			message.release()
+			continue
+		}
+		if err := t.handler.Write(message.buf); err != nil {
+			log.Printf("err: %v", err)
+			if t.writeFailed != nil {
+				t.writeFailed(message)
+			}
+		}
+		message.release()
+	}
+
+	return t.queueDepth() > 0
 }
 
 // readPump pumps messages from an individual websocket connection to the dispatcher
@@ -123,6 +459,10 @@ func (t *Transport) readPump(wg *sync.WaitGroup) {
 
 	wg.Done()
 
+	if t.readGate != nil {
+		<-t.readGate
+	}
+
 	for {
 		opCode, buf, err := t.conn.ReadMessage()
 		if err != nil || opCode != websocket.TextMessage {
@@ -139,7 +479,8 @@ func (t *Transport) readPump(wg *sync.WaitGroup) {
 	t.done <- 1
 }
 
-// writePump keeps an individual websocket connection alive
+// writePump writes queued messages to an individual websocket connection
+// and keeps the websocket connection alive
 func (t *Transport) writePump(wg *sync.WaitGroup) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -150,15 +491,31 @@ func (t *Transport) writePump(wg *sync.WaitGroup) {
 
 	for {
 		select {
+		case <-t.queued:
+			t.flush()
+		case <-t.closed:
+			return
 		case <-ticker.C:
-			t.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := t.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if err := t.ping(); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// Write a ping to keep the websocket connection alive
+func (t *Transport) ping() error {
+	if t.conn == nil {
+		return nil
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.PingMessage, []byte{})
+}
+
 /** TLS-SRP Dialer interface **/
 
 type TLSSRPDialer struct {
@@ -1,6 +1,7 @@
 package networkwebsockets
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,6 +27,62 @@ func encodeWireMessage(action, source, target, payload string) ([]byte, error) {
 	return json.Marshal(m) // returns ([]byte, error)
 }
 
+func encodeDisconnectWireMessage(source, target string, code int, reason string) ([]byte, error) {
+	m := WireMessage{
+		Action:  "disconnect",
+		Source:  source,
+		Target:  target,
+		Payload: reason,
+		Code:    code,
+	}
+
+	return json.Marshal(m)
+}
+
+// Return the deadline (in milliseconds since the unix epoch) of a broadcast
+// received at the given time with the given maxAge, or 0 if it has none
+func broadcastDeadline(received time.Time, maxAge int) int64 {
+	if maxAge <= 0 {
+		return 0
+	}
+	return received.Add(time.Duration(maxAge)*time.Millisecond).UnixNano() / int64(time.Millisecond)
+}
+
+func encodeSubtreeBroadcastWireMessage(source, channel, payload string) ([]byte, error) {
+	m := WireMessage{
+		Action:  "broadcast",
+		Source:  source,
+		Payload: payload,
+		Channel: channel,
+	}
+
+	return json.Marshal(m)
+}
+
+func encodeCorrelatedWireMessage(action, source, target, payload, correlation string) ([]byte, error) {
+	m := WireMessage{
+		Action:      action,
+		Source:      source,
+		Target:      target,
+		Payload:     payload,
+		Correlation: correlation,
+	}
+
+	return json.Marshal(m)
+}
+
+func encodeEchoWireMessage(source, target string, clientTime, serverTime int64) ([]byte, error) {
+	m := WireMessage{
+		Action:     "echo",
+		Source:     source,
+		Target:     target,
+		ClientTime: clientTime,
+		ServerTime: serverTime,
+	}
+
+	return json.Marshal(m)
+}
+
 func decodeWireMessage(msg []byte) (WireMessage, error) {
 	var message WireMessage
 	err := json.Unmarshal(msg, &message)
@@ -33,7 +90,18 @@ func decodeWireMessage(msg []byte) (WireMessage, error) {
 	return message, err
 }
 
-func upgradeHTTPToWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+// Decode a wire message, failing if it contains any unknown fields
+func decodeStrictWireMessage(msg []byte) (WireMessage, error) {
+	var message WireMessage
+
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&message)
+
+	return message, err
+}
+
+func upgradeHTTPToWebSocket(w http.ResponseWriter, r *http.Request, readBufferSize, writeBufferSize int) (*websocket.Conn, error) {
 	// Chose a subprotocol from those offered in the client request
 	selectedSubprotocol := ""
 	if subprotocolsStr := strings.TrimSpace(r.Header.Get("Sec-Websocket-Protocol")); subprotocolsStr != "" {
@@ -42,8 +110,8 @@ func upgradeHTTPToWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.
 	}
 
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  8192,
-		WriteBufferSize: 8192,
+		ReadBufferSize:  readBufferSize,
+		WriteBufferSize: writeBufferSize,
 		CheckOrigin: func(r *http.Request) bool {
 			return true // allow all cross-origin access
 		},
@@ -68,6 +136,12 @@ func upgradeHTTPToWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.
 
 func dialProxyFromDNSRecord(record *DNSRecord, channel *Channel) error {
 
+	// Wait for a free dial slot, if concurrent dials are limited
+	if slots := channel.service.federationDialSlots(); slots != nil {
+		slots <- true
+		defer func() { <-slots }()
+	}
+
 	hosts := [...]string{record.AddrV4.String(), record.AddrV6.String()}
 
 	for i := 0; i < len(hosts); i++ {
@@ -90,8 +164,8 @@ func dialProxyFromDNSRecord(record *DNSRecord, channel *Channel) error {
 		tlsSrpDialer := &TLSSRPDialer{
 			&websocket.Dialer{
 				HandshakeTimeout: time.Duration(10) * time.Second,
-				ReadBufferSize:   8192,
-				WriteBufferSize:  8192,
+				ReadBufferSize:   channel.service.ReadBufferSize,
+				WriteBufferSize:  channel.service.WriteBufferSize,
 			},
 			&tls.Config{
 				SRPUser:     record.Hash_Base64,
@@ -102,17 +176,22 @@ func dialProxyFromDNSRecord(record *DNSRecord, channel *Channel) error {
 		ws, _, nErr := tlsSrpDialer.Dial(remoteWSUrl, map[string][]string{
 			"Origin":                 []string{"localhost"},
 			"Sec-WebSocket-Protocol": []string{"nws-proxy-draft-01"},
+			"X-Nws-Instance":         []string{channel.service.instanceId},
 		})
 		if nErr != nil {
+			channel.recordDial(addr, nErr)
 			errStr := fmt.Sprintf("Proxy named web socket connection to wss://%s%s failed: %s", remoteWSUrl.Host, remoteWSUrl.Path, nErr)
 			return errors.New(errStr)
 		}
+		channel.recordDial(addr, nil)
 
 		log.Printf("Established proxy named web socket connection to wss://%s%s", remoteWSUrl.Host, remoteWSUrl.Path)
 
 		// Create, bind and start a new proxy connection
-		proxyConn := NewProxy(ws, false)
+		proxyConn := newProxy(ws, false, channel.service.generateId())
 		proxyConn.setHash_Base64(record.Hash_Base64)
+		proxyConn.instance = record.ServiceInstance
+		proxyConn.lastSeen = time.Now().UnixNano()
 		proxyConn.Start(channel)
 
 		return nil
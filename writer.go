@@ -0,0 +1,150 @@
+package networkwebsockets
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of queued messages the shared writer of a channel writes to a
+// transport before moving on to the next transport with queued messages
+const writerBatchSize = 16
+
+// Writes the queued messages of all peer connections of a channel from a
+// single goroutine, for services with the "channel" WriterModel
+type channelWriter struct {
+	// Transports with queued messages, in the order they were queued
+	pending   []*Transport
+	isPending map[*Transport]bool
+
+	// All transports written by this writer, kept alive with pings
+	transports map[*Transport]bool
+
+	mu sync.Mutex
+
+	wakeup   chan bool
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+func newChannelWriter() *channelWriter {
+	writer := &channelWriter{
+		pending:    make([]*Transport, 0),
+		isPending:  make(map[*Transport]bool),
+		transports: make(map[*Transport]bool),
+
+		wakeup: make(chan bool, 1),
+		stop:   make(chan bool),
+	}
+
+	return writer
+}
+
+func (writer *channelWriter) add(t *Transport) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	writer.transports[t] = true
+}
+
+func (writer *channelWriter) remove(t *Transport) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	delete(writer.transports, t)
+}
+
+// Schedule the queued messages of a transport to be written
+func (writer *channelWriter) wake(t *Transport) {
+	writer.schedule(t)
+
+	select {
+	case writer.wakeup <- true:
+	default:
+	}
+}
+
+// Add a transport to the end of the transports with queued messages, if it
+// is not already among them
+func (writer *channelWriter) schedule(t *Transport) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if !writer.isPending[t] {
+		writer.isPending[t] = true
+		writer.pending = append(writer.pending, t)
+	}
+}
+
+// Remove and return the next transport with queued messages, or nil if
+// there is none
+func (writer *channelWriter) next() *Transport {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if len(writer.pending) == 0 {
+		return nil
+	}
+
+	t := writer.pending[0]
+	writer.pending[0] = nil // allow to be garbage-collected
+	writer.pending = writer.pending[1:]
+	delete(writer.isPending, t)
+
+	return t
+}
+
+// Write queued messages, up to writerBatchSize per transport at a time, one
+// transport after another, and keep all transports' websocket connections
+// alive until the writer is stopped. Transports with more queued messages
+// go to the back of the line, so a busy peer does not hold up the others
+// for longer than one batch. Writes still happen one at a time though: a
+// transport whose connection blocks on a write holds up every other
+// transport of the channel until the write completes or its write
+// deadline passes.
+func (writer *channelWriter) run() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-writer.wakeup:
+			for t := writer.next(); t != nil; t = writer.next() {
+				if t.flushUpTo(writerBatchSize) {
+					writer.schedule(t)
+				}
+			}
+		case <-ticker.C:
+			writer.mu.Lock()
+			transports := make([]*Transport, 0, len(writer.transports))
+			for t := range writer.transports {
+				transports = append(transports, t)
+			}
+			writer.mu.Unlock()
+
+			for _, t := range transports {
+				t.ping()
+			}
+		case <-writer.stop:
+			return
+		}
+	}
+}
+
+func (writer *channelWriter) Stop() {
+	writer.stopOnce.Do(func() {
+		close(writer.stop)
+	})
+}
+
+// Return the writer shared by all peer connections of this channel,
+// creating it if needed
+func (channel *Channel) sharedWriter() *channelWriter {
+	channel.writerMu.Lock()
+	defer channel.writerMu.Unlock()
+
+	if channel.writer == nil {
+		channel.writer = newChannelWriter()
+		channel.spawn(channel.writer.run)
+	}
+	return channel.writer
+}